@@ -4,24 +4,36 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const maxFileSize = 1024
 
 const (
-    ReadOnly     ConfigOpt = 0
-    ReadWrite    ConfigOpt = 1
-    SyncOnPut    ConfigOpt = 2
-    SyncOnDemand ConfigOpt = 3
+    ReadOnly     FlagOpt = 0
+    ReadWrite    FlagOpt = 1
+    SyncOnPut    FlagOpt = 2
+    SyncOnDemand FlagOpt = 3
+    CompactKeyDir FlagOpt = 4
 
     KeyDoesNotExist = "key does not exist"
     CannotOpenThisDir = "cannot open this directory"
     WriteDenied = "write permission denied"
     CannotCreateBitcask = "read only cannot create new bitcask directory"
     WriterExist = "another writer exists in this bitcask"
+    MalformedLine = "malformed line"
+    ValueTooLarge = "value too large for a compact keydir"
+    UnknownFormat = "unknown file format, run bitcask migrate"
+    UnsupportedVersion = "unsupported file format version"
+    OldVersion = "old file format version, run bitcask migrate"
+    DatastoreInUse = "datastore is open by another process"
+    MalformedKey = "malformed key"
+    BucketDoesNotExist = "bucket does not exist"
 )
 
 const (
@@ -31,8 +43,10 @@ const (
     keyDirFilePrefix = "keydir"
     hintFilePrefix = "hintfile"
 
-    staticFields = 3
+    staticFields = 7
     numberFieldSize = 19
+    hintHeaderSize = 6 * numberFieldSize
+    keyDirHeaderSize = 7 * numberFieldSize
 
     reader      processAccess = 0
     writer      processAccess = 1
@@ -41,34 +55,125 @@ const (
     readLock = ".readlock"
     writeLock = ".writelock"
 
-    maxPendingWrites = 100
+    readChunkSize = 1 << 20
 
-    tompStone = "DELETE THIS VALUE"
+    defaultMaxPendingBytes = 1 << 20
+    defaultMaxPendingAge = time.Second
+
+    tompStoneSize = -1
+
+    // the keys of the plain API live in defaultBucket, the names of the other buckets in catalogBucket.
+    // shardBucket, the lowest id, holds the marker of a shard being added to a Sharded datastore.
+    // The ids below defaultBucket are out of reach of the Bucket API.
+    defaultBucket int64 = 0
+    catalogBucket int64 = -1
+    shardBucket int64 = -2
 )
 
-type ConfigOpt int
+// ConfigOpt configures a bitcask process when passed to Open.
+type ConfigOpt interface {
+    apply(config *options)
+}
+
+// FlagOpt is a ConfigOpt that takes no value, like ReadWrite or SyncOnPut.
+type FlagOpt int
+
+type syncIntervalOpt time.Duration
+
+type syncBytesOpt int64
+
+type maxPendingBytesOpt int64
+
+type maxPendingAgeOpt time.Duration
+
+type loadWorkersOpt int
+
+type checkpointIntervalOpt time.Duration
 
 type BitcaskError string
 
 type processAccess int
 
-type pendingWrites map[string]string
+// pendingWrite is a write in the pending log. previous is the record on disk that the
+// write replaces, so a checkpoint taken before the write is flushed can still save it.
+type pendingWrite struct {
+    key bucketKey
+    line string
+    seq uint64
+    previous record
+    hasPrevious bool
+}
+
+type syncPolicy int
+
+const (
+    syncNever    syncPolicy = 0
+    syncAlways   syncPolicy = 1
+    syncInterval syncPolicy = 2
+    syncBytes    syncPolicy = 3
+)
 
 type Bitcask struct {
     directoryPath string
     lock string
     keyDirFile string
-    keyDir map[string]record
+    keyDir *bucketKeyDir
+    buckets map[string]int64
+    bucketNames map[int64]string
     config options
     currentActive activeFile
-    pendingWrites map[string]string
+    pendingWrites []pendingWrite
+    pendingIndex map[bucketKey]int
+    pendingBytes int64
+    pendingSince time.Time
+
+    // mu guards keyDir, the buckets, the pending writes and the write counters below.
+    // writeMu serializes every write and fsync of the data files, the
+    // writer holding it commits all pending writes as one group.
+    mu sync.RWMutex
+    writeMu sync.Mutex
+    // mergeMu serializes merges, it is taken before writeMu.
+    mergeMu sync.Mutex
+    lastFileId int64
+    lastSeq uint64
+    syncedSeq uint64
+    unsyncedBytes int64
+    stopBackground chan struct{}
+    backgroundDone sync.WaitGroup
+
+    // watchMu serializes the delivery of events to the watchers, it is taken before mu.
+    // mu guards the event queues, those of the watchers too, and the watcher counts. closed is closed by Close,
+    // so a write blocked on a watcher that stopped reading gives up.
+    watchMu sync.Mutex
+    closed chan struct{}
+    closeOnce sync.Once
+    watchers map[*watcher]bool
+    appliedWatchers int
+    syncedWatchers int
+    appliedEvents []Event
 }
 
 type activeFile struct {
-    file *os.File
+    file File
     fileName string
     currentPos int64
     currentSize int64
+    hints map[bucketKey]record
+    isTorn bool
+}
+
+// mergedRecord is a live record copied by Merge, previous is the record it replaces.
+type mergedRecord struct {
+    bucket int64
+    key string
+    record record
+    previous record
+}
+
+// bucketKey is a key in a bucket.
+type bucketKey struct {
+    bucket int64
+    key string
 }
 
 type record struct {
@@ -76,12 +181,39 @@ type record struct {
     valueSize int64
     valuePos int64
     tstamp int64
+    seq uint64
     isPending bool
 }
 
+// Entry is a value with the timestamp and sequence number of the write that stored it.
+type Entry struct {
+    Value string
+    Tstamp int64
+    Seq uint64
+}
+
+// Stats describes a bitcask datastore as seen by the process that opened it.
+type Stats struct {
+    Keys int `json:"keys"`
+    Buckets int `json:"buckets"`
+    DataFiles int `json:"data_files"`
+    DataBytes int64 `json:"data_bytes"`
+    HintFiles int `json:"hint_files"`
+    PendingWrites int `json:"pending_writes"`
+    PendingBytes int64 `json:"pending_bytes"`
+}
+
 type options struct {
-    writePermission ConfigOpt
-    syncOption ConfigOpt
+    writePermission FlagOpt
+    syncOption syncPolicy
+    syncInterval time.Duration
+    syncBytes int64
+    maxPendingBytes int64
+    maxPendingAge time.Duration
+    loadWorkers int
+    compactKeyDir bool
+    checkpointInterval time.Duration
+    fs FS
 }
 
 func (e BitcaskError) Error() string {
@@ -90,64 +222,186 @@ func (e BitcaskError) Error() string {
 
 }
 
+func (opt FlagOpt) apply(config *options) {
+
+    switch opt {
+    case ReadOnly, ReadWrite:
+        config.writePermission = opt
+    case SyncOnPut:
+        config.syncOption = syncAlways
+    case SyncOnDemand:
+        config.syncOption = syncNever
+    case CompactKeyDir:
+        config.compactKeyDir = true
+    }
+
+}
+
+// SyncEvery makes a ReadWrite process fsync its pending writes every interval.
+// Put returns as soon as the write is buffered.
+func SyncEvery(interval time.Duration) ConfigOpt {
+
+    return syncIntervalOpt(interval)
+
+}
+
+func (opt syncIntervalOpt) apply(config *options) {
+
+    config.syncOption = syncInterval
+    config.syncInterval = time.Duration(opt)
+
+}
+
+// SyncEveryBytes makes a ReadWrite process fsync once n bytes have been written since the last fsync.
+// The Put that crosses the limit returns only after the fsync is done.
+func SyncEveryBytes(n int64) ConfigOpt {
+
+    return syncBytesOpt(n)
+
+}
+
+func (opt syncBytesOpt) apply(config *options) {
+
+    config.syncOption = syncBytes
+    config.syncBytes = int64(opt)
+
+}
+
+// MaxPendingBytes bounds the memory held by writes that are not yet written to the data files.
+// A Put that fills the buffer writes it out before returning.
+func MaxPendingBytes(n int64) ConfigOpt {
+
+    return maxPendingBytesOpt(n)
+
+}
+
+func (opt maxPendingBytesOpt) apply(config *options) {
+
+    config.maxPendingBytes = int64(opt)
+
+}
+
+// MaxPendingAge bounds how long a write may stay buffered before a background flusher writes it out.
+func MaxPendingAge(age time.Duration) ConfigOpt {
+
+    return maxPendingAgeOpt(age)
+
+}
+
+func (opt maxPendingAgeOpt) apply(config *options) {
+
+    config.maxPendingAge = time.Duration(opt)
+
+}
+
+// CheckpointEvery makes a ReadWrite process save its keydir every interval,
+// in addition to the checkpoint saved by Close, so Open only replays the data written after it.
+func CheckpointEvery(interval time.Duration) ConfigOpt {
+
+    return checkpointIntervalOpt(interval)
+
+}
+
+func (opt checkpointIntervalOpt) apply(config *options) {
+
+    config.checkpointInterval = time.Duration(opt)
+
+}
+
+// LoadWorkers sets how many files Open parses at once to build the keydir, the number of CPUs by default.
+func LoadWorkers(n int) ConfigOpt {
+
+    return loadWorkersOpt(n)
+
+}
+
+func (opt loadWorkersOpt) apply(config *options) {
+
+    config.loadWorkers = int(opt)
+    if config.loadWorkers < 1 {
+        config.loadWorkers = 1
+    }
+
+}
+
 // Open creates a new process to manipulate the given bitcask datastore path.
-// It takes options ReadWrite, ReadOnly, SyncOnPut and SyncOnDemand.
+// It takes options ReadWrite, ReadOnly, SyncOnPut, SyncOnDemand, SyncEvery, SyncEveryBytes,
+// MaxPendingBytes, MaxPendingAge, CompactKeyDir, CheckpointEvery, LoadWorkers and FileSystem.
+// CompactKeyDir keeps the keydir in a packed form that needs a fraction of the memory per key,
+// at the cost of slower lookups, and limits values to 4GiB.
+// SyncOnPut fsyncs every write before Put returns, concurrent writers are committed as one group.
+// SyncOnDemand, the default, never fsyncs on its own, only Sync and Close do.
 // Only one ReadWrite process can open a bitcask at a time.
 // Only ReadWrite permission can create a new bitcask datastore.
 // If there is no bitcask datastore in the given path a new datastore is created when ReadWrite permission is given.
 func Open(dirPath string, opts ...ConfigOpt) (*Bitcask, error) {
 
     bitcask := Bitcask{
-        keyDir: make(map[string]record),
         directoryPath: dirPath,
-        config: options{writePermission: ReadOnly, syncOption: SyncOnDemand},
+        config: options{
+            writePermission: ReadOnly,
+            syncOption: syncNever,
+            maxPendingBytes: defaultMaxPendingBytes,
+            maxPendingAge: defaultMaxPendingAge,
+            loadWorkers: runtime.NumCPU(),
+            fs: OSFS{},
+        },
     }
 
     for _, opt := range opts {
-        switch opt {
-        case ReadWrite:
-            bitcask.config.writePermission = ReadWrite
-            bitcask.pendingWrites = make(map[string]string)
-        case SyncOnPut:
-            bitcask.config.syncOption = SyncOnPut
-        }
+        opt.apply(&bitcask.config)
+    }
+    bitcask.keyDir = bitcask.newBucketKeyDir()
+    bitcask.buckets = make(map[string]int64)
+    bitcask.bucketNames = make(map[int64]string)
+    bitcask.closed = make(chan struct{})
+
+    if bitcask.config.writePermission == ReadWrite {
+        bitcask.pendingIndex = make(map[bucketKey]int)
     }
 
-    _, openErr := os.Open(dirPath)
+    _, openErr := bitcask.config.fs.ReadDir(dirPath)
 
     if openErr == nil {
         if bitcask.lockCheck() == writer {
             return nil, BitcaskError(WriterExist)
         }
-        bitcask.buildKeyDir()
+        if err := bitcask.buildKeyDir(); err != nil {
+            return nil, err
+        }
         if bitcask.config.writePermission == ReadOnly {
             bitcask.buildKeyDirFile()
             bitcask.lock = readLock + strconv.Itoa(int(time.Now().UnixMicro()))
-            lockFile, _ := os.OpenFile(path.Join(bitcask.directoryPath, bitcask.lock),
-            os.O_CREATE, fileMode)
-            lockFile.Close()
+            bitcask.createLockFile()
         } else {
             bitcask.lock = writeLock + strconv.Itoa(int(time.Now().UnixMicro()))
-            lockFile, _ := os.OpenFile(path.Join(bitcask.directoryPath, bitcask.lock),
-            os.O_CREATE, fileMode)
-            lockFile.Close()
-            bitcask.createActiveFile()
+            bitcask.createLockFile()
+            if err := bitcask.createActiveFile(); err != nil {
+                bitcask.config.fs.Remove(path.Join(bitcask.directoryPath, bitcask.lock))
+                return nil, err
+            }
         }
 
     } else if os.IsNotExist(openErr) {
         if bitcask.config.writePermission == ReadOnly {
             return nil, BitcaskError(CannotCreateBitcask)
         }
-        os.MkdirAll(dirPath, dirMode)
-        bitcask.keyDir = make(map[string]record)
-        bitcask.createActiveFile()
+        bitcask.config.fs.MkdirAll(dirPath)
+        if err := bitcask.createActiveFile(); err != nil {
+            return nil, err
+        }
         bitcask.lock = writeLock + strconv.Itoa(int(time.Now().UnixMicro()))
-        lockFile, _ := os.OpenFile(path.Join(bitcask.directoryPath, bitcask.lock),
-        os.O_CREATE, fileMode)
-        lockFile.Close()
+        bitcask.createLockFile()
     } else {
         return nil, BitcaskError(fmt.Sprintf("%s: %s", dirPath, CannotOpenThisDir))
     }
+
+    if bitcask.config.writePermission == ReadWrite {
+        bitcask.stopBackground = make(chan struct{})
+        bitcask.backgroundDone.Add(1)
+        go bitcask.backgroundLoop()
+    }
+
     return &bitcask, nil
 }
 
@@ -155,99 +409,117 @@ func Open(dirPath string, opts ...ConfigOpt) (*Bitcask, error) {
 // returns an error if key does not exist in the bitcask datastore.
 func (bitcask *Bitcask) Get(key string) (string, error) {
 
-    recValue, isExist := bitcask.keyDir[key]
-
-    if !isExist {
-        return "", BitcaskError(fmt.Sprintf("%s: %s", string(key), KeyDoesNotExist))
-    }
+    bitcask.mu.RLock()
+    defer bitcask.mu.RUnlock()
 
-    if recValue.isPending {
-        _, value, _, _, _ := extractFileLine(bitcask.pendingWrites[key])
-        return value, nil
-    } else {
-        buf := make([]byte, recValue.valueSize)
-        file, _ := os.Open(path.Join(bitcask.directoryPath, recValue.fileId))
-        file.ReadAt(buf, recValue.valuePos)
-        file.Close()
-        return string(buf), nil
-    }
+    return bitcask.get(defaultBucket, key)
 
 }
 
-// Put stores a value by key in a bitcask datastore.
-// Sync on each put if SyncOnPut option is set.
-func (bitcask *Bitcask) Put(key string, value string) error {
+// GetEntry retrieves the value by key, as Get, with the timestamp and sequence number of its write.
+// returns an error if key does not exist in the bitcask datastore.
+func (bitcask *Bitcask) GetEntry(key string) (Entry, error) {
 
-    if bitcask.config.writePermission == ReadOnly {
-        return BitcaskError(WriteDenied)
-    }
+    bitcask.mu.RLock()
+    defer bitcask.mu.RUnlock()
 
-    tstamp := time.Now().UnixMicro()
-    bitcask.keyDir[key] = record{
-        fileId:    "",
-        valueSize: int64(len(value)),
-        valuePos:  0,
-        tstamp:    tstamp,
-        isPending: true,
+    value, err := bitcask.get(defaultBucket, key)
+    if err != nil {
+        return Entry{}, err
     }
-    bitcask.addPendingWrite(key, value, tstamp)
+    recValue, _ := bitcask.keyDir.get(defaultBucket, key)
 
-    if bitcask.config.syncOption == SyncOnPut {
-        bitcask.Sync()
-    }
+    return Entry{Value: value, Tstamp: recValue.tstamp, Seq: recValue.seq}, nil
 
-    return nil
+}
+
+// Put stores a value by key in a bitcask datastore.
+// With SyncOnPut, or when the write reaches the SyncEveryBytes limit,
+// Put returns only after the write has been fsynced to disk.
+func (bitcask *Bitcask) Put(key string, value string) error {
+
+    return bitcask.put(defaultBucket, "", key, value)
 
 }
 
 // Delete removes a key from a bitcask datastore 
-// by appending a special TompStone value that will be deleted in the next merge.
+// by appending a tompstone record that will be deleted in the next merge.
+// The tompstone is synced like the value of a Put.
 // returns an error if key does not exist in the bitcask datastore.
 func (bitcask *Bitcask) Delete(key string) error {
 
-    if bitcask.config.writePermission == ReadOnly {
-        return BitcaskError(WriteDenied)
-    }
+    return bitcask.delete(defaultBucket, "", key)
 
-    _, err := bitcask.Get(key)
-    if err != nil {
-        return err
-    }
+}
 
-    delete(bitcask.keyDir, key)
-    delete(bitcask.pendingWrites, key)
+// DeleteAll removes every key of a bitcask datastore, the keys of buckets left out,
+// by appending a tompstone of each key under a single lock, so no other write comes in between.
+// The tompstones are flushed like those of as many Deletes, possibly across several writes and data files,
+// so a crash in the middle may leave only some of the keys deleted.
+// returns an error if ReadWrite permission is not set.
+func (bitcask *Bitcask) DeleteAll() error {
 
-    return nil
+    return bitcask.deleteAll(defaultBucket)
 
 }
 
 // ListKeys list all keys in a bitcask datastore.
+// The keys of buckets are not listed, they are listed by the ListKeys of their Bucket.
 func (bitcask *Bitcask) ListKeys() []string {
 
-    var list []string
-
-    for key := range bitcask.keyDir {
-        list = append(list, key)
-    }
+    bitcask.mu.RLock()
+    defer bitcask.mu.RUnlock()
 
-    return list
+    return bitcask.listKeys(defaultBucket)
 
 }
 
-// Fold folds over all key/value pairs in a bitcask datastore.
+// Fold folds over all key/value pairs in a bitcask datastore, the keys of buckets left out.
 // fun is expected to be in the form: F(K, V, Acc) -> Acc
 func (bitcask *Bitcask) Fold(fun func(string, string, any) any, acc any) any {
 
-    for key := range bitcask.keyDir {
-        value, _ := bitcask.Get(key)
+    for _, key := range bitcask.ListKeys() {
+        value, err := bitcask.Get(key)
+        if err != nil {
+            continue
+        }
         acc = fun(key, value, acc)
     }
     return acc
 
 }
 
+// Stats returns the number of keys and buckets, the data and hint files on disk
+// and the writes not yet written to the data files.
+func (bitcask *Bitcask) Stats() Stats {
+
+    var stats Stats
+
+    files, _ := bitcask.config.fs.ReadDir(bitcask.directoryPath)
+    for _, file := range files {
+        if strings.HasPrefix(file.Name(), hintFilePrefix) {
+            stats.HintFiles++
+        } else if _, err := strconv.ParseInt(file.Name(), 10, 64); err == nil {
+            stats.DataFiles++
+            stats.DataBytes += file.Size()
+        }
+    }
+
+    bitcask.mu.RLock()
+    defer bitcask.mu.RUnlock()
+    stats.Keys = bitcask.keyDir.len(defaultBucket)
+    stats.Buckets = len(bitcask.buckets)
+    stats.PendingWrites = len(bitcask.pendingWrites)
+    stats.PendingBytes = bitcask.pendingBytes
+
+    return stats
+
+}
+
 // Merge rearrange the bitcask datastore in a more compact form.
 // Also produces hintfiles to provide a faster startup.
+// The live records are copied from a snapshot of the keydir, Get and Put only wait
+// while the snapshot is taken and while the keydir is pointed at the copies.
 // returns an error if ReadWrite permission is not set.
 func (bitcask *Bitcask) Merge() error {
 
@@ -255,78 +527,116 @@ func (bitcask *Bitcask) Merge() error {
         return BitcaskError(WriteDenied)
     }
 
-    var currentPos int64 = 0
-    var currentSize int64 = 0
-    var oldFiles []string
-    newKeyDir := make(map[string]record)
-
-    mergeFileName := strconv.FormatInt(time.Now().UnixMicro(), 10)
-    hintFileName := hintFilePrefix + mergeFileName
-    bitcask.Sync()
+    bitcask.mergeMu.Lock()
+    defer bitcask.mergeMu.Unlock()
 
-    mergeFile, _ := os.OpenFile(path.Join(bitcask.directoryPath, mergeFileName),
-    os.O_CREATE | os.O_RDWR, fileMode)
+    if err := bitcask.Sync(); err != nil {
+        return err
+    }
 
-    hintFile, _ := os.OpenFile(path.Join(bitcask.directoryPath, hintFileName),
-    os.O_CREATE | os.O_RDWR, fileMode)
+    var oldFiles []string
+    var merged []mergedRecord
+    var mergeFileNames []string
+
+    bitcask.writeMu.Lock()
+    bitcask.mu.Lock()
+
+    // the active file is kept, so a tailer that caught up with it is not sent back to the first file.
+    // The records of dropped buckets are not in keyDir, they are left behind with the old files.
+    sealedFileName := bitcask.currentActive.fileName
+    bitcask.keyDir.forEach(func(bucket int64, key string, recValue record) {
+        if !recValue.isPending && recValue.fileId != sealedFileName {
+            merged = append(merged, mergedRecord{bucket: bucket, key: key, previous: recValue})
+        }
+    })
 
-    
-    bitcaskDir, _ := os.Open(bitcask.directoryPath)
-    files, _ := bitcaskDir.Readdir(0)
-    for _, file := range files {
-        if file.Name() != bitcask.currentActive.fileName {
-            oldFiles = append(oldFiles, file.Name())
+    // the merged files are laid out before they are written, so their names are taken now,
+    // between the old files and the new active file: the active file stays the newest data file,
+    // as a checkpoint skips the files older than it, and a merged file is always removed
+    // by the next merge before a tompstone written during this one.
+    var currentPos int64 = int64(fileHeaderSize)
+    var currentSize int64 = 0
+    for i := range merged {
+        lineSize := staticFields * numberFieldSize + int64(len(merged[i].key)) + merged[i].previous.valueSize
+        if len(mergeFileNames) == 0 || (currentSize > 0 && lineSize + currentSize > maxFileSize) {
+            mergeFileNames = append(mergeFileNames, bitcask.nextFileName())
+            currentPos = int64(fileHeaderSize)
+            currentSize = 0
         }
+        merged[i].record = record{
+            fileId:    mergeFileNames[len(mergeFileNames) - 1],
+            valueSize: merged[i].previous.valueSize,
+            valuePos:  currentPos + staticFields * numberFieldSize + int64(len(merged[i].key)),
+            tstamp:    merged[i].previous.tstamp,
+            seq:       merged[i].previous.seq,
+            isPending: false,
+        }
+        currentPos += lineSize + 1
+        currentSize += lineSize + 1
     }
 
-    for key, recValue := range bitcask.keyDir {
-        if recValue.fileId != bitcask.currentActive.fileName {
-
-            tstamp := time.Now().UnixMicro()
-            value, _ := bitcask.Get(key)
-            fileLine := string(compressFileLine(key, value, tstamp))
-
-            if int64(len(fileLine)) + currentSize > maxFileSize {
-                mergeFile.Close()
-                hintFile.Close()
-
-                mergeFileName = strconv.FormatInt(time.Now().UnixMicro(), 10)
-                mergeFile, _ = os.OpenFile(path.Join(bitcask.directoryPath, mergeFileName),
-                os.O_CREATE | os.O_RDWR, fileMode)
+    // the active file is sealed, so no file merged or removed is written to during the merge.
+    err := bitcask.rotateActiveFile()
+    if err == nil {
+        files, _ := bitcask.config.fs.ReadDir(bitcask.directoryPath)
+        for _, file := range files {
+            name := file.Name()
+            if name != bitcask.currentActive.fileName && name != sealedFileName && name != hintFilePrefix + sealedFileName {
+                oldFiles = append(oldFiles, name)
+            }
+        }
+    }
+    bitcask.mu.Unlock()
+    bitcask.writeMu.Unlock()
+    if err != nil {
+        return err
+    }
 
-                hintFileName = hintFilePrefix + mergeFileName
-                hintFile, _ = os.OpenFile(path.Join(bitcask.directoryPath, hintFileName),
-                os.O_CREATE | os.O_RDWR, fileMode)
+    // old data files are removed oldest first, so a crash in between never leaves
+    // a value without the tompstone written after it.
+    sort.SliceStable(oldFiles, func(i, j int) bool {
+        first, firstErr := strconv.ParseInt(oldFiles[i], 10, 64)
+        second, secondErr := strconv.ParseInt(oldFiles[j], 10, 64)
+        if firstErr != nil || secondErr != nil {
+            return firstErr == nil && secondErr != nil
+        }
+        return first < second
+    })
 
-                currentPos = 0
-                currentSize = 0
-            }
+    if err := bitcask.writeMergeFiles(merged); err != nil {
+        return err
+    }
 
-            newKeyDir[key] = record{
-                fileId:    mergeFileName,
-                valueSize: int64(len(value)),
-                valuePos:  currentPos + staticFields * numberFieldSize + int64(len(key)),
-                tstamp:    tstamp,
-                isPending: false,
-            }
+    bitcask.writeMu.Lock()
+    bitcask.mu.Lock()
 
-            hintFileLine := buildHintFileLine(newKeyDir[key], key)
-            n, _ := fmt.Fprintln(mergeFile, fileLine)
-            fmt.Fprintln(hintFile, hintFileLine)
-            currentPos += int64(n)
-            currentSize += int64(n)
-        } else {
-            newKeyDir[key] = bitcask.keyDir[key]
+    // a key written or deleted since the snapshot keeps its newer record,
+    // and so does a pending write of a key that was merged.
+    mergedRecords := make(map[bucketKey]mergedRecord)
+    for _, rec := range merged {
+        if current, isExist := bitcask.keyDir.get(rec.bucket, rec.key); isExist && current == rec.previous {
+            bitcask.keyDir.put(rec.bucket, rec.key, rec.record)
         }
+        mergedRecords[bucketKey{rec.bucket, rec.key}] = rec
     }
+    for i, write := range bitcask.pendingWrites {
+        if rec, isExist := mergedRecords[write.key]; isExist && write.hasPrevious && write.previous == rec.previous {
+            bitcask.pendingWrites[i].previous = rec.record
+        }
+    }
+    bitcask.keyDir.releaseFileIds()
 
-    bitcask.keyDir = newKeyDir
-    mergeFile.Close()
-    hintFile.Close()
+    // the checkpoint pointing into the old files must go before them.
+    err = bitcask.config.fs.Remove(path.Join(bitcask.directoryPath, checkpointFileName))
+    bitcask.mu.Unlock()
+    bitcask.writeMu.Unlock()
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
 
     for _, file := range oldFiles {
-        if !strings.HasPrefix(file, ".") {
-            os.Remove(path.Join(bitcask.directoryPath, file))
+        if !strings.HasPrefix(file, ".") && file != replicationFileName {
+            bitcask.config.fs.Remove(path.Join(bitcask.directoryPath, file))
         }
     }
 
@@ -334,7 +644,8 @@ func (bitcask *Bitcask) Merge() error {
     
 }
 
-// Sync forces all pending writes to be written into disk.
+// Sync forces all pending writes to be written and fsynced into disk.
+// Writes of concurrent Put calls waiting for a sync are committed together.
 // returns an error if ReadWrite permission is not set.
 func (bitcask *Bitcask) Sync() error {
 
@@ -342,39 +653,44 @@ func (bitcask *Bitcask) Sync() error {
         return BitcaskError(WriteDenied)
     }
 
-    for key, line := range bitcask.pendingWrites {
-        if bitcask.keyDir[key].isPending {
-            recValue := bitcask.keyDir[key]
-
-            n := bitcask.writeToActiveFile(string(line))
+    bitcask.mu.RLock()
+    seq := bitcask.lastSeq
+    bitcask.mu.RUnlock()
 
-            recValue.fileId = bitcask.currentActive.fileName
-            recValue.valuePos = bitcask.currentActive.currentPos + staticFields * numberFieldSize + int64(len(key))
-            recValue.isPending = false
-            bitcask.keyDir[key] = recValue
+    return bitcask.commit(seq, true)
 
-            bitcask.currentActive.currentPos += n
-            bitcask.currentActive.currentSize += n
+}
 
-            delete(bitcask.pendingWrites, key)
-        }
-    }
+// Close flushes all pending writes into disk and closes the bitcask datastore.
+// The active file is sealed with a hint file and the keydir is checkpointed,
+// so the next Open does not have to read the data files. Closing it again does nothing.
+func (bitcask *Bitcask) Close() {
 
-    return nil
+    bitcask.closeOnce.Do(bitcask.shutdown)
 
 }
 
-// Close flushes all pending writes into disk and closes the bitcask datastore.
-func (bitcask *Bitcask) Close() {
+func (bitcask *Bitcask) shutdown() {
 
+    close(bitcask.closed)
     if bitcask.config.writePermission == ReadWrite {
+        close(bitcask.stopBackground)
+        bitcask.backgroundDone.Wait()
         bitcask.Sync()
+        bitcask.writeCheckpoint()
+        bitcask.closeWatchers()
         bitcask.currentActive.file.Close()
-        os.Remove(path.Join(bitcask.directoryPath, bitcask.lock))
+        activePath := path.Join(bitcask.directoryPath, bitcask.currentActive.fileName)
+        if bitcask.currentActive.currentSize == 0 {
+            bitcask.config.fs.Remove(activePath)
+        } else {
+            bitcask.writeHintFile(bitcask.currentActive.fileName, bitcask.currentActive.hints)
+        }
+        bitcask.config.fs.Remove(path.Join(bitcask.directoryPath, bitcask.lock))
     } else {
-        os.Remove(path.Join(bitcask.directoryPath, bitcask.keyDirFile))
-        os.Remove(path.Join(bitcask.directoryPath, bitcask.lock))
+        bitcask.closeWatchers()
+        bitcask.config.fs.Remove(path.Join(bitcask.directoryPath, bitcask.keyDirFile))
+        bitcask.config.fs.Remove(path.Join(bitcask.directoryPath, bitcask.lock))
     }
-    bitcask = nil
 
 }
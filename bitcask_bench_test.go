@@ -0,0 +1,279 @@
+package bitcask
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var benchBitcaskPath = path.Join("bench_dir")
+
+const benchValueSize = 100
+
+// openBenchBitcask opens a new datastore holding keys keys, synced to disk.
+func openBenchBitcask(b *testing.B, keys int, opts ...ConfigOpt) *Bitcask {
+
+    b.Helper()
+
+    os.RemoveAll(benchBitcaskPath)
+    bc, err := Open(benchBitcaskPath, append([]ConfigOpt{ReadWrite}, opts...)...)
+    if err != nil {
+        b.Fatal(err)
+    }
+    value := strings.Repeat("v", benchValueSize)
+    for i := 0; i < keys; i++ {
+        bc.Put(fmt.Sprintf("key%d", i), value)
+    }
+    bc.Sync()
+
+    return bc
+
+}
+
+func closeBenchBitcask(bc *Bitcask) {
+
+    bc.Close()
+    os.RemoveAll(benchBitcaskPath)
+
+}
+
+func BenchmarkPut(b *testing.B) {
+
+    modes := []struct {
+        name string
+        opt ConfigOpt
+    }{
+        {"sync on put", SyncOnPut},
+        {"sync on demand", SyncOnDemand},
+    }
+
+    for _, mode := range modes {
+        b.Run(mode.name, func(b *testing.B) {
+            bc := openBenchBitcask(b, 0, mode.opt)
+            defer closeBenchBitcask(bc)
+            value := strings.Repeat("v", benchValueSize)
+
+            b.SetBytes(benchValueSize)
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                bc.Put(fmt.Sprintf("key%d", i), value)
+            }
+            bc.Sync()
+        })
+    }
+
+}
+
+func BenchmarkGet(b *testing.B) {
+
+    const keys = 10000
+    bc := openBenchBitcask(b, keys)
+    defer closeBenchBitcask(bc)
+
+    b.Run("sequential", func(b *testing.B) {
+        b.SetBytes(benchValueSize)
+        for i := 0; i < b.N; i++ {
+            bc.Get(fmt.Sprintf("key%d", i % keys))
+        }
+    })
+
+    b.Run("random", func(b *testing.B) {
+        rng := rand.New(rand.NewSource(1))
+        b.SetBytes(benchValueSize)
+        for i := 0; i < b.N; i++ {
+            bc.Get(fmt.Sprintf("key%d", rng.Intn(keys)))
+        }
+    })
+
+}
+
+func BenchmarkFold(b *testing.B) {
+
+    const keys = 10000
+    bc := openBenchBitcask(b, keys)
+    defer closeBenchBitcask(bc)
+
+    b.SetBytes(keys * benchValueSize)
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        bc.Fold(func(key string, value string, acc any) any {
+            return acc.(int) + len(value)
+        }, 0)
+    }
+
+}
+
+// BenchmarkMerge merges datastores where a share of the records written, the fragmentation,
+// are overwritten values that the merge drops.
+func BenchmarkMerge(b *testing.B) {
+
+    const keys = 2000
+
+    for _, fragmentation := range []int{0, 50, 90} {
+        b.Run(fmt.Sprintf("%d%% fragmented", fragmentation), func(b *testing.B) {
+            value := strings.Repeat("w", benchValueSize)
+            overwrites := keys * fragmentation / (100 - fragmentation)
+
+            for i := 0; i < b.N; i++ {
+                b.StopTimer()
+                bc := openBenchBitcask(b, keys)
+                for j := 0; j < overwrites; j++ {
+                    bc.Put(fmt.Sprintf("key%d", j % keys), value)
+                }
+                bc.Sync()
+                b.StartTimer()
+
+                bc.Merge()
+
+                b.StopTimer()
+                closeBenchBitcask(bc)
+            }
+        })
+    }
+
+}
+
+// writeLoadBitcask writes keys keys to a new datastore, spread over one data file and one hint file
+// per maxFileSize bytes, and returns the number of data files.
+func writeLoadBitcask(b *testing.B, keys int) int {
+
+    b.Helper()
+
+    os.RemoveAll(benchBitcaskPath)
+    b1, err := Open(benchBitcaskPath, ReadWrite)
+    if err != nil {
+        b.Fatal(err)
+    }
+    for i := 0; i < keys; i++ {
+        b1.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+    }
+    b1.Close()
+
+    files, _ := os.ReadDir(benchBitcaskPath)
+    dataFiles := 0
+    for _, file := range files {
+        if _, err := strconv.ParseInt(file.Name(), 10, 64); err == nil {
+            dataFiles++
+        }
+    }
+
+    return dataFiles
+
+}
+
+// removeBenchFiles removes the files of the bench datastore whose name starts with prefix.
+func removeBenchFiles(prefix string) {
+
+    files, _ := os.ReadDir(benchBitcaskPath)
+    for _, file := range files {
+        if strings.HasPrefix(file.Name(), prefix) {
+            os.Remove(path.Join(benchBitcaskPath, file.Name()))
+        }
+    }
+
+}
+
+// BenchmarkOpen measures a whole read only Open and Close, from the checkpoint saved by Close, then,
+// with the checkpoint removed, from the hint files and from the data files alone, as after a crash.
+// Besides the loader it creates a lock file and writes the keydir file of a reader, which dwarf
+// a load from the checkpoint.
+func BenchmarkOpen(b *testing.B) {
+
+    b.Logf("%d data files", writeLoadBitcask(b, 30000))
+    defer os.RemoveAll(benchBitcaskPath)
+
+    open := func(b *testing.B) {
+        for i := 0; i < b.N; i++ {
+            bc, err := Open(benchBitcaskPath)
+            if err != nil {
+                b.Fatal(err)
+            }
+            bc.Close()
+        }
+    }
+
+    b.Run("checkpoint", open)
+    // a read only process does not save a checkpoint on Close, so the files below are parsed on every Open.
+    removeBenchFiles(checkpointFileName)
+    b.Run("hint files", open)
+    removeBenchFiles(hintFilePrefix)
+    b.Run("data files", open)
+
+}
+
+// BenchmarkLoadKeyDir times the keydir loader of Open on its own, the parsing of the hint or data files
+// by a pool of workers and the merge of their records into the keydir, with the worker count of LoadWorkers.
+// The workers only shorten a load when there are CPUs, or reads of a cold disk, to run them side by side.
+func BenchmarkLoadKeyDir(b *testing.B) {
+
+    b.Logf("%d data files, %d CPUs", writeLoadBitcask(b, 100000), runtime.NumCPU())
+    defer os.RemoveAll(benchBitcaskPath)
+    removeBenchFiles(checkpointFileName)
+
+    load := func(b *testing.B, workers int) {
+        for i := 0; i < b.N; i++ {
+            bc := &Bitcask{
+                directoryPath: benchBitcaskPath,
+                config: options{writePermission: ReadOnly, loadWorkers: workers, fs: OSFS{}},
+            }
+            bc.keyDir = bc.newBucketKeyDir()
+            if err := bc.buildKeyDir(); err != nil {
+                b.Fatal(err)
+            }
+        }
+    }
+
+    for _, source := range []string{"hint files", "data files"} {
+        if source == "data files" {
+            removeBenchFiles(hintFilePrefix)
+        }
+        for _, workers := range []int{1, 4, 16} {
+            b.Run(fmt.Sprintf("%s with %d workers", source, workers), func(b *testing.B) {
+                load(b, workers)
+            })
+        }
+    }
+
+}
+
+func BenchmarkKeyDirMemory(b *testing.B) {
+
+    keyDirs := map[string]func() keyDirectory{
+        "map": func() keyDirectory { return make(mapKeyDir) },
+        "compact": func() keyDirectory { return newCompactKeyDir() },
+    }
+
+    for name, newKeyDir := range keyDirs {
+        b.Run(name, func(b *testing.B) {
+            const keys = 1000000
+            var before, after runtime.MemStats
+
+            for i := 0; i < b.N; i++ {
+                runtime.GC()
+                runtime.ReadMemStats(&before)
+
+                keyDir := newKeyDir()
+                for j := 0; j < keys; j++ {
+                    keyDir.put(fmt.Sprintf("key%015d", j), record{
+                        fileId:    fmt.Sprint(1700000000000000 + j / 10),
+                        valueSize: 100,
+                        valuePos:  int64(j % 10 * 100),
+                        tstamp:    int64(j),
+                        seq:       uint64(j),
+                    })
+                }
+
+                runtime.GC()
+                runtime.ReadMemStats(&after)
+                b.ReportMetric(float64(after.HeapAlloc - before.HeapAlloc) / keys, "bytes/key")
+                runtime.KeepAlive(keyDir)
+            }
+        })
+    }
+
+}
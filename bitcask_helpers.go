@@ -2,135 +2,647 @@ package bitcask
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
-	"os"
+	"io"
+	"math"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-func (bitcask *Bitcask) createActiveFile() {
+func (bitcask *Bitcask) createActiveFile() error {
 
-    fileName := strconv.FormatInt(time.Now().UnixMicro(), 10)
+    fileName := bitcask.nextFileName()
 
-    activeFile, _ := os.OpenFile(path.Join(bitcask.directoryPath, fileName),
-    os.O_CREATE | os.O_RDWR, fileMode)
+    activeFile, err := bitcask.createFileWithHeader(path.Join(bitcask.directoryPath, fileName))
+    if err != nil {
+        return err
+    }
 
     bitcask.currentActive.file = activeFile
     bitcask.currentActive.fileName = fileName
-    bitcask.currentActive.currentPos = 0
+    bitcask.currentActive.currentPos = int64(fileHeaderSize)
     bitcask.currentActive.currentSize = 0
+    bitcask.currentActive.hints = make(map[bucketKey]record)
+    bitcask.currentActive.isTorn = false
+
+    return nil
 
 }
 
-func (bitcask *Bitcask) buildKeyDir() {
+// buildKeyDir loads keyDir from the keydir file of a reader, when another reader is open,
+// or from the checkpoint, hint and data files, then the buckets from the catalog.
+// returns an error if a file is not in the current format.
+func (bitcask *Bitcask) buildKeyDir() error {
 
     if bitcask.config.writePermission == ReadOnly && bitcask.lockCheck() == reader {
-        keyDirData, _ := os.ReadFile(path.Join(bitcask.directoryPath, bitcask.keyDirFileCheck()))
-
-        bitcask.keyDir = make(map[string]record)
-        keyDirScanner := bufio.NewScanner(strings.NewReader(string(keyDirData)))
-
-        for keyDirScanner.Scan() {
-            line := keyDirScanner.Text()
+        keyDirFileName := bitcask.keyDirFileCheck()
+        keyDirFile, _ := bitcask.config.fs.Open(path.Join(bitcask.directoryPath, keyDirFileName))
+        defer keyDirFile.Close()
+
+        bitcask.keyDir = bitcask.newBucketKeyDir()
+        keyDirReader := bufio.NewReader(keyDirFile)
+        if _, err := readFileHeader(keyDirReader); err != nil && err != io.EOF {
+            return formatError(keyDirFileName, err)
+        }
 
-            key, fileId, valueSize, valuePos, tstamp := extractKeyDirFileLine(line)
+        for {
+            line, err := readSizedLine(keyDirReader, keyDirHeaderSize, 6)
+            if err != nil {
+                break
+            }
+            bucket, key, fileId, valueSize, valuePos, tstamp, seq, err := extractKeyDirFileLine(line)
+            if err != nil {
+                break
+            }
 
-            bitcask.keyDir[key] = record{
+            bitcask.keyDir.put(bucket, key, record{
                 fileId:    fileId,
                 valueSize: valueSize,
                 valuePos:  valuePos,
                 tstamp:    tstamp,
+                seq:       seq,
                 isPending: false,
-            }
+            })
         }
     } else {
         var fileNames []string
+        dataFiles := make(map[string]bool)
         hintFilesMap := make(map[string]string)
-        bitcaskDir, _ := os.Open(bitcask.directoryPath)
-        files, _ := bitcaskDir.Readdir(0)
+        files, _ := bitcask.config.fs.ReadDir(bitcask.directoryPath)
 
         for _, file := range files {
             name := file.Name()
             if strings.HasPrefix(name, hintFilePrefix) {
                 hintFilesMap[strings.Trim(name, hintFilePrefix)] = name
-                fileNames = append(fileNames, strings.Trim(name, hintFilePrefix))
-            } else {
+            } else if fileId, err := strconv.ParseInt(name, 10, 64); err == nil {
                 fileNames = append(fileNames, name)
+                dataFiles[name] = true
+                if fileId > bitcask.lastFileId {
+                    bitcask.lastFileId = fileId
+                }
             }
         }
 
-        for _, name := range fileNames {
-            if hint, isExist := hintFilesMap[name]; isExist {
-                bitcask.extractHintFile(hint)
-            } else {
-                var currentPos int64 = 0
-                fileData, _ := os.ReadFile(path.Join(bitcask.directoryPath, name))
-                fileScanner := bufio.NewScanner(strings.NewReader(string(fileData)))
-                for fileScanner.Scan() {
-                    line := fileScanner.Text()
-                    key, _, tstamp, keySize, valueSize := extractFileLine(line)
-                    bitcask.keyDir[key] = record{
-                    	fileId:    name,
-                    	valueSize: valueSize,
-                    	valuePos:  currentPos + staticFields * numberFieldSize + keySize,
-                    	tstamp:    tstamp,
-                    	isPending: false,
+        // with a valid checkpoint only the data written after it is replayed.
+        coveredFileId, coveredPos, isCheckpointed := bitcask.loadCheckpoint(dataFiles)
+
+        // files are parsed concurrently, the sequence numbers make the order
+        // their records are loaded into keyDir irrelevant.
+        fileNamesChan := make(chan string)
+        fileHintsChan := make(chan map[bucketKey]record)
+        var workers sync.WaitGroup
+        var loadErr error
+        var loadErrOnce sync.Once
+
+        for i := 0; i < bitcask.config.loadWorkers; i++ {
+            workers.Add(1)
+            go func() {
+                defer workers.Done()
+                for name := range fileNamesChan {
+                    var hints map[bucketKey]record
+                    var err error
+                    fileId, _ := strconv.ParseInt(name, 10, 64)
+                    if isCheckpointed && fileId == coveredFileId {
+                        hints, err = bitcask.extractDataFile(name, coveredPos)
+                    } else if hint, isExist := hintFilesMap[name]; isExist {
+                        hints, err = bitcask.extractHintFile(hint)
+                    } else {
+                        hints, err = bitcask.extractDataFile(name, 0)
+                    }
+                    if err != nil {
+                        loadErrOnce.Do(func() { loadErr = err })
+                        continue
                     }
-                    currentPos += int64(len(line) + 1)
+                    fileHintsChan <- hints
+                }
+            }()
+        }
+
+        go func() {
+            for _, name := range fileNames {
+                fileId, _ := strconv.ParseInt(name, 10, 64)
+                if !isCheckpointed || fileId >= coveredFileId {
+                    fileNamesChan <- name
                 }
             }
+            close(fileNamesChan)
+            workers.Wait()
+            close(fileHintsChan)
+        }()
+
+        deleted := make(map[bucketKey]uint64)
+        for hints := range fileHintsChan {
+            for key, recValue := range hints {
+                bitcask.loadRecord(key, recValue, recValue.valueSize == tompStoneSize, deleted)
+            }
+        }
+        if loadErr != nil {
+            return loadErr
+        }
+    }
+
+    return bitcask.loadBuckets()
+
+}
+
+// extractDataFile streams a data file from fromPos and returns the last record of every key in it,
+// tompstones hinted as in a hint file. Reading stops at the first torn or corrupted record.
+// returns an error if the data file is not in the current format.
+func (bitcask *Bitcask) extractDataFile(name string, fromPos int64) (map[bucketKey]record, error) {
+
+    hints, _, err := bitcask.scanDataFile(name, fromPos)
+    if err != nil {
+        return nil, err
+    }
+
+    // data files left without a hint file by a crashed writer get one now,
+    // a writer never appends to a data file it did not create.
+    if bitcask.config.writePermission == ReadWrite && fromPos == 0 && len(hints) > 0 {
+        bitcask.writeHintFile(name, hints)
+    }
+
+    return hints, nil
+
+}
+
+// scanDataFile returns the hints of a data file from fromPos, as extractDataFile,
+// and the offset of the end of its last intact record.
+func (bitcask *Bitcask) scanDataFile(name string, fromPos int64) (map[bucketKey]record, int64, error) {
+
+    var currentPos int64 = int64(fileHeaderSize)
+    hints := make(map[bucketKey]record)
+
+    dataFile, err := bitcask.config.fs.Open(path.Join(bitcask.directoryPath, name))
+    if err != nil {
+        return hints, 0, nil
+    }
+    defer dataFile.Close()
+    if _, err := readFileHeader(dataFile); err == io.EOF {
+        return hints, 0, nil
+    } else if err != nil {
+        return nil, 0, formatError(name, err)
+    }
+    if fromPos > currentPos {
+        if _, err := dataFile.Seek(fromPos, io.SeekStart); err != nil {
+            return hints, currentPos, nil
+        }
+        currentPos = fromPos
+    }
+    dataReader := bufio.NewReader(dataFile)
+
+    for {
+        line, err := readSizedLine(dataReader, staticFields * numberFieldSize, 5, 6)
+        if err != nil || !checkFileLine(line) {
+            break
+        }
+        bucket, key, value, tstamp, seq, isTompStone, err := extractFileLine(line)
+        if err != nil {
+            break
+        }
+        hints[bucketKey{bucket, key}] = hintRecord(record{
+            fileId:    name,
+            valueSize: int64(len(value)),
+            valuePos:  currentPos + staticFields * numberFieldSize + int64(len(key)),
+            tstamp:    tstamp,
+            seq:       seq,
+            isPending: false,
+        }, isTompStone)
+        currentPos += int64(len(line) + 1)
+    }
+
+    return hints, currentPos, nil
+
+}
+
+// readSizedLine reads a line of a data, hint or keydir file.
+// The line length comes from the sizes stored in the header fields sizeFields,
+// so keys and values may contain newlines. The newline ending the line is dropped.
+// The body is read as it comes rather than allocated from the sizes, so a corrupt size
+// fails with io.ErrUnexpectedEOF at the end of the file instead of exhausting memory.
+func readSizedLine(lineReader *bufio.Reader, headerSize int, sizeFields ...int) (string, error) {
+
+    header := make([]byte, headerSize)
+    if _, err := io.ReadFull(lineReader, header); err != nil {
+        return "", err
+    }
+
+    var bodySize int64 = 1
+    for _, field := range sizeFields {
+        size, err := strconv.ParseInt(string(header[field * numberFieldSize:(field + 1) * numberFieldSize]), 10, 64)
+        if err != nil || size < 0 || size > math.MaxInt64 - bodySize {
+            return "", BitcaskError(MalformedLine)
+        }
+        bodySize += size
+    }
+
+    capacity := bodySize
+    if capacity > maxFileSize {
+        capacity = maxFileSize
+    }
+    body := bytes.NewBuffer(make([]byte, 0, capacity))
+    if n, err := io.CopyN(body, lineReader, bodySize); n < bodySize {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return "", err
+    }
+
+    return string(header) + string(body.Bytes()[:bodySize - 1]), nil
+
+}
+
+// loadRecord adds a record read from disk to keyDir, unless a write of the key
+// with a higher sequence number, put or delete, was already loaded.
+func (bitcask *Bitcask) loadRecord(key bucketKey, recValue record, isTompStone bool, deleted map[bucketKey]uint64) {
+
+    if recValue.seq > bitcask.lastSeq {
+        bitcask.lastSeq = recValue.seq
+    }
+
+    if current, isExist := bitcask.keyDir.get(key.bucket, key.key); isExist && current.seq >= recValue.seq {
+        return
+    }
+    if deletedSeq, isExist := deleted[key]; isExist && deletedSeq >= recValue.seq {
+        return
+    }
+
+    if isTompStone {
+        bitcask.keyDir.delete(key.bucket, key.key)
+        deleted[key] = recValue.seq
+    } else {
+        bitcask.keyDir.put(key.bucket, key.key, recValue)
+    }
+
+}
+
+func (bitcask *Bitcask) get(bucket int64, key string) (string, error) {
+
+    recValue, isExist := bitcask.keyDir.get(bucket, key)
+
+    if !isExist {
+        return "", BitcaskError(fmt.Sprintf("%s: %s", string(key), KeyDoesNotExist))
+    }
+
+    if recValue.isPending {
+        _, _, value, _, _, _, _ := extractFileLine(bitcask.pendingWrites[bitcask.pendingIndex[bucketKey{bucket, key}]].line)
+        return value, nil
+    } else {
+        file, err := bitcask.config.fs.Open(path.Join(bitcask.directoryPath, recValue.fileId))
+        if err != nil {
+            return "", err
+        }
+        defer file.Close()
+        value, err := readValue(file, recValue.valuePos, recValue.valueSize)
+        if err != nil {
+            return "", err
         }
+        return string(value), nil
     }
 
 }
 
-func (bitcask *Bitcask) addPendingWrite(key string, value string, tstamp int64) {
-    
-    if len(bitcask.pendingWrites) == maxPendingWrites {
-        bitcask.Sync()
+// readValue reads size bytes at pos, at most readChunkSize at a time,
+// so a corrupt size fails at the end of the file instead of exhausting memory.
+func readValue(file io.ReaderAt, pos int64, size int64) ([]byte, error) {
+
+    var value []byte
+    for int64(len(value)) < size {
+        chunk := size - int64(len(value))
+        if chunk > readChunkSize {
+            chunk = readChunkSize
+        }
+        buf := make([]byte, chunk)
+        n, err := file.ReadAt(buf, pos + int64(len(value)))
+        if err != nil && n < len(buf) {
+            return nil, err
+        }
+        if value == nil {
+            value = buf
+        } else {
+            value = append(value, buf...)
+        }
     }
-    bitcask.pendingWrites[key] = string(compressFileLine(key, value, tstamp))
+
+    return value, nil
 
 }
 
-func (bitcask *Bitcask) writeToActiveFile(line string) int64 {
+// addPendingWrite appends the write to the pending log and reports whether the log is full.
+// It must be called before keyDir is updated, to keep the record the write replaces.
+func (bitcask *Bitcask) addPendingWrite(bucket int64, key string, value string, tstamp int64, seq uint64, isTompStone bool) bool {
+
+    write := pendingWrite{
+        key: bucketKey{bucket, key},
+        line: string(compressFileLine(bucket, key, value, tstamp, seq, isTompStone)),
+        seq: seq,
+    }
+    if current, isExist := bitcask.keyDir.get(bucket, key); isExist && !current.isPending {
+        write.previous = current
+        write.hasPrevious = true
+    }
+
+    if len(bitcask.pendingWrites) == 0 {
+        bitcask.pendingSince = time.Now()
+    }
+    bitcask.pendingIndex[write.key] = len(bitcask.pendingWrites)
+    bitcask.pendingWrites = append(bitcask.pendingWrites, write)
+    line := write.line
+    bitcask.pendingBytes += int64(len(line) + 1)
+    bitcask.unsyncedBytes += int64(len(line) + 1)
+
+    return bitcask.pendingBytes >= bitcask.config.maxPendingBytes
+
+}
+
+// awaitWrite waits until the write with sequence number seq meets the durability of the sync option.
+// A write that fills the pending log writes it out even when no fsync is due.
+func (bitcask *Bitcask) awaitWrite(seq uint64, isFull bool, unsyncedBytes int64) error {
+
+    switch bitcask.config.syncOption {
+    case syncAlways:
+        return bitcask.commit(seq, true)
+    case syncBytes:
+        if unsyncedBytes >= bitcask.config.syncBytes {
+            return bitcask.commit(seq, true)
+        }
+    }
 
-    if int64(len(line)) + bitcask.currentActive.currentSize > maxFileSize {
-        newActiveFileName := strconv.FormatInt(time.Now().UnixMicro(), 10)
-        newActiveFile, _ := os.OpenFile(path.Join(bitcask.directoryPath, newActiveFileName), os.O_CREATE | os.O_RDWR, fileMode)
+    if isFull {
+        return bitcask.commit(seq, false)
+    }
+
+    return nil
+
+}
+
+// commit writes all pending writes to the active file, and fsyncs them when fsync is set.
+// Callers queue on writeMu, so the writes of every Put that arrived while
+// another commit was running go out in a single write and a single fsync.
+// A commit for seq that finds it already fsynced by an earlier group returns at once.
+// The events released by the fsync are delivered once writeMu is released.
+func (bitcask *Bitcask) commit(seq uint64, fsync bool) error {
+
+    var isReleased bool
+    defer func() {
+        if isReleased {
+            bitcask.deliverEvents()
+        }
+    }()
+
+    bitcask.writeMu.Lock()
+    defer bitcask.writeMu.Unlock()
+
+    if fsync && bitcask.syncedSeq >= seq {
+        return nil
+    }
+
+    bitcask.mu.Lock()
+    lastSeq := bitcask.lastSeq
+    writtenBytes := bitcask.unsyncedBytes
+    err := bitcask.flushPendingWrites()
+    bitcask.mu.Unlock()
+
+    if err != nil || !fsync {
+        return err
+    }
+
+    if err := bitcask.currentActive.file.Sync(); err != nil {
+        return err
+    }
+
+    bitcask.mu.Lock()
+    bitcask.unsyncedBytes -= writtenBytes
+    isReleased = bitcask.releaseSyncedEvents(lastSeq)
+    bitcask.mu.Unlock()
+    bitcask.syncedSeq = lastSeq
+
+    return nil
+
+}
+
+// flushPendingWrites writes the pending log, tompstones included, to the data files in sequence order.
+// keyDir is pointed at the written record of every key whose last write is still this one.
+func (bitcask *Bitcask) flushPendingWrites() error {
+
+    var batch bytes.Buffer
+    batchStart := 0
+    offsets := make([]int64, len(bitcask.pendingWrites))
+    writtenRecords := make(map[bucketKey]record)
+    room := maxFileSize - bitcask.currentActive.currentSize
+
+    flush := func(batchEnd int) error {
+        if batch.Len() > 0 {
+            pos, err := bitcask.writeToActiveFile(batch.Bytes())
+            if err != nil {
+                return err
+            }
+            for i := batchStart; i < batchEnd; i++ {
+                bucket, key, value, tstamp, seq, isTompStone, _ := extractFileLine(bitcask.pendingWrites[i].line)
+                written := record{
+                    fileId:    bitcask.currentActive.fileName,
+                    valueSize: int64(len(value)),
+                    valuePos:  pos + offsets[i] + staticFields * numberFieldSize + int64(len(key)),
+                    tstamp:    tstamp,
+                    seq:       seq,
+                    isPending: false,
+                }
+                bitcask.currentActive.hints[bucketKey{bucket, key}] = hintRecord(written, isTompStone)
+                writtenRecords[bucketKey{bucket, key}] = hintRecord(written, isTompStone)
+
+                recValue, isExist := bitcask.keyDir.get(bucket, key)
+                if isExist && recValue.isPending && recValue.seq == seq {
+                    bitcask.keyDir.put(bucket, key, written)
+                }
+            }
+            batch.Reset()
+            room = maxFileSize
+        }
+        batchStart = batchEnd
+        return nil
+    }
+
+    for i, write := range bitcask.pendingWrites {
+        if batch.Len() > 0 && int64(batch.Len() + len(write.line) + 1) > room {
+            if err := flush(i); err != nil {
+                bitcask.dropPendingWrites(batchStart, writtenRecords)
+                return err
+            }
+        }
+        offsets[i] = int64(batch.Len())
+        batch.WriteString(write.line)
+        batch.WriteByte('\n')
+    }
 
-        bitcask.currentActive.currentSize = 0
-        bitcask.currentActive.currentPos = 0
+    if err := flush(len(bitcask.pendingWrites)); err != nil {
+        bitcask.dropPendingWrites(batchStart, writtenRecords)
+        return err
+    }
+    bitcask.dropPendingWrites(len(bitcask.pendingWrites), writtenRecords)
+
+    return nil
+
+}
+
+// dropPendingWrites removes the first n writes of the pending log once they are written.
+// The first remaining write of a key takes the record just written for it as its previous record.
+func (bitcask *Bitcask) dropPendingWrites(n int, writtenRecords map[bucketKey]record) {
+
+    if n == len(bitcask.pendingWrites) {
+        bitcask.pendingWrites = nil
+        bitcask.pendingIndex = make(map[bucketKey]int)
+        bitcask.pendingBytes = 0
+        return
+    }
+
+    for _, write := range bitcask.pendingWrites[:n] {
+        bitcask.pendingBytes -= int64(len(write.line) + 1)
+    }
+    bitcask.pendingWrites = append([]pendingWrite(nil), bitcask.pendingWrites[n:]...)
+    for i, write := range bitcask.pendingWrites {
+        if written, isExist := writtenRecords[write.key]; isExist {
+            bitcask.pendingWrites[i].previous = written
+            bitcask.pendingWrites[i].hasPrevious = written.valueSize != tompStoneSize
+            delete(writtenRecords, write.key)
+        }
+    }
+    for key, index := range bitcask.pendingIndex {
+        if index < n {
+            delete(bitcask.pendingIndex, key)
+        } else {
+            bitcask.pendingIndex[key] = index - n
+        }
+    }
+
+}
+
+// writeToActiveFile appends data to the active file in one write and returns the position it was written at.
+// The active file is rotated first when data does not fit in it, or when a failed write may have left
+// part of a record at its end, which would hide the records written after it.
+func (bitcask *Bitcask) writeToActiveFile(data []byte) (int64, error) {
+
+    isFull := int64(len(data)) + bitcask.currentActive.currentSize > maxFileSize
+    if bitcask.currentActive.currentSize > 0 && (isFull || bitcask.currentActive.isTorn) {
+        if err := bitcask.rotateActiveFile(); err != nil {
+            return 0, err
+        }
+    }
+
+    pos := bitcask.currentActive.currentPos
+    n, err := bitcask.currentActive.file.Write(data)
+    bitcask.currentActive.currentPos += int64(n)
+    bitcask.currentActive.currentSize += int64(n)
+    if err != nil && n > 0 {
+        bitcask.currentActive.isTorn = true
+    }
+
+    return pos, err
+
+}
+
+// rotateActiveFile fsyncs, closes and seals the active file with a hint file and replaces it by a new one.
+// An empty active file is removed instead.
+func (bitcask *Bitcask) rotateActiveFile() error {
+
+    if bitcask.currentActive.currentSize == 0 {
         bitcask.currentActive.file.Close()
-        bitcask.currentActive.file = newActiveFile
-        bitcask.currentActive.fileName = newActiveFileName
+        bitcask.config.fs.Remove(path.Join(bitcask.directoryPath, bitcask.currentActive.fileName))
+    } else {
+        if err := syncAndClose(bitcask.currentActive.file); err != nil {
+            return err
+        }
+        // a missing hint file only makes the next Open scan the data file.
+        bitcask.writeHintFile(bitcask.currentActive.fileName, bitcask.currentActive.hints)
     }
 
-    n, _ := bitcask.currentActive.file.Write([]byte(fmt.Sprintln(line)))
-    return int64(n)
+    return bitcask.createActiveFile()
 
 }
 
-func compressFileLine(key string, value string, tstamp int64) []byte {
+// backgroundLoop writes out pending writes that reached the max pending age,
+// fsyncs every sync interval when SyncEvery is set and checkpoints when CheckpointEvery is set.
+func (bitcask *Bitcask) backgroundLoop() {
 
-    tstampStr := padWithZero(tstamp)
-    keySize := padWithZero(int64(len([]byte(key))))
-    valueSize := padWithZero(int64(len([]byte(value))))
-    return []byte(tstampStr + keySize + valueSize + string(key) + value)
+    defer bitcask.backgroundDone.Done()
+
+    flushTicker := time.NewTicker(tickInterval(bitcask.config.maxPendingAge / 2))
+    defer flushTicker.Stop()
+
+    var syncTick <-chan time.Time
+    if bitcask.config.syncOption == syncInterval {
+        syncTicker := time.NewTicker(tickInterval(bitcask.config.syncInterval))
+        defer syncTicker.Stop()
+        syncTick = syncTicker.C
+    }
+
+    var checkpointTick <-chan time.Time
+    if bitcask.config.checkpointInterval > 0 {
+        checkpointTicker := time.NewTicker(tickInterval(bitcask.config.checkpointInterval))
+        defer checkpointTicker.Stop()
+        checkpointTick = checkpointTicker.C
+    }
+
+    for {
+        select {
+        case <-flushTicker.C:
+            bitcask.mu.RLock()
+            isOld := len(bitcask.pendingWrites) > 0 &&
+            time.Since(bitcask.pendingSince) >= bitcask.config.maxPendingAge
+            seq := bitcask.lastSeq
+            bitcask.mu.RUnlock()
+            if isOld {
+                bitcask.commit(seq, false)
+            }
+        case <-syncTick:
+            bitcask.Sync()
+        case <-checkpointTick:
+            bitcask.writeCheckpoint()
+        case <-bitcask.stopBackground:
+            return
+        }
+    }
+
+}
+
+func tickInterval(interval time.Duration) time.Duration {
+
+    if interval < time.Millisecond {
+        return time.Millisecond
+    }
+
+    return interval
+
+}
+
+// nextFileName returns a name for a new data file, data file names grow with creation time.
+func (bitcask *Bitcask) nextFileName() string {
+
+    fileId := time.Now().UnixMicro()
+    if fileId <= bitcask.lastFileId {
+        fileId = bitcask.lastFileId + 1
+    }
+    bitcask.lastFileId = fileId
+
+    return strconv.FormatInt(fileId, 10)
 
 }
 
-func extractFileLine(line string) (string, string, int64, int64, int64) {
+func syncAndClose(files ...File) error {
 
-    tstamp, _ := strconv.ParseInt(line[0: 19], 10, 64)
-    keySize, _ := strconv.ParseInt(line[19:38], 10, 64)
-    valueSize, _ := strconv.ParseInt(line[38:57], 10, 64)
-    key := line[57:57+keySize]
-    value := line[57+keySize:]
+    for _, file := range files {
+        if err := file.Sync(); err != nil {
+            file.Close()
+            return err
+        }
+        if err := file.Close(); err != nil {
+            return err
+        }
+    }
 
-    return key, value, tstamp, keySize, valueSize
+    return nil
 
 }
 
@@ -138,76 +650,257 @@ func (bitcask *Bitcask) buildKeyDirFile() {
 
     keyDirFileName := keyDirFilePrefix + strconv.FormatInt(time.Now().UnixMicro(), 10)
     bitcask.keyDirFile = keyDirFileName
-    keyDirFile, _ := os.Create(path.Join(bitcask.directoryPath, keyDirFileName))
-    for key, recValue := range bitcask.keyDir {
-        fileId, _ := strconv.ParseInt(recValue.fileId, 10, 64)
-        fileIdStr:= padWithZero(fileId)
-        valueSizeStr:= padWithZero(recValue.valueSize)
-        valuePosStr:= padWithZero(recValue.valuePos)
-        tstampStr := padWithZero(recValue.tstamp)
-        keySizeStr := padWithZero(int64(len(key)))
+    keyDirFile, _ := bitcask.createFileWithHeader(path.Join(bitcask.directoryPath, keyDirFileName))
+    defer keyDirFile.Close()
+    keyDirWriter := bufio.NewWriter(keyDirFile)
+    defer keyDirWriter.Flush()
 
-        line := fileIdStr + valueSizeStr + valuePosStr + tstampStr + keySizeStr + key
-        fmt.Fprintln(keyDirFile, line)
-    }
+    bitcask.keyDir.forEach(func(bucket int64, key string, recValue record) {
+        fmt.Fprintln(keyDirWriter, buildKeyDirFileLine(recValue, bucket, key))
+    })
 
 }
 
-func extractKeyDirFileLine(line string) (string, string, int64, int64, int64) {
+func buildKeyDirFileLine(recValue record, bucket int64, key string) string {
 
-    fileId, _ := strconv.ParseInt(line[0:19], 10, 64)
-    valueSize, _ := strconv.ParseInt(line[19:38], 10, 64)
-    valuePos, _ := strconv.ParseInt(line[38:57], 10, 64)
-    tstamp, _ := strconv.ParseInt(line[57:76], 10, 64)
-    keySize, _ := strconv.ParseInt(line[76:95], 10, 64)
-    key := line[95:95+keySize]
+    fileId, _ := strconv.ParseInt(recValue.fileId, 10, 64)
+    fileIdStr:= padWithZero(fileId)
+    valueSizeStr:= padWithZero(recValue.valueSize)
+    valuePosStr:= padWithZero(recValue.valuePos)
+    tstampStr := padWithZero(recValue.tstamp)
+    seqStr := padWithZero(int64(recValue.seq))
+    bucketStr := padWithZero(bucket)
+    keySizeStr := padWithZero(int64(len(key)))
+
+    return fileIdStr + valueSizeStr + valuePosStr + tstampStr + seqStr + bucketStr + keySizeStr + key
+
+}
+
+// extractKeyDirFileLine returns the bucket, key and record of a keydir or checkpoint line.
+// returns MalformedLine if the line does not hold a record.
+func extractKeyDirFileLine(line string) (int64, string, string, int64, int64, int64, uint64, error) {
+
+    fields, err := parseFields(line, 7)
+    if err != nil {
+        return 0, "", "", 0, 0, 0, 0, err
+    }
+    fileId, valueSize, valuePos, tstamp, seq, bucket, keySize := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6]
+    if fileId < 0 || valueSize < 0 || valuePos < 0 || seq < 0 || bucket < shardBucket ||
+        keySize != int64(len(line) - keyDirHeaderSize) {
+        return 0, "", "", 0, 0, 0, 0, BitcaskError(MalformedLine)
+    }
+    key := line[keyDirHeaderSize:]
 
-    return key, strconv.FormatInt(fileId, 10), valueSize, valuePos, tstamp
+    return bucket, key, strconv.FormatInt(fileId, 10), valueSize, valuePos, tstamp, uint64(seq), nil
 
 }
 
-func buildHintFileLine(recValue record, key string) string {
+func buildHintFileLine(recValue record, bucket int64, key string) string {
 
     tstamp := padWithZero(recValue.tstamp)
+    seq := padWithZero(int64(recValue.seq))
+    bucketStr := padWithZero(bucket)
     keySize := padWithZero(int64(len(key)))
     valueSize := padWithZero(recValue.valueSize)
     valuePos := padWithZero(recValue.valuePos)
-    return tstamp + keySize + valueSize + valuePos + key
+    return tstamp + seq + bucketStr + keySize + valueSize + valuePos + key
 
 }
 
-func (bitcask *Bitcask) extractHintFile(hintName string) {
+// extractHintFileLine returns the bucket, key and the value size, value position, timestamp and sequence number of a hint line.
+// returns MalformedLine if the line does not hold a hint.
+func extractHintFileLine(line string) (int64, string, int64, int64, int64, uint64, error) {
 
-    hintFileData, _ := os.ReadFile(path.Join(bitcask.directoryPath, hintName))
-    hintFileScanner := bufio.NewScanner(strings.NewReader(string(hintFileData)))
+    fields, err := parseFields(line, 6)
+    if err != nil {
+        return 0, "", 0, 0, 0, 0, err
+    }
+    tstamp, seq, bucket, keySize, valueSize, valuePos := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5]
+    if seq < 0 || bucket < shardBucket || valueSize < tompStoneSize || valuePos < 0 ||
+        keySize != int64(len(line) - hintHeaderSize) {
+        return 0, "", 0, 0, 0, 0, BitcaskError(MalformedLine)
+    }
+    key := line[hintHeaderSize:]
+
+    return bucket, key, valueSize, valuePos, tstamp, uint64(seq), nil
+
+}
+
+// writeMergeFiles copies the values of the merged records to the data files laid out by Merge,
+// each with its hint file, and fsyncs them. The values are read from the records they replace,
+// in files that no write touches until the merge removes them.
+func (bitcask *Bitcask) writeMergeFiles(merged []mergedRecord) error {
+
+    var mergeFile, hintFile File
+    var mergeWriter, hintWriter *bufio.Writer
+    files := make(map[string]File)
+    defer func() {
+        for _, file := range files {
+            file.Close()
+        }
+    }()
+
+    closeMergeFiles := func() error {
+        if mergeFile == nil {
+            return nil
+        }
+        err := mergeWriter.Flush()
+        if err == nil {
+            err = hintWriter.Flush()
+        }
+        if err != nil {
+            mergeFile.Close()
+            hintFile.Close()
+            return err
+        }
+        return syncAndClose(mergeFile, hintFile)
+    }
+
+    for i, rec := range merged {
+        if i == 0 || rec.record.fileId != merged[i - 1].record.fileId {
+            if err := closeMergeFiles(); err != nil {
+                return err
+            }
+            var err error
+            mergeFile, err = bitcask.createFileWithHeader(path.Join(bitcask.directoryPath, rec.record.fileId))
+            if err != nil {
+                return err
+            }
+            hintFile, err = bitcask.createFileWithHeader(path.Join(bitcask.directoryPath, hintFilePrefix + rec.record.fileId))
+            if err != nil {
+                mergeFile.Close()
+                mergeFile = nil
+                return err
+            }
+            mergeWriter = bufio.NewWriter(mergeFile)
+            hintWriter = bufio.NewWriter(hintFile)
+        }
+
+        file, isExist := files[rec.previous.fileId]
+        if !isExist {
+            var err error
+            file, err = bitcask.config.fs.Open(path.Join(bitcask.directoryPath, rec.previous.fileId))
+            if err != nil {
+                mergeFile.Close()
+                hintFile.Close()
+                return err
+            }
+            files[rec.previous.fileId] = file
+        }
+        value, err := readValue(file, rec.previous.valuePos, rec.previous.valueSize)
+        if err != nil {
+            mergeFile.Close()
+            hintFile.Close()
+            return err
+        }
+
+        mergeWriter.Write(compressFileLine(rec.bucket, rec.key, string(value), rec.record.tstamp, rec.record.seq, false))
+        mergeWriter.WriteByte('\n')
+        fmt.Fprintln(hintWriter, buildHintFileLine(rec.record, rec.bucket, rec.key))
+    }
+
+    return closeMergeFiles()
+
+}
+
+// writeHintFile writes the hint file of a sealed data file.
+// It is written under a hidden name and renamed once synced, so Open never trusts a partial hint file.
+func (bitcask *Bitcask) writeHintFile(fileName string, hints map[bucketKey]record) error {
+
+    hintFileName := hintFilePrefix + fileName
+    tmpPath := path.Join(bitcask.directoryPath, "." + hintFileName)
+
+    hintFile, err := bitcask.createFileWithHeader(tmpPath)
+    if err != nil {
+        return err
+    }
+
+    hintWriter := bufio.NewWriter(hintFile)
+    for key, recValue := range hints {
+        fmt.Fprintln(hintWriter, buildHintFileLine(recValue, key.bucket, key.key))
+    }
+    if err := hintWriter.Flush(); err != nil {
+        hintFile.Close()
+        bitcask.config.fs.Remove(tmpPath)
+        return err
+    }
+    if err := syncAndClose(hintFile); err != nil {
+        bitcask.config.fs.Remove(tmpPath)
+        return err
+    }
+
+    return bitcask.config.fs.Rename(tmpPath, path.Join(bitcask.directoryPath, hintFileName))
+
+}
+
+// hintRecord returns the hint of a record, a tompstone is hinted with tompStoneSize as its value size.
+func hintRecord(recValue record, isTompStone bool) record {
+
+    if isTompStone {
+        recValue.valueSize = tompStoneSize
+    }
+
+    return recValue
+
+}
+
+// extractHintFile returns the records of a hint file.
+// returns an error if the hint file is not in the current format.
+func (bitcask *Bitcask) extractHintFile(hintName string) (map[bucketKey]record, error) {
+
+    hints := make(map[bucketKey]record)
+
+    hintFile, err := bitcask.config.fs.Open(path.Join(bitcask.directoryPath, hintName))
+    if err != nil {
+        return hints, nil
+    }
+    defer hintFile.Close()
+    hintReader := bufio.NewReader(hintFile)
+    if _, err := readFileHeader(hintReader); err == io.EOF {
+        return hints, nil
+    } else if err != nil {
+        return nil, formatError(hintName, err)
+    }
 
     fileId := strings.Trim(hintName, hintFilePrefix)
 
-    for hintFileScanner.Scan() {
-        line := hintFileScanner.Text()
-        tstamp, _ := strconv.ParseInt(line[0:19], 10, 64)
-        keySize, _ := strconv.ParseInt(line[19:38], 10, 64)
-        valueSize, _ := strconv.ParseInt(line[38:57], 10, 64)
-        valuePos, _ := strconv.ParseInt(line[57:76], 10, 64)
-        key := line[76:76+keySize]
+    for {
+        line, err := readSizedLine(hintReader, hintHeaderSize, 3)
+        if err != nil {
+            break
+        }
+        bucket, key, valueSize, valuePos, tstamp, seq, err := extractHintFileLine(line)
+        if err != nil {
+            break
+        }
 
-        bitcask.keyDir[key] = record{
+        hints[bucketKey{bucket, key}] = record{
         	fileId:    fileId,
         	valueSize: valueSize,
         	valuePos:  valuePos,
         	tstamp:    tstamp,
+        	seq:       seq,
         	isPending: false,
         }
     }
 
+    return hints, nil
+
+}
+
+func (bitcask *Bitcask) createLockFile() {
+
+    lockFile, err := bitcask.config.fs.Create(path.Join(bitcask.directoryPath, bitcask.lock))
+    if err == nil {
+        lockFile.Close()
+    }
+
 }
 
 func (bitcask *Bitcask) lockCheck() processAccess {
 
-    bitcaskDir, _ := os.Open(bitcask.directoryPath)
+    files, _ := bitcask.config.fs.ReadDir(bitcask.directoryPath)
 
-    files, _ := bitcaskDir.Readdir(0)
-    
     for _, file := range files {
         if strings.HasPrefix(file.Name(), readLock) {
             return reader
@@ -223,10 +916,8 @@ func (bitcask *Bitcask) lockCheck() processAccess {
 func (bitcask *Bitcask) keyDirFileCheck() string {
 
     var fileName string
-    bitcaskDir, _ := os.Open(bitcask.directoryPath)
+    files, _ := bitcask.config.fs.ReadDir(bitcask.directoryPath)
 
-    files, _ := bitcaskDir.Readdir(0)
-    
     for _, file := range files {
         if strings.HasPrefix(file.Name(), keyDirFilePrefix) {
             fileName = file.Name()
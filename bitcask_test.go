@@ -1,12 +1,18 @@
 package bitcask
 
 import (
+	"bytes"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var testBitcaskPath = path.Join("testing_dir")
@@ -17,22 +23,24 @@ func TestOpen(t *testing.T) {
 
     t.Run("open new bitcask with read and write permission", func(t *testing.T) {
 
-        Open(testBitcaskPath, ReadWrite)
+        b, _ := Open(testBitcaskPath, ReadWrite)
 
         if _, err := os.Stat(testBitcaskPath); os.IsNotExist(err) {
             t.Errorf("Expected to find directory: %q", testBitcaskPath)
         }
+        b.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
 
     t.Run("open new bitcask with sync_on_put option", func(t *testing.T) {
 
-        Open(testBitcaskPath, ReadWrite, SyncOnPut)
+        b, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut)
 
         if _, err := os.Stat(testBitcaskPath); os.IsNotExist(err) {
             t.Errorf("Expected to find directory: %q", testBitcaskPath)
         }
+        b.Close()
         os.RemoveAll(testBitcaskPath)
         
     })
@@ -45,6 +53,22 @@ func TestOpen(t *testing.T) {
 
     })
 
+    t.Run("close twice", func(t *testing.T) {
+
+        b1, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        b1.Put("key1", "value1")
+        b1.Close()
+        b1.Close()
+
+        fs := NewMemFS()
+        b2, _ := Open(testBitcaskPath, ReadWrite, FileSystem(fs))
+        b2.Close()
+        b3, _ := Open(testBitcaskPath, FileSystem(fs))
+        b3.Close()
+        b3.Close()
+
+    })
+
     t.Run("open existing bitcask with write permission", func(t *testing.T) {
 
         b1, _ := Open(testBitcaskPath, ReadWrite)
@@ -101,30 +125,183 @@ func TestOpen(t *testing.T) {
         want := "value50"
 
         assertString(t, got, want)
+        b2.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("every sealed data file has a hint file after close", func(t *testing.T) {
+
+        b1, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut)
+        for i := 0; i < 100; i++ {
+            b1.Put(fmt.Sprintf("key%d", i + 1), fmt.Sprintf("value%d", i + 1))
+        }
+        b1.Delete("key50")
+        b1.Close()
+
+        files, _ := os.ReadDir(testBitcaskPath)
+        names := make(map[string]bool)
+        for _, file := range files {
+            names[file.Name()] = true
+        }
+        for name := range names {
+            if _, err := strconv.ParseInt(name, 10, 64); err == nil && !names[hintFilePrefix + name] {
+                t.Errorf("data file %q has no hint file", name)
+            }
+        }
+
+        b2, _ := Open(testBitcaskPath)
+        got, _ := b2.Get("key49")
+        assertString(t, got, "value49")
+        _, err := b2.Get("key50")
+        assertError(t, err, "key50: key does not exist")
+        b2.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("open existing bitcask with compact keydir", func(t *testing.T) {
+
+        b1, _ := Open(testBitcaskPath, ReadWrite, CompactKeyDir)
+        for i := 0; i < 100; i++ {
+            b1.Put(fmt.Sprintf("key%d", i + 1), fmt.Sprintf("value%d", i + 1))
+        }
+        b1.Delete("key50")
+        b1.Merge()
+        b1.Close()
+
+        b2, _ := Open(testBitcaskPath, CompactKeyDir)
+        got, _ := b2.Get("key49")
+        assertString(t, got, "value49")
+        _, err := b2.Get("key50")
+        assertError(t, err, "key50: key does not exist")
+        if len(b2.ListKeys()) != 99 {
+            t.Errorf("got %d keys, want 99", len(b2.ListKeys()))
+        }
+        b2.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("open existing bitcask from its checkpoint", func(t *testing.T) {
+
+        b1, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut)
+        for i := 0; i < 100; i++ {
+            b1.Put(fmt.Sprintf("key%d", i + 1), fmt.Sprintf("value%d", i + 1))
+        }
+        b1.Close()
+
+        // a record only found by reading a data file the checkpoint covers.
+        files, _ := os.ReadDir(testBitcaskPath)
+        os.Remove(path.Join(testBitcaskPath, hintFilePrefix + files[0].Name()))
+        oldFile, _ := os.OpenFile(path.Join(testBitcaskPath, files[0].Name()), os.O_APPEND | os.O_WRONLY, fileMode)
+        fmt.Fprintln(oldFile, string(compressFileLine(defaultBucket, "ghost", "value", 1, 1000, false)))
+        oldFile.Close()
+
+        b2, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut)
+        b2.Put("key101", "value101")
+        b2.Delete("key1")
+        // crash without Close.
+        os.Remove(path.Join(testBitcaskPath, b2.lock))
+
+        b3, _ := Open(testBitcaskPath)
+        got, _ := b3.Get("key50")
+        assertString(t, got, "value50")
+        got, _ = b3.Get("key101")
+        assertString(t, got, "value101")
+        _, err := b3.Get("key1")
+        assertError(t, err, "key1: key does not exist")
+        _, err = b3.Get("ghost")
+        assertError(t, err, "ghost: key does not exist")
+        b3.Close()
+        b2.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("open existing bitcask with corrupted checkpoint", func(t *testing.T) {
+
+        b1, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut)
+        for i := 0; i < 100; i++ {
+            b1.Put(fmt.Sprintf("key%d", i + 1), fmt.Sprintf("value%d", i + 1))
+        }
+        b1.Close()
+
+        checkpointPath := path.Join(testBitcaskPath, checkpointFileName)
+        data, _ := os.ReadFile(checkpointPath)
+        data[len(data) - 2] ^= 1
+        os.WriteFile(checkpointPath, data, fileMode)
+
+        b2, _ := Open(testBitcaskPath)
+        for i := 0; i < 100; i++ {
+            got, _ := b2.Get(fmt.Sprintf("key%d", i + 1))
+            assertString(t, got, fmt.Sprintf("value%d", i + 1))
+        }
+        b2.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("open bitcask written before format versions", func(t *testing.T) {
+
+        writeLegacyFile(t, "100", legacyFileLine("key1", "value1", 1))
+
+        _, err := Open(testBitcaskPath)
+        assertError(t, err, "100: unknown file format, run bitcask migrate")
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("open bitcask with another format version", func(t *testing.T) {
+
+        b1, _ := Open(testBitcaskPath, ReadWrite)
+        b1.Put("key1", "value1")
+        fileName := b1.currentActive.fileName
+        b1.Close()
+
+        filePath := path.Join(testBitcaskPath, fileName)
+        data, _ := os.ReadFile(filePath)
+        copy(data[len(fileMagic):], padWithZero(formatVersion + 1))
+        os.WriteFile(filePath, data, fileMode)
+        os.Remove(path.Join(testBitcaskPath, hintFilePrefix + fileName))
+        os.Remove(path.Join(testBitcaskPath, checkpointFileName))
+
+        _, err := Open(testBitcaskPath)
+        assertError(t, err, fileName + ": unsupported file format version")
+
+        copy(data[len(fileMagic):], padWithZero(formatVersion - 1))
+        os.WriteFile(filePath, data, fileMode)
+        _, err = Open(testBitcaskPath)
+        assertError(t, err, fileName + ": old file format version, run bitcask migrate")
         os.RemoveAll(testBitcaskPath)
 
     })
 
     t.Run("open bitcask with writer exists in it", func(t *testing.T) {
 
-        Open(testBitcaskPath, ReadWrite)
+        b, _ := Open(testBitcaskPath, ReadWrite)
         _, err := Open(testBitcaskPath)
 
         assertError(t, err, "another writer exists in this bitcask")
+        b.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
 
     t.Run("open bitcask failed", func(t *testing.T) {
 
-        os.MkdirAll(path.Join("no open dir"), 000)
+        if os.Geteuid() == 0 {
+            t.Skip("root opens a directory whatever its permissions")
+        }
+        dirPath := path.Join(t.TempDir(), "no open dir")
+        os.MkdirAll(dirPath, 000)
+        t.Cleanup(func() { os.Chmod(dirPath, 0700) })
 
-        want := "no open dir: cannot open this directory"
-        _, err := Open("no open dir")
+        want := dirPath + ": cannot open this directory"
+        _, err := Open(dirPath)
 
         assertError(t, err, want)
-        os.RemoveAll("no open dir")
-            
+
     })
 
 }
@@ -143,6 +320,26 @@ func TestGet(t *testing.T) {
         want := "value12345"
 
         assertString(t, got, want)
+        b2.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("value with newlines from file", func(t *testing.T) {
+
+        b1, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut)
+        b1.Put("key\n1", "line1\nline2\n")
+        b1.Put("key2", "value2")
+        b1.Close()
+        os.Remove(path.Join(testBitcaskPath, hintFilePrefix + b1.currentActive.fileName))
+
+        b2, _ := Open(testBitcaskPath)
+
+        got, _ := b2.Get("key\n1")
+        assertString(t, got, "line1\nline2\n")
+        got, _ = b2.Get("key2")
+        assertString(t, got, "value2")
+        b2.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
@@ -156,6 +353,7 @@ func TestGet(t *testing.T) {
         want := "value12345"
 
         assertString(t, got, want)
+        b.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
@@ -168,6 +366,35 @@ func TestGet(t *testing.T) {
         _, err := b.Get("unknown key")
 
         assertError(t, err, want)
+        b.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+}
+
+func TestGetEntry(t *testing.T) {
+
+    t.Run("entries of pending and written values", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite)
+        b.Put("key1", "value1")
+        first, _ := b.GetEntry("key1")
+        b.Sync()
+        written, _ := b.GetEntry("key1")
+        b.Put("key1", "value2")
+        second, _ := b.GetEntry("key1")
+
+        if first != written {
+            t.Errorf("got %+v after sync, want %+v", written, first)
+        }
+        assertString(t, second.Value, "value2")
+        if second.Seq <= first.Seq || second.Tstamp < first.Tstamp {
+            t.Errorf("got %+v after %+v, want a later write", second, first)
+        }
+        _, err := b.GetEntry("key2")
+        assertError(t, err, "key2: key does not exist")
+        b.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
@@ -185,24 +412,87 @@ func TestPut(t *testing.T) {
         got, _ := b.Get("key12")
 
         assertString(t, got, want)
+        b.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
 
-    t.Run("reach max pending writes limit", func(t *testing.T) {
+    t.Run("reach max pending bytes limit", func(t *testing.T) {
 
-        b, _ := Open(testBitcaskPath, ReadWrite, SyncOnDemand)
+        b, _ := Open(testBitcaskPath, ReadWrite, SyncOnDemand, MaxPendingBytes(1000))
 
-        for i := 0; i <= maxPendingWrites; i++ {
+        for i := 0; i < 20; i++ {
             key := fmt.Sprintf("key%d", i + 1)
             value := fmt.Sprintf("value%d", i + 1)
             b.Put(key, value)
         }
 
-        _, isExist := b.pendingWrites["key101"]
-        if len(b.pendingWrites) != 1 && !isExist {
-            t.Error("max pending writes limit reached and no force sync happened")
-            t.Error(len(b.pendingWrites))
+        if b.pendingBytes >= 1000 {
+            t.Errorf("got %d pending bytes, want less than the 1000 bytes limit", b.pendingBytes)
+        }
+        if len(b.pendingWrites) == 20 {
+            t.Error("max pending bytes limit reached and no flush happened")
+        }
+
+        for i := 0; i < 20; i++ {
+            got, _ := b.Get(fmt.Sprintf("key%d", i + 1))
+            assertString(t, got, fmt.Sprintf("value%d", i + 1))
+        }
+        b.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("reach max pending age limit", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, SyncOnDemand, MaxPendingAge(10 * time.Millisecond))
+        b.Put("key12", "value12345")
+
+        time.Sleep(50 * time.Millisecond)
+        b.mu.RLock()
+        pending := len(b.pendingWrites)
+        b.mu.RUnlock()
+        if pending != 0 {
+            t.Errorf("got %d pending writes after the max pending age, want 0", pending)
+        }
+        b.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("pending writes reach disk in put order", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, SyncOnDemand)
+
+        var want []string
+        for i := 0; i < 10; i++ {
+            key := fmt.Sprintf("key%d", 10 - i)
+            b.Put(key, "value")
+            want = append(want, key)
+        }
+        b.Close()
+
+        // the writes may span several data files, their names grow with creation time.
+        var got []string
+        var lastSeq uint64
+        files, _ := os.ReadDir(testBitcaskPath)
+        for _, file := range files {
+            if _, err := strconv.ParseInt(file.Name(), 10, 64); err != nil {
+                continue
+            }
+            data, _ := os.ReadFile(path.Join(testBitcaskPath, file.Name()))
+            for _, line := range strings.Split(strings.TrimSuffix(string(data[fileHeaderSize:]), "\n"), "\n") {
+                _, key, _, _, seq, _, _ := extractFileLine(line)
+                if seq <= lastSeq {
+                    t.Errorf("got sequence number %d after %d, want increasing sequence numbers", seq, lastSeq)
+                }
+                lastSeq = seq
+                got = append(got, key)
+            }
+        }
+
+        if !reflect.DeepEqual(got, want) {
+            t.Errorf("got:\n%v\nwant:\n%v", got, want)
         }
         os.RemoveAll(testBitcaskPath)
 
@@ -217,6 +507,7 @@ func TestPut(t *testing.T) {
         err := b2.Put("key12", "value12345")
 
         assertError(t, err, "write permission denied")
+        b2.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
@@ -232,6 +523,25 @@ func TestDelete(t *testing.T) {
         b.Delete("key12")
         _, err := b.Get("key12")
         assertError(t, err, "key12: key does not exist")
+        b.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("deleted key stays deleted after reopen", func(t *testing.T) {
+
+        b1, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut)
+        b1.Put("key12", "value12345")
+        b1.Put("key13", "value13")
+        b1.Delete("key12")
+        b1.Close()
+
+        b2, _ := Open(testBitcaskPath, ReadWrite)
+        _, err := b2.Get("key12")
+        assertError(t, err, "key12: key does not exist")
+        got, _ := b2.Get("key13")
+        assertString(t, got, "value13")
+        b2.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
@@ -241,10 +551,46 @@ func TestDelete(t *testing.T) {
         b, _ := Open(testBitcaskPath, ReadWrite, SyncOnDemand)
         err := b.Delete("key12")
         assertError(t, err, "key12: key does not exist")
+        b.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
 
+    t.Run("delete all keys at once", func(t *testing.T) {
+
+        fs := NewMemFS()
+        b1, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut, FileSystem(fs))
+        for i := 0; i < 100; i++ {
+            b1.Put(fmt.Sprintf("key%d", i), "value")
+        }
+        users, _ := b1.Bucket("users")
+        users.Put("ada", "36")
+        events, cancel := b1.Watch("", WatchBuffer(100))
+        defer cancel()
+
+        if err := b1.DeleteAll(); err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        if keys := b1.ListKeys(); len(keys) != 0 {
+            t.Errorf("got keys %v, want none", keys)
+        }
+        if n := len(events); n != 100 {
+            t.Errorf("got %d delete events, want 100", n)
+        }
+        b1.Close()
+
+        b2, _ := Open(testBitcaskPath, FileSystem(fs))
+        defer b2.Close()
+        if keys := b2.ListKeys(); len(keys) != 0 {
+            t.Errorf("got keys %v after reopen, want none", keys)
+        }
+        users, _ = b2.Bucket("users")
+        got, _ := users.Get("ada")
+        assertString(t, got, "36")
+        assertError(t, b2.DeleteAll(), WriteDenied)
+
+    })
+
     t.Run("delete with no write permission", func(t *testing.T) {
 
         b1, _ := Open(testBitcaskPath, ReadWrite)
@@ -253,6 +599,7 @@ func TestDelete(t *testing.T) {
         b2, _ := Open(testBitcaskPath)
         err := b2.Delete("key12")
         assertError(t, err, "write permission denied")
+        b2.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
@@ -275,6 +622,7 @@ func TestListkeys(t *testing.T) {
         if !reflect.DeepEqual(got, want) {
             t.Errorf("got:\n%v\nwant:\n%v", got, want)
         }
+        b.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
@@ -303,6 +651,7 @@ func TestFold(t *testing.T) {
         if got != want {
             t.Errorf("got:%d, want:%d", got, want)
         }
+        b.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
@@ -330,6 +679,119 @@ func TestMerge(t *testing.T) {
 
     })
 
+    t.Run("newest value wins after merge and reopen", func(t *testing.T) {
+
+        b1, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut)
+
+        for i := 0; i < 100; i++ {
+            b1.Put(fmt.Sprintf("key%d", i % 10), fmt.Sprintf("value%d", i))
+        }
+        b1.Merge()
+        b1.Put("key3", "newest")
+        b1.Close()
+
+        b2, _ := Open(testBitcaskPath)
+        got, _ := b2.Get("key3")
+        assertString(t, got, "newest")
+        got, _ = b2.Get("key4")
+        assertString(t, got, "value94")
+        b2.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("key deleted after merge stays deleted after reopen", func(t *testing.T) {
+
+        b1, _ := Open(testBitcaskPath, ReadWrite)
+        for i := 0; i < 30; i++ {
+            b1.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+        }
+        b1.Merge()
+        b1.Delete("key1")
+        b1.Close()
+
+        b2, _ := Open(testBitcaskPath)
+        _, err := b2.Get("key1")
+        assertError(t, err, "key1: key does not exist")
+        b2.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("reads and writes go on while the records are copied", func(t *testing.T) {
+
+        fs := &pausingFS{MemFS: NewMemFS(), paused: make(chan struct{}), resume: make(chan struct{})}
+        b1, _ := Open(testBitcaskPath, ReadWrite, FileSystem(fs))
+        for i := 0; i < 30; i++ {
+            b1.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+        }
+
+        merged := make(chan error)
+        go func() {
+            merged <- b1.Merge()
+        }()
+        <-fs.paused
+
+        done := make(chan struct{})
+        go func() {
+            defer close(done)
+            b1.Put("key1", "new")
+            b1.Delete("key2")
+            got, _ := b1.Get("key3")
+            assertString(t, got, "value3")
+            b1.Sync()
+        }()
+        select {
+        case <-done:
+        case <-time.After(5 * time.Second):
+            t.Fatal("writes blocked by the merge")
+        }
+        close(fs.resume)
+        if err := <-merged; err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+
+        check := func(b *Bitcask) {
+            got, _ := b.Get("key1")
+            assertString(t, got, "new")
+            _, err := b.Get("key2")
+            assertError(t, err, "key2: key does not exist")
+            got, _ = b.Get("key3")
+            assertString(t, got, "value3")
+        }
+        check(b1)
+        // the copy of key2 made by the merge is removed before its tompstone.
+        b1.Merge()
+        b1.Close()
+
+        b2, _ := Open(testBitcaskPath, FileSystem(fs))
+        check(b2)
+        b2.Close()
+
+    })
+
+    t.Run("compact keydir drops the ids of the merged files", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, CompactKeyDir, FileSystem(NewMemFS()))
+        defer b.Close()
+        for round := 0; round < 5; round++ {
+            for i := 0; i < 100; i++ {
+                b.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d-%d", i, round))
+            }
+            if err := b.Merge(); err != nil {
+                t.Fatalf("got error %q, want none", err)
+            }
+        }
+
+        compact := b.keyDir.partitions[defaultBucket].(*compactKeyDir)
+        if dataFiles := b.Stats().DataFiles; len(compact.fileIds) > dataFiles + 1 {
+            t.Errorf("got %d file ids for %d data files", len(compact.fileIds) - 1, dataFiles)
+        }
+        got, _ := b.Get("key42")
+        assertString(t, got, "value42-4")
+
+    })
+
     t.Run("with no write permission", func(t *testing.T) {
 
         b1, _ := Open(testBitcaskPath, ReadWrite)
@@ -341,12 +803,35 @@ func TestMerge(t *testing.T) {
         want := "write permission denied"
 
         assertError(t, err, want)
+        b2.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
 
 }
 
+// pausingFS is a MemFS that pauses the first merge once it starts writing the merged files,
+// until resume is closed.
+type pausingFS struct {
+    *MemFS
+    paused chan struct{}
+    resume chan struct{}
+    once sync.Once
+}
+
+func (fs *pausingFS) Create(name string) (File, error) {
+
+    if strings.HasPrefix(path.Base(name), hintFilePrefix) {
+        fs.once.Do(func() {
+            close(fs.paused)
+            <-fs.resume
+        })
+    }
+
+    return fs.MemFS.Create(name)
+
+}
+
 func TestSync(t *testing.T) {
 
     t.Run("put with sync on put option is set", func(t *testing.T) {
@@ -358,6 +843,7 @@ func TestSync(t *testing.T) {
         got, _ := b.Get("key12")
 
         assertString(t, got, want)
+        b.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
@@ -376,6 +862,75 @@ func TestSync(t *testing.T) {
         got, _ := b.Get("key25")
 
         assertString(t, got, want)
+        b.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("concurrent puts with sync on put option is set", func(t *testing.T) {
+
+        b1, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut)
+
+        var wg sync.WaitGroup
+        for i := 0; i < 50; i++ {
+            wg.Add(1)
+            go func(i int) {
+                defer wg.Done()
+                b1.Put(fmt.Sprintf("key%d", i + 1), fmt.Sprintf("value%d", i + 1))
+            }(i)
+        }
+        wg.Wait()
+
+        if len(b1.pendingWrites) != 0 {
+            t.Errorf("got %d pending writes after put returned, want 0", len(b1.pendingWrites))
+        }
+        b1.Close()
+
+        b2, _ := Open(testBitcaskPath)
+        for i := 0; i < 50; i++ {
+            got, _ := b2.Get(fmt.Sprintf("key%d", i + 1))
+            assertString(t, got, fmt.Sprintf("value%d", i + 1))
+        }
+        b2.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("put with sync every interval option is set", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, SyncEvery(10 * time.Millisecond))
+        b.Put("key12", "value12345")
+
+        time.Sleep(50 * time.Millisecond)
+        b.mu.RLock()
+        pending := len(b.pendingWrites)
+        b.mu.RUnlock()
+        if pending != 0 {
+            t.Errorf("got %d pending writes after the sync interval, want 0", pending)
+        }
+
+        got, _ := b.Get("key12")
+        assertString(t, got, "value12345")
+        b.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("put with sync every bytes option is set", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, SyncEveryBytes(200))
+
+        b.Put("key1", "value1")
+        if len(b.pendingWrites) != 1 {
+            t.Errorf("got %d pending writes before the bytes limit, want 1", len(b.pendingWrites))
+        }
+
+        b.Put("key2", strings.Repeat("v", 200))
+        if len(b.pendingWrites) != 0 || b.unsyncedBytes != 0 {
+            t.Errorf("got %d pending writes and %d unsynced bytes after the bytes limit, want 0",
+            len(b.pendingWrites), b.unsyncedBytes)
+        }
+        b.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
@@ -389,12 +944,345 @@ func TestSync(t *testing.T) {
         err := b2.Sync()
 
         assertError(t, err, "write permission denied")
+        b2.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+}
+
+func TestStats(t *testing.T) {
+
+    t.Run("stats of pending and written keys", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, SyncOnDemand)
+        for i := 0; i < 10; i++ {
+            b.Put(fmt.Sprintf("key%d", i + 1), "value")
+        }
+        b.Delete("key10")
+
+        got := b.Stats()
+        want := Stats{Keys: 9, DataFiles: 1, DataBytes: int64(fileHeaderSize), PendingWrites: 11, PendingBytes: b.pendingBytes}
+        if got != want {
+            t.Errorf("got:\n%+v\nwant:\n%+v", got, want)
+        }
+
+        b.Sync()
+        got = b.Stats()
+        if got.Keys != 9 || got.PendingWrites != 0 || got.DataBytes <= int64(fileHeaderSize) {
+            t.Errorf("got %+v after sync, want 9 keys and no pending writes", got)
+        }
+        b.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+}
+
+func TestVerify(t *testing.T) {
+
+    t.Run("verify a closed bitcask", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite)
+        for i := 0; i < 100; i++ {
+            b.Put(fmt.Sprintf("key%d", i + 1), fmt.Sprintf("value%d", i + 1))
+        }
+        b.Delete("key1")
+        b.Close()
+
+        problems, err := Verify(testBitcaskPath)
+        if err != nil || len(problems) != 0 {
+            t.Errorf("got problems %v and error %v, want none", problems, err)
+        }
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("verify and repair a crashed bitcask", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut)
+        for i := 0; i < 100; i++ {
+            b.Put(fmt.Sprintf("key%d", i + 1), fmt.Sprintf("value%d", i + 1))
+        }
+        lastFile := b.currentActive.fileName
+        lock := b.lock
+        b.Close()
+
+        lastPath := path.Join(testBitcaskPath, lastFile)
+        info, _ := os.Stat(lastPath)
+        os.Truncate(lastPath, info.Size() - 3)
+        os.WriteFile(path.Join(testBitcaskPath, lock), nil, fileMode)
+        os.WriteFile(path.Join(testBitcaskPath, keyDirFilePrefix + "1"), nil, fileMode)
+        os.WriteFile(path.Join(testBitcaskPath, hintFilePrefix + "1"), nil, fileMode)
+
+        problems, _ := Verify(testBitcaskPath)
+        var got []string
+        for _, problem := range problems {
+            got = append(got, problem.Description)
+        }
+        sort.Strings(got)
+        want := []string{BadCheckpoint, HintMismatch, StaleLock, OrphanHintFile, TornRecord, StaleFile}
+        sort.Strings(want)
+        if !reflect.DeepEqual(got, want) {
+            t.Errorf("got:\n%v\nwant:\n%v", got, want)
+        }
+
+        Repair(testBitcaskPath)
+        problems, _ = Verify(testBitcaskPath)
+        if len(problems) != 0 {
+            t.Errorf("got problems %v after repair, want none", problems)
+        }
+
+        b, err := Open(testBitcaskPath)
+        if err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        got1, _ := b.Get("key1")
+        assertString(t, got1, "value1")
+        _, err = b.Get("key100")
+        assertError(t, err, "key100: key does not exist")
+        b.Close()
         os.RemoveAll(testBitcaskPath)
 
     })
 
 }
 
+func TestScanFile(t *testing.T) {
+
+    t.Run("scan a data file with a tompstone and a corrupted record", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite)
+        b.Put("key1", "value1")
+        b.Put("key2", "value2")
+        b.Delete("key1")
+        fileName := b.currentActive.fileName
+        b.Close()
+
+        filePath := path.Join(testBitcaskPath, fileName)
+        data, _ := os.ReadFile(filePath)
+        data[bytes.Index(data, []byte("value2"))] = 'V'
+        os.WriteFile(filePath, data, fileMode)
+
+        header, _ := ReadFileHeader(filePath)
+        if header.Kind != DataFile || header.Version != formatVersion {
+            t.Errorf("got header %+v, want a data file in version %d", header, formatVersion)
+        }
+
+        var got []FileRecord
+        err := ScanFile(filePath, func(rec FileRecord) {
+            got = append(got, rec)
+        })
+        if err != nil || len(got) != 3 {
+            t.Fatalf("got %d records and error %v, want 3 records", len(got), err)
+        }
+        if got[0].Offset != int64(fileHeaderSize) || got[0].Key != "key1" || got[0].Value != "value1" || got[0].Malformed != "" {
+            t.Errorf("got first record %+v", got[0])
+        }
+        assertString(t, got[1].Malformed, ChecksumMismatch)
+        if !got[2].IsTompStone || got[2].Seq != 3 {
+            t.Errorf("got last record %+v, want the tompstone of key1", got[2])
+        }
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("scan a hint file of a datastore in memory", func(t *testing.T) {
+
+        fs := NewMemFS()
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(fs))
+        b.Put("key1", "value1")
+        b.Put("key2", "value2")
+        b.Merge()
+        b.Close()
+
+        infos, _ := fs.ReadDir(testBitcaskPath)
+        var filePath string
+        for _, info := range infos {
+            if strings.HasPrefix(info.Name(), hintFilePrefix) && filePath == "" {
+                filePath = path.Join(testBitcaskPath, info.Name())
+            }
+        }
+        if _, err := ReadFileHeader(filePath); err == nil {
+            t.Errorf("read the header of %q from the operating system files", filePath)
+        }
+
+        header, err := ReadFileHeader(filePath, FileSystem(fs))
+        if err != nil || header.Kind != HintFile {
+            t.Errorf("got header %+v and error %v, want a hint file", header, err)
+        }
+        var keys []string
+        err = ScanFile(filePath, func(rec FileRecord) {
+            keys = append(keys, rec.Key)
+        }, FileSystem(fs))
+        if err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        assertKeys(t, keys, "key1", "key2")
+
+    })
+
+}
+
+func TestMigrate(t *testing.T) {
+
+    t.Run("migrate bitcask written before format versions", func(t *testing.T) {
+
+        // a merge used to write live records into files named after the active file.
+        writeLegacyFile(t, "100", legacyFileLine("key1", "value1", 10) + legacyFileLine("key2", "new\nvalue2", 30))
+        writeLegacyFile(t, "200", legacyFileLine("key2", "value2", 20) + legacyFileLine("key3", "value3", 40))
+
+        if err := Migrate(testBitcaskPath); err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        if err := Migrate(testBitcaskPath); err != nil {
+            t.Fatalf("got error %q on a second run, want none", err)
+        }
+
+        b, err := Open(testBitcaskPath, ReadWrite)
+        if err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        got, _ := b.Get("key1")
+        assertString(t, got, "value1")
+        got, _ = b.Get("key2")
+        assertString(t, got, "new\nvalue2")
+        got, _ = b.Get("key3")
+        assertString(t, got, "value3")
+        b.Put("key1", "newest")
+        b.Close()
+
+        b, _ = Open(testBitcaskPath)
+        got, _ = b.Get("key1")
+        assertString(t, got, "newest")
+        b.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("migrate bitcask in format version 1", func(t *testing.T) {
+
+        header := fileMagic + padWithZero(1) + padWithZero(1) + "\n"
+        writeLegacyFile(t, "100", header + v1FileLine("key1", "value1", 10, 1, false) +
+            v1FileLine("key2", "value2", 20, 2, false) + v1FileLine("key1", "", 30, 3, true))
+        // the torn record a crash left at the end of the active file is dropped.
+        writeLegacyFile(t, "200", header + v1FileLine("key2", "newer\nvalue2", 5, 4, false) +
+            v1FileLine("key3", "value3", 40, 5, false)[:30])
+        writeLegacyFile(t, hintFilePrefix + "100", header)
+
+        if err := Migrate(testBitcaskPath); err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+
+        b, err := Open(testBitcaskPath, ReadWrite)
+        if err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        _, err = b.Get("key1")
+        assertError(t, err, "key1: key does not exist")
+        got, _ := b.Get("key2")
+        assertString(t, got, "newer\nvalue2")
+        _, err = b.Get("key3")
+        assertError(t, err, "key3: key does not exist")
+        b.Put("key3", "value3")
+        entry, _ := b.GetEntry("key3")
+        if entry.Seq != 5 {
+            t.Errorf("got sequence number %d, want 5", entry.Seq)
+        }
+        b.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+    t.Run("migrate open bitcask", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite)
+        err := Migrate(testBitcaskPath)
+
+        assertError(t, err, "datastore is open by another process")
+        b.Close()
+        os.RemoveAll(testBitcaskPath)
+
+    })
+
+}
+
+func TestFileSystem(t *testing.T) {
+
+    t.Run("bitcask in memory", func(t *testing.T) {
+
+        fs := NewMemFS()
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(fs))
+        for i := 0; i < 100; i++ {
+            b.Put(fmt.Sprintf("key%d", i + 1), fmt.Sprintf("value%d", i + 1))
+        }
+        b.Delete("key2")
+        b.Merge()
+        b.Put("key1", "newest")
+        b.Close()
+
+        if _, err := os.Stat(testBitcaskPath); !os.IsNotExist(err) {
+            t.Errorf("Expected no directory on disk: %q", testBitcaskPath)
+        }
+        problems, err := Verify(testBitcaskPath, FileSystem(fs))
+        if err != nil || len(problems) != 0 {
+            t.Errorf("got problems %v and error %v, want none", problems, err)
+        }
+
+        b, _ = Open(testBitcaskPath, FileSystem(fs))
+        got, _ := b.Get("key1")
+        assertString(t, got, "newest")
+        got, _ = b.Get("key100")
+        assertString(t, got, "value100")
+        _, err = b.Get("key2")
+        assertError(t, err, "key2: key does not exist")
+        b.Close()
+
+    })
+
+    t.Run("in memory bitcasks do not share files", func(t *testing.T) {
+
+        b1, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        b1.Put("key1", "value1")
+        b1.Close()
+
+        _, err := Open(testBitcaskPath, FileSystem(NewMemFS()))
+        assertError(t, err, "read only cannot create new bitcask directory")
+
+    })
+
+}
+
+func legacyFileLine(key string, value string, tstamp int64) string {
+
+    return padWithZero(tstamp) + padWithZero(int64(len(key))) + padWithZero(int64(len(value))) + key + value + "\n"
+
+}
+
+// v1FileLine builds a data file record of format version 1, which has no bucket.
+func v1FileLine(key string, value string, tstamp int64, seq uint64, isTompStone bool) string {
+
+    kind := valueKind
+    if isTompStone {
+        kind = tompStoneKind
+    }
+    body := padWithZero(tstamp) + padWithZero(int64(seq)) + padWithZero(kind) +
+        padWithZero(int64(len(key))) + padWithZero(int64(len(value))) + key + value
+
+    return padWithZero(int64(crc32.ChecksumIEEE([]byte(body)))) + body + "\n"
+
+}
+
+func writeLegacyFile(t testing.TB, name string, data string) {
+
+    t.Helper()
+    os.MkdirAll(testBitcaskPath, dirMode)
+    if err := os.WriteFile(path.Join(testBitcaskPath, name), []byte(data), fileMode); err != nil {
+        t.Fatal(err)
+    }
+
+}
+
 func assertError(t testing.TB, err error, want string) {
 
     t.Helper()
@@ -0,0 +1,333 @@
+package bitcask
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Bucket is a named namespace of a bitcask datastore. Its records share the data files of the datastore
+// with the bucket id in their header, and its keys are kept in a keydir partition of their own,
+// so ListKeys and Fold only go over the keys of the bucket.
+type Bucket struct {
+    bitcask *Bitcask
+    name string
+    id int64
+}
+
+// Bucket returns the bucket named name, and creates it if it does not exist.
+// A bucket is created by a single record that maps its name to its id, the sequence number of that record,
+// so the id of a dropped bucket is never given to another one.
+// returns an error if the bucket does not exist and ReadWrite permission is not set.
+func (bitcask *Bitcask) Bucket(name string) (*Bucket, error) {
+
+    bitcask.mu.Lock()
+
+    if id, isExist := bitcask.buckets[name]; isExist {
+        bitcask.mu.Unlock()
+        return &Bucket{bitcask: bitcask, name: name, id: id}, nil
+    }
+    if bitcask.config.writePermission == ReadOnly {
+        bitcask.mu.Unlock()
+        return nil, BitcaskError(fmt.Sprintf("%s: %s", name, BucketDoesNotExist))
+    }
+
+    tstamp := time.Now().UnixMicro()
+    bitcask.lastSeq++
+    seq := bitcask.lastSeq
+    id := int64(seq)
+    value := strconv.FormatInt(id, 10)
+    isFull := bitcask.addPendingWrite(catalogBucket, name, value, tstamp, seq, false)
+    bitcask.keyDir.put(catalogBucket, name, record{
+        fileId:    "",
+        valueSize: int64(len(value)),
+        valuePos:  0,
+        tstamp:    tstamp,
+        seq:       seq,
+        isPending: true,
+    })
+    bitcask.buckets[name] = id
+    bitcask.bucketNames[id] = name
+    unsyncedBytes := bitcask.unsyncedBytes
+    bitcask.mu.Unlock()
+
+    if err := bitcask.awaitWrite(seq, isFull, unsyncedBytes); err != nil {
+        return nil, err
+    }
+
+    return &Bucket{bitcask: bitcask, name: name, id: id}, nil
+
+}
+
+// DropBucket removes the bucket named name with all its keys by appending a single tompstone,
+// the records of the bucket are deleted in the next merge.
+// returns an error if the bucket does not exist or ReadWrite permission is not set.
+func (bitcask *Bitcask) DropBucket(name string) error {
+
+    if bitcask.config.writePermission == ReadOnly {
+        return BitcaskError(WriteDenied)
+    }
+
+    bitcask.mu.Lock()
+
+    id, isExist := bitcask.buckets[name]
+    if !isExist {
+        bitcask.mu.Unlock()
+        return BitcaskError(fmt.Sprintf("%s: %s", name, BucketDoesNotExist))
+    }
+
+    bitcask.lastSeq++
+    seq := bitcask.lastSeq
+    isFull := bitcask.addPendingWrite(catalogBucket, name, "", time.Now().UnixMicro(), seq, true)
+    bitcask.keyDir.delete(catalogBucket, name)
+    bitcask.keyDir.drop(id)
+    delete(bitcask.buckets, name)
+    delete(bitcask.bucketNames, id)
+    unsyncedBytes := bitcask.unsyncedBytes
+    bitcask.mu.Unlock()
+
+    return bitcask.awaitWrite(seq, isFull, unsyncedBytes)
+
+}
+
+// ListBuckets returns the names of the buckets of a bitcask datastore in order.
+func (bitcask *Bitcask) ListBuckets() []string {
+
+    var names []string
+
+    bitcask.mu.RLock()
+    for name := range bitcask.buckets {
+        names = append(names, name)
+    }
+    bitcask.mu.RUnlock()
+    sort.Strings(names)
+
+    return names
+
+}
+
+// Name returns the name of the bucket.
+func (bucket *Bucket) Name() string {
+
+    return bucket.name
+
+}
+
+// Get retrieves the value by key from the bucket.
+// returns an error if key does not exist in the bucket or the bucket was dropped.
+func (bucket *Bucket) Get(key string) (string, error) {
+
+    bucket.bitcask.mu.RLock()
+    defer bucket.bitcask.mu.RUnlock()
+
+    if err := bucket.bitcask.checkBucket(bucket.id, bucket.name); err != nil {
+        return "", err
+    }
+
+    return bucket.bitcask.get(bucket.id, key)
+
+}
+
+// Put stores a value by key in the bucket, synced as a Put of the datastore.
+// returns an error if the bucket was dropped.
+func (bucket *Bucket) Put(key string, value string) error {
+
+    return bucket.bitcask.put(bucket.id, bucket.name, key, value)
+
+}
+
+// Delete removes a key from the bucket by appending a tompstone record.
+// returns an error if key does not exist in the bucket or the bucket was dropped.
+func (bucket *Bucket) Delete(key string) error {
+
+    return bucket.bitcask.delete(bucket.id, bucket.name, key)
+
+}
+
+// ListKeys list all keys in the bucket, none once the bucket was dropped.
+func (bucket *Bucket) ListKeys() []string {
+
+    bucket.bitcask.mu.RLock()
+    defer bucket.bitcask.mu.RUnlock()
+
+    return bucket.bitcask.listKeys(bucket.id)
+
+}
+
+// Fold folds over all key/value pairs in the bucket.
+// fun is expected to be in the form: F(K, V, Acc) -> Acc
+func (bucket *Bucket) Fold(fun func(string, string, any) any, acc any) any {
+
+    for _, key := range bucket.ListKeys() {
+        value, err := bucket.Get(key)
+        if err != nil {
+            continue
+        }
+        acc = fun(key, value, acc)
+    }
+    return acc
+
+}
+
+// put stores a value by key in bucket, name is the name of the bucket in errors.
+func (bitcask *Bitcask) put(bucket int64, name string, key string, value string) error {
+
+    if bitcask.config.writePermission == ReadOnly {
+        return BitcaskError(WriteDenied)
+    }
+
+    if bitcask.config.compactKeyDir && !fitsCompactKeyDir(len(value)) {
+        return BitcaskError(ValueTooLarge)
+    }
+
+    tstamp := time.Now().UnixMicro()
+
+    bitcask.mu.Lock()
+    if err := bitcask.checkBucket(bucket, name); err != nil {
+        bitcask.mu.Unlock()
+        return err
+    }
+    bitcask.lastSeq++
+    seq := bitcask.lastSeq
+    isFull := bitcask.addPendingWrite(bucket, key, value, tstamp, seq, false)
+    bitcask.keyDir.put(bucket, key, record{
+        fileId:    "",
+        valueSize: int64(len(value)),
+        valuePos:  0,
+        tstamp:    tstamp,
+        seq:       seq,
+        isPending: true,
+    })
+    isWatched := bitcask.queueEvent(bucket, PutEvent, key, tstamp, seq)
+    unsyncedBytes := bitcask.unsyncedBytes
+    bitcask.mu.Unlock()
+
+    if isWatched {
+        bitcask.deliverEvents()
+    }
+
+    return bitcask.awaitWrite(seq, isFull, unsyncedBytes)
+
+}
+
+// delete appends a tompstone of key in bucket, name is the name of the bucket in errors.
+func (bitcask *Bitcask) delete(bucket int64, name string, key string) error {
+
+    if bitcask.config.writePermission == ReadOnly {
+        return BitcaskError(WriteDenied)
+    }
+
+    bitcask.mu.Lock()
+
+    if err := bitcask.checkBucket(bucket, name); err != nil {
+        bitcask.mu.Unlock()
+        return err
+    }
+    _, err := bitcask.get(bucket, key)
+    if err != nil {
+        bitcask.mu.Unlock()
+        return err
+    }
+
+    bitcask.lastSeq++
+    seq := bitcask.lastSeq
+    tstamp := time.Now().UnixMicro()
+    isFull := bitcask.addPendingWrite(bucket, key, "", tstamp, seq, true)
+    bitcask.keyDir.delete(bucket, key)
+    isWatched := bitcask.queueEvent(bucket, DeleteEvent, key, tstamp, seq)
+    unsyncedBytes := bitcask.unsyncedBytes
+    bitcask.mu.Unlock()
+
+    if isWatched {
+        bitcask.deliverEvents()
+    }
+
+    return bitcask.awaitWrite(seq, isFull, unsyncedBytes)
+
+}
+
+// deleteAll appends a tompstone of every key in bucket under a single lock,
+// it excludes other writers but is not atomic on a crash.
+func (bitcask *Bitcask) deleteAll(bucket int64) error {
+
+    if bitcask.config.writePermission == ReadOnly {
+        return BitcaskError(WriteDenied)
+    }
+
+    isFull, isWatched := false, false
+    tstamp := time.Now().UnixMicro()
+
+    bitcask.mu.Lock()
+    for _, key := range bitcask.listKeys(bucket) {
+        bitcask.lastSeq++
+        seq := bitcask.lastSeq
+        isFull = bitcask.addPendingWrite(bucket, key, "", tstamp, seq, true) || isFull
+        bitcask.keyDir.delete(bucket, key)
+        isWatched = bitcask.queueEvent(bucket, DeleteEvent, key, tstamp, seq) || isWatched
+    }
+    seq := bitcask.lastSeq
+    unsyncedBytes := bitcask.unsyncedBytes
+    bitcask.mu.Unlock()
+
+    if isWatched {
+        bitcask.deliverEvents()
+    }
+
+    return bitcask.awaitWrite(seq, isFull, unsyncedBytes)
+
+}
+
+func (bitcask *Bitcask) listKeys(bucket int64) []string {
+
+    var list []string
+
+    bitcask.keyDir.forEachIn(bucket, func(key string, recValue record) {
+        list = append(list, key)
+    })
+
+    return list
+
+}
+
+// checkBucket returns an error if bucket, named name, was dropped.
+func (bitcask *Bitcask) checkBucket(bucket int64, name string) error {
+
+    if _, isExist := bitcask.bucketNames[bucket]; bucket > defaultBucket && !isExist {
+        return BitcaskError(fmt.Sprintf("%s: %s", name, BucketDoesNotExist))
+    }
+
+    return nil
+
+}
+
+// loadBuckets reads the names and ids of the buckets from the catalog once keyDir is loaded,
+// and drops the keydir partitions of the buckets that are no longer in it, the reserved ids are kept.
+// returns an error if an id in the catalog cannot be read.
+func (bitcask *Bitcask) loadBuckets() error {
+
+    bitcask.buckets = make(map[string]int64)
+    bitcask.bucketNames = make(map[int64]string)
+
+    for _, name := range bitcask.listKeys(catalogBucket) {
+        value, err := bitcask.get(catalogBucket, name)
+        if err != nil {
+            return err
+        }
+        id, err := strconv.ParseInt(value, 10, 64)
+        if err != nil || id <= defaultBucket {
+            return BitcaskError(fmt.Sprintf("%s: %s", name, MalformedLine))
+        }
+        bitcask.buckets[name] = id
+        bitcask.bucketNames[id] = name
+    }
+
+    for bucket := range bitcask.keyDir.partitions {
+        if _, isExist := bitcask.bucketNames[bucket]; !isExist && bucket > defaultBucket {
+            bitcask.keyDir.drop(bucket)
+        }
+    }
+
+    return nil
+
+}
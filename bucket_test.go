@@ -0,0 +1,178 @@
+package bitcask
+
+import (
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestBuckets(t *testing.T) {
+
+    t.Run("buckets keep their keys apart", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        defer b.Close()
+        users, _ := b.Bucket("users")
+        orders, _ := b.Bucket("orders")
+
+        b.Put("key", "default")
+        users.Put("key", "user")
+        users.Put("ada", "36")
+        orders.Put("key", "order")
+
+        got, _ := b.Get("key")
+        assertString(t, got, "default")
+        got, _ = users.Get("key")
+        assertString(t, got, "user")
+        got, _ = orders.Get("key")
+        assertString(t, got, "order")
+
+        assertKeys(t, b.ListKeys(), "key")
+        assertKeys(t, users.ListKeys(), "ada", "key")
+        sum := users.Fold(func(key string, value string, acc any) any {
+            return acc.(string) + key + "=" + value + ";"
+        }, "")
+        if sum != "ada=36;key=user;" && sum != "key=user;ada=36;" {
+            t.Errorf("Fold() = %q", sum)
+        }
+
+        users.Delete("key")
+        _, err := users.Get("key")
+        assertError(t, err, "key: key does not exist")
+        got, _ = b.Get("key")
+        assertString(t, got, "default")
+        assertError(t, users.Delete("key"), "key: key does not exist")
+
+        if stats := b.Stats(); stats.Keys != 1 || stats.Buckets != 2 {
+            t.Errorf("got stats %+v, want 1 key and 2 buckets", stats)
+        }
+        if names := b.ListBuckets(); !reflect.DeepEqual(names, []string{"orders", "users"}) {
+            t.Errorf("ListBuckets() = %v", names)
+        }
+
+    })
+
+    t.Run("a bucket is dropped with one record", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        defer b.Close()
+        users, _ := b.Bucket("users")
+        for _, key := range []string{"a", "b", "c", "d"} {
+            users.Put(key, "value")
+        }
+        b.Sync()
+
+        pending := len(b.pendingWrites)
+        if err := b.DropBucket("users"); err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        if written := len(b.pendingWrites) - pending; written != 1 {
+            t.Errorf("DropBucket wrote %d records, want 1", written)
+        }
+
+        _, err := users.Get("a")
+        assertError(t, err, "users: bucket does not exist")
+        assertError(t, users.Put("a", "value"), "users: bucket does not exist")
+        assertError(t, users.Delete("a"), "users: bucket does not exist")
+        assertKeys(t, users.ListKeys())
+        assertError(t, b.DropBucket("users"), "users: bucket does not exist")
+
+        users, _ = b.Bucket("users")
+        assertKeys(t, users.ListKeys())
+        _, err = users.Get("a")
+        assertError(t, err, "a: key does not exist")
+
+    })
+
+    t.Run("buckets and drops survive reopen and merge", func(t *testing.T) {
+
+        fs := NewMemFS()
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(fs))
+        users, _ := b.Bucket("users")
+        dropped, _ := b.Bucket("dropped")
+        for i := 0; i < 50; i++ {
+            users.Put(string(rune('a' + i % 26)) + "user", "value")
+            dropped.Put(string(rune('a' + i % 26)) + "dropped", "value")
+        }
+        droppedId := dropped.id
+        b.DropBucket("dropped")
+        again, _ := b.Bucket("dropped")
+        again.Put("new", "value")
+        b.Close()
+
+        check := func(step string, b *Bitcask) {
+            t.Helper()
+            users, err := b.Bucket("users")
+            if err != nil {
+                t.Fatalf("%s: got error %q, want none", step, err)
+            }
+            if n := len(users.ListKeys()); n != 26 {
+                t.Errorf("%s: users has %d keys, want 26", step, n)
+            }
+            again, _ := b.Bucket("dropped")
+            assertKeys(t, again.ListKeys(), "new")
+            assertKeys(t, b.ListKeys())
+            if _, isExist := b.keyDir.partitions[droppedId]; isExist {
+                t.Errorf("%s: the keys of the dropped bucket are still loaded", step)
+            }
+        }
+
+        b, _ = Open(testBitcaskPath, ReadWrite, FileSystem(fs))
+        check("from the checkpoint", b)
+        b.Close()
+
+        fs.Remove(path.Join(testBitcaskPath, checkpointFileName))
+        b, _ = Open(testBitcaskPath, ReadWrite, FileSystem(fs))
+        check("from the hint files", b)
+        if err := b.Merge(); err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        check("after merge", b)
+        b.Close()
+
+        b, _ = Open(testBitcaskPath, FileSystem(fs))
+        check("read only after merge", b)
+        b.Close()
+
+    })
+
+    t.Run("read only bucket", func(t *testing.T) {
+
+        fs := NewMemFS()
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(fs))
+        users, _ := b.Bucket("users")
+        users.Put("ada", "36")
+        b.Close()
+
+        b1, _ := Open(testBitcaskPath, FileSystem(fs))
+        defer b1.Close()
+        _, err := b1.Bucket("orders")
+        assertError(t, err, "orders: bucket does not exist")
+        assertError(t, b1.DropBucket("users"), "write permission denied")
+
+        // a second reader loads the keydir file of the first.
+        b2, _ := Open(testBitcaskPath, FileSystem(fs))
+        defer b2.Close()
+        users, err = b2.Bucket("users")
+        if err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        got, _ := users.Get("ada")
+        assertString(t, got, "36")
+        assertError(t, users.Put("ada", "37"), "write permission denied")
+
+    })
+
+}
+
+func assertKeys(t testing.TB, got []string, want ...string) {
+
+    t.Helper()
+    sort.Strings(got)
+    sort.Strings(want)
+    if len(got) != len(want) || len(want) > 0 && !reflect.DeepEqual(got, want) {
+        t.Errorf("got keys %q, want %q", got, want)
+    }
+
+}
@@ -0,0 +1,150 @@
+package bitcask
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+	"strconv"
+)
+
+const (
+    checkpointFileName = "checkpoint"
+    checkpointHeaderSize = 4 * numberFieldSize
+)
+
+// writeCheckpoint saves the keydir as of the current end of the active file.
+// After the file header, the checkpoint starts with a header line holding the file id and offset it covers,
+// the last sequence number and a crc32 of the lines after it, one keydir line per key.
+// Writes are blocked while it is written, Get is not.
+func (bitcask *Bitcask) writeCheckpoint() error {
+
+    bitcask.writeMu.Lock()
+    defer bitcask.writeMu.Unlock()
+    bitcask.mu.RLock()
+    defer bitcask.mu.RUnlock()
+
+    // a pending write is not covered by the checkpoint, the record it replaces is.
+    previous := make(map[bucketKey]pendingWrite)
+    for _, write := range bitcask.pendingWrites {
+        if _, isExist := previous[write.key]; !isExist {
+            previous[write.key] = write
+        }
+    }
+
+    tmpPath := path.Join(bitcask.directoryPath, "." + checkpointFileName)
+    checkpointFile, err := bitcask.createFileWithHeader(tmpPath)
+    if err != nil {
+        return err
+    }
+
+    // the header is written last, once the checksum is known.
+    header := make([]byte, checkpointHeaderSize + 1)
+    if _, err := checkpointFile.Write(header); err != nil {
+        checkpointFile.Close()
+        bitcask.config.fs.Remove(tmpPath)
+        return err
+    }
+    checksum := crc32.NewIEEE()
+    checkpointWriter := bufio.NewWriter(io.MultiWriter(checkpointFile, checksum))
+
+    bitcask.keyDir.forEach(func(bucket int64, key string, recValue record) {
+        if !recValue.isPending {
+            fmt.Fprintln(checkpointWriter, buildKeyDirFileLine(recValue, bucket, key))
+        }
+    })
+    for key, write := range previous {
+        if write.hasPrevious {
+            fmt.Fprintln(checkpointWriter, buildKeyDirFileLine(write.previous, key.bucket, key.key))
+        }
+    }
+
+    fileId, _ := strconv.ParseInt(bitcask.currentActive.fileName, 10, 64)
+    header = []byte(padWithZero(fileId) + padWithZero(bitcask.currentActive.currentPos) +
+    padWithZero(int64(bitcask.lastSeq)) + padWithZero(0) + "\n")
+
+    err = checkpointWriter.Flush()
+    if err == nil {
+        copy(header[3 * numberFieldSize:], padWithZero(int64(checksum.Sum32())))
+        _, err = checkpointFile.WriteAt(header, int64(fileHeaderSize))
+    }
+    if err == nil {
+        err = syncAndClose(checkpointFile)
+    } else {
+        checkpointFile.Close()
+    }
+    if err != nil {
+        bitcask.config.fs.Remove(tmpPath)
+        return err
+    }
+
+    return bitcask.config.fs.Rename(tmpPath, path.Join(bitcask.directoryPath, checkpointFileName))
+
+}
+
+// loadCheckpoint loads the checkpoint into keyDir and returns the file id and offset it covers.
+// It reports false, leaving keyDir untouched, when there is no checkpoint in the current format,
+// its checksum does not match or it points into a data file that no longer exists.
+func (bitcask *Bitcask) loadCheckpoint(dataFiles map[string]bool) (int64, int64, bool) {
+
+    checkpointFile, err := bitcask.config.fs.Open(path.Join(bitcask.directoryPath, checkpointFileName))
+    if err != nil {
+        return 0, 0, false
+    }
+    defer checkpointFile.Close()
+
+    fileReader := bufio.NewReader(checkpointFile)
+    if _, err := readFileHeader(fileReader); err != nil {
+        return 0, 0, false
+    }
+    header := make([]byte, checkpointHeaderSize + 1)
+    if _, err := io.ReadFull(fileReader, header); err != nil {
+        return 0, 0, false
+    }
+    fileId, err1 := strconv.ParseInt(string(header[0:19]), 10, 64)
+    offset, err2 := strconv.ParseInt(string(header[19:38]), 10, 64)
+    lastSeq, err3 := strconv.ParseUint(string(header[38:57]), 10, 64)
+    wantChecksum, err4 := strconv.ParseUint(string(header[57:76]), 10, 32)
+    if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+        return 0, 0, false
+    }
+
+    checksum := crc32.NewIEEE()
+    checkpointReader := bufio.NewReader(io.TeeReader(fileReader, checksum))
+    keyDir := bitcask.newBucketKeyDir()
+
+    for {
+        line, err := readSizedLine(checkpointReader, keyDirHeaderSize, 6)
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return 0, 0, false
+        }
+
+        bucket, key, recFileId, valueSize, valuePos, tstamp, seq, err := extractKeyDirFileLine(line)
+        if err != nil || !dataFiles[recFileId] {
+            return 0, 0, false
+        }
+        keyDir.put(bucket, key, record{
+            fileId:    recFileId,
+            valueSize: valueSize,
+            valuePos:  valuePos,
+            tstamp:    tstamp,
+            seq:       seq,
+            isPending: false,
+        })
+    }
+
+    if uint64(checksum.Sum32()) != wantChecksum {
+        return 0, 0, false
+    }
+
+    bitcask.keyDir = keyDir
+    if lastSeq > bitcask.lastSeq {
+        bitcask.lastSeq = lastSeq
+    }
+
+    return fileId, offset, true
+
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bitcask"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sizeDist is a distribution of key or value sizes, in bytes.
+type sizeDist struct {
+	min, max int
+	mean     float64 // of an exponential distribution, capped at max; zero for a uniform one
+}
+
+// parseSizeDist parses a size distribution: "n" for a fixed size, "min-max" for sizes
+// uniform in [min, max] and "exp:mean" for exponential sizes with that mean, capped at 16 times it.
+func parseSizeDist(s string) (sizeDist, error) {
+	if strings.HasPrefix(s, "exp:") {
+		m, err := strconv.ParseFloat(strings.TrimPrefix(s, "exp:"), 64)
+		if err != nil || m <= 0 {
+			return sizeDist{}, fmt.Errorf("bad size distribution %q: the mean must be a positive number", s)
+		}
+		return sizeDist{min: 0, max: int(16 * m), mean: m}, nil
+	}
+	low, high, isRange := strings.Cut(s, "-")
+	if !isRange {
+		high = low
+	}
+	min, err1 := strconv.Atoi(low)
+	max, err2 := strconv.Atoi(high)
+	if err1 != nil || err2 != nil || min < 0 || max < min {
+		return sizeDist{}, fmt.Errorf("bad size distribution %q: want n, min-max or exp:mean", s)
+	}
+	return sizeDist{min: min, max: max}, nil
+}
+
+func (d sizeDist) sample(rng *rand.Rand) int {
+	if d.mean > 0 {
+		size := int(rng.ExpFloat64() * d.mean)
+		if size > d.max {
+			size = d.max
+		}
+		return size
+	}
+	return d.min + rng.Intn(d.max-d.min+1)
+}
+
+// config describes a load. With a fixed ops count and one worker the load is the same on every run.
+type config struct {
+	keys        int
+	keySize     sizeDist
+	valueSize   sizeDist
+	keyDist     string // uniform, zipf or sequential
+	readRatio   float64
+	deleteRatio float64
+	concurrency int
+	duration    time.Duration
+	ops         int64 // stops the load after this many operations instead of after duration, if positive
+	seed        int64
+}
+
+// check reports a config no load can be run with.
+func (cfg config) check() error {
+	switch {
+	case cfg.keys < 1:
+		return fmt.Errorf("-keys must be positive")
+	case cfg.concurrency < 1:
+		return fmt.Errorf("-concurrency must be positive")
+	case cfg.keyDist != "uniform" && cfg.keyDist != "zipf" && cfg.keyDist != "sequential":
+		return fmt.Errorf("unknown -key-dist %q", cfg.keyDist)
+	case cfg.readRatio < 0 || cfg.deleteRatio < 0 || cfg.readRatio+cfg.deleteRatio > 1:
+		return fmt.Errorf("-reads and -deletes must be ratios adding up to at most 1")
+	}
+	return nil
+}
+
+type opKind int
+
+const (
+	opGet opKind = iota
+	opPut
+	opDelete
+	opKinds
+)
+
+var opNames = [opKinds]string{"get", "put", "delete"}
+
+// result holds the latency of every operation of a load, by kind.
+type result struct {
+	latencies [opKinds][]time.Duration
+	errors    [opKinds]int
+	misses    int // gets of keys that do not exist
+	elapsed   time.Duration
+}
+
+// workload holds the keys of a load and the bytes values are cut from.
+type workload struct {
+	config
+	keyNames []string
+	values   string
+}
+
+func newWorkload(cfg config) *workload {
+	rng := rand.New(rand.NewSource(cfg.seed))
+	w := &workload{config: cfg, keyNames: make([]string, cfg.keys)}
+	for i := range w.keyNames {
+		w.keyNames[i] = fmt.Sprintf("%0*d", cfg.keySize.sample(rng), i)
+	}
+	values := make([]byte, cfg.valueSize.max)
+	for i := range values {
+		values[i] = byte('a' + rng.Intn(26))
+	}
+	w.values = string(values)
+	return w
+}
+
+func (w *workload) value(rng *rand.Rand) string {
+	return w.values[:w.valueSize.sample(rng)]
+}
+
+// preload puts every key once, so that reads find values.
+func (w *workload) preload(bc *bitcask.Bitcask) error {
+	rng := rand.New(rand.NewSource(w.seed))
+	for _, key := range w.keyNames {
+		if err := bc.Put(key, w.value(rng)); err != nil {
+			return err
+		}
+	}
+	return bc.Sync()
+}
+
+// keyChooser returns the function picking the keys of a worker.
+func (w *workload) keyChooser(rng *rand.Rand, worker int) func() int {
+	switch w.keyDist {
+	case "zipf":
+		zipf := rand.NewZipf(rng, 1.1, 1, uint64(w.keys-1))
+		return func() int { return int(zipf.Uint64()) }
+	case "sequential":
+		next := worker
+		return func() int {
+			key := next % w.keys
+			next += w.concurrency
+			return key
+		}
+	}
+	return func() int { return rng.Intn(w.keys) }
+}
+
+// run runs the load on bc and returns the latencies of its operations.
+func (w *workload) run(bc *bitcask.Bitcask) result {
+	var (
+		mu      sync.Mutex
+		res     result
+		wg      sync.WaitGroup
+		started int64
+	)
+	deadline := time.Now().Add(w.duration)
+	start := time.Now()
+
+	for worker := 0; worker < w.concurrency; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(w.seed + int64(worker) + 1))
+			nextKey := w.keyChooser(rng, worker)
+			var own result
+
+			for {
+				if w.ops > 0 {
+					if atomic.AddInt64(&started, 1) > w.ops {
+						break
+					}
+				} else if time.Now().After(deadline) {
+					break
+				}
+
+				key := w.keyNames[nextKey()]
+				kind, p := opPut, rng.Float64()
+				if p < w.readRatio {
+					kind = opGet
+				} else if p < w.readRatio+w.deleteRatio {
+					kind = opDelete
+				}
+
+				var err error
+				begin := time.Now()
+				switch kind {
+				case opGet:
+					_, err = bc.Get(key)
+				case opPut:
+					err = bc.Put(key, w.value(rng))
+				case opDelete:
+					err = bc.Delete(key)
+				}
+				own.latencies[kind] = append(own.latencies[kind], time.Since(begin))
+				switch {
+				case err == nil:
+				case kind != opPut && strings.HasSuffix(err.Error(), bitcask.KeyDoesNotExist):
+					if kind == opGet {
+						own.misses++
+					}
+				default:
+					own.errors[kind]++
+				}
+			}
+
+			mu.Lock()
+			for kind := range res.latencies {
+				res.latencies[kind] = append(res.latencies[kind], own.latencies[kind]...)
+				res.errors[kind] += own.errors[kind]
+			}
+			res.misses += own.misses
+			mu.Unlock()
+		}(worker)
+	}
+	wg.Wait()
+
+	res.elapsed = time.Since(start)
+	for kind := range res.latencies {
+		sort.Slice(res.latencies[kind], func(i, j int) bool {
+			return res.latencies[kind][i] < res.latencies[kind][j]
+		})
+	}
+	return res
+}
+
+// percentile returns the latency at or under which p percent of sorted fall.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted))/100)) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// roundLatency rounds d to three significant digits.
+func roundLatency(d time.Duration) time.Duration {
+	unit := time.Duration(1)
+	for d/unit >= 1000 {
+		unit *= 10
+	}
+	return d.Round(unit)
+}
+
+var reportPercentiles = []float64{50, 90, 99, 99.9}
+
+// report prints the throughput and latency percentiles of res.
+func report(out io.Writer, res result) {
+	total := 0
+	for _, latencies := range res.latencies {
+		total += len(latencies)
+	}
+	seconds := res.elapsed.Seconds()
+	fmt.Fprintf(out, "%d ops in %v, %.0f ops/s\n", total, res.elapsed.Round(time.Millisecond), float64(total)/seconds)
+	if res.misses > 0 {
+		fmt.Fprintf(out, "%d gets of missing keys\n", res.misses)
+	}
+
+	fmt.Fprintf(out, "%-7s %9s %7s %10s", "op", "count", "errors", "ops/s")
+	for _, p := range reportPercentiles {
+		fmt.Fprintf(out, " %9s", "p"+strconv.FormatFloat(p, 'f', -1, 64))
+	}
+	fmt.Fprintf(out, " %9s\n", "max")
+	for kind, latencies := range res.latencies {
+		if len(latencies) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "%-7s %9d %7d %10.0f", opNames[kind], len(latencies), res.errors[kind], float64(len(latencies))/seconds)
+		for _, p := range reportPercentiles {
+			fmt.Fprintf(out, " %9v", roundLatency(percentile(latencies, p)))
+		}
+		fmt.Fprintf(out, " %9v\n", roundLatency(latencies[len(latencies)-1]))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bitcask"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testBitcaskPath = path.Join("testing_dir")
+
+func TestParseSizeDist(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    sizeDist
+		wantErr bool
+	}{
+		{in: "100", want: sizeDist{min: 100, max: 100}},
+		{in: "10-20", want: sizeDist{min: 10, max: 20}},
+		{in: "exp:64", want: sizeDist{min: 0, max: 1024, mean: 64}},
+		{in: "20-10", wantErr: true},
+		{in: "-5", wantErr: true},
+		{in: "exp:0", wantErr: true},
+		{in: "big", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSizeDist(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseSizeDist(%q) = %+v, %v, want %+v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for _, dist := range []sizeDist{{min: 10, max: 20}, {min: 0, max: 1024, mean: 64}} {
+		for i := 0; i < 1000; i++ {
+			if size := dist.sample(rng); size < dist.min || size > dist.max {
+				t.Fatalf("%+v sampled %d", dist, size)
+			}
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 1000; i++ {
+		sorted = append(sorted, time.Duration(i))
+	}
+	for p, want := range map[float64]time.Duration{0: 1, 50: 500, 99: 990, 99.9: 999, 100: 1000} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("percentile(%v) = %v, want %v", p, got, want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile of no latencies = %v, want 0", got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	defer os.RemoveAll(testBitcaskPath)
+	bc, err := bitcask.Open(testBitcaskPath, bitcask.ReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	cfg := config{
+		keys:        50,
+		keySize:     sizeDist{min: 8, max: 8},
+		valueSize:   sizeDist{min: 10, max: 30},
+		keyDist:     "zipf",
+		readRatio:   0.5,
+		deleteRatio: 0.2,
+		concurrency: 1,
+		ops:         300,
+		seed:        7,
+	}
+	w := newWorkload(cfg)
+	if err := w.preload(bc); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(bc.ListKeys()); got != cfg.keys {
+		t.Fatalf("preloaded %d keys, want %d", got, cfg.keys)
+	}
+
+	res := w.run(bc)
+	total := 0
+	for kind, latencies := range res.latencies {
+		total += len(latencies)
+		if res.errors[kind] != 0 {
+			t.Errorf("%d %s errors", res.errors[kind], opNames[kind])
+		}
+	}
+	if total != 300 {
+		t.Errorf("ran %d operations, want 300", total)
+	}
+
+	// the same seed draws the same load
+	again := newWorkload(cfg).run(bc)
+	for kind := range res.latencies {
+		if len(again.latencies[kind]) != len(res.latencies[kind]) {
+			t.Errorf("second run made %d %ss, first run %d", len(again.latencies[kind]), opNames[kind], len(res.latencies[kind]))
+		}
+	}
+
+	var out strings.Builder
+	report(&out, res)
+	for _, want := range []string{"300 ops", "p99.9", "get", "put", "delete"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report does not mention %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	good := config{keys: 1, concurrency: 1, keyDist: "uniform", readRatio: 0.5, deleteRatio: 0.5}
+	if err := good.check(); err != nil {
+		t.Errorf("check() = %v, want nil", err)
+	}
+	for _, bad := range []func(*config){
+		func(c *config) { c.keys = 0 },
+		func(c *config) { c.concurrency = 0 },
+		func(c *config) { c.keyDist = "gaussian" },
+		func(c *config) { c.deleteRatio = 0.6 },
+	} {
+		cfg := good
+		bad(&cfg)
+		if err := cfg.check(); err == nil {
+			t.Errorf("check() of %+v = nil, want an error", cfg)
+		}
+	}
+}
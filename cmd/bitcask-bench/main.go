@@ -0,0 +1,84 @@
+// Command bitcask-bench runs a load on a bitcask datastore and reports its throughput
+// and latency percentiles, by operation.
+//
+//	bitcask-bench [-keys n] [-key-size dist] [-value-size dist] [-key-dist uniform|zipf|sequential]
+//	              [-reads ratio] [-deletes ratio] [-concurrency n] [-duration d | -ops n] [-seed n] [-sync] <dir>
+//
+// Sizes are "n", "min-max" or "exp:mean". Every key is put once before the load unless -preload=false.
+// The load is drawn from -seed, so a run with -ops and -concurrency 1 is the same every time.
+package main
+
+import (
+	"bitcask"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	keys := flag.Int("keys", 100000, "number of distinct keys")
+	keySize := flag.String("key-size", "16", "key size distribution, in bytes")
+	valueSize := flag.String("value-size", "100", "value size distribution, in bytes")
+	keyDist := flag.String("key-dist", "uniform", "how keys are picked: uniform, zipf or sequential")
+	reads := flag.Float64("reads", 0.8, "share of operations that are gets")
+	deletes := flag.Float64("deletes", 0, "share of operations that are deletes, the rest are puts")
+	concurrency := flag.Int("concurrency", 4, "number of concurrent workers")
+	duration := flag.Duration("duration", 10*time.Second, "how long to run the load")
+	ops := flag.Int64("ops", 0, "run this many operations instead of for -duration")
+	seed := flag.Int64("seed", 1, "seed of the load")
+	preload := flag.Bool("preload", true, "put every key once before the load")
+	syncOnPut := flag.Bool("sync", false, "fsync every write")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bitcask-bench [flags] <dir>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg := config{
+		keys:        *keys,
+		keyDist:     *keyDist,
+		readRatio:   *reads,
+		deleteRatio: *deletes,
+		concurrency: *concurrency,
+		duration:    *duration,
+		ops:         *ops,
+		seed:        *seed,
+	}
+	var err error
+	if cfg.keySize, err = parseSizeDist(*keySize); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.valueSize, err = parseSizeDist(*valueSize); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.check(); err != nil {
+		log.Fatal(err)
+	}
+
+	opts := []bitcask.ConfigOpt{bitcask.ReadWrite}
+	if *syncOnPut {
+		opts = append(opts, bitcask.SyncOnPut)
+	}
+	bc, err := bitcask.Open(flag.Arg(0), opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer bc.Close()
+
+	w := newWorkload(cfg)
+	if *preload {
+		start := time.Now()
+		if err := w.preload(bc); err != nil {
+			bc.Close()
+			log.Fatal(err)
+		}
+		fmt.Printf("preloaded %d keys in %v\n", cfg.keys, time.Since(start).Round(time.Millisecond))
+	}
+	report(os.Stdout, w.run(bc))
+}
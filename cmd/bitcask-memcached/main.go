@@ -0,0 +1,74 @@
+// Command bitcask-memcached serves a bitcask datastore to memcached clients
+// over the ASCII protocol.
+//
+//	bitcask-memcached [-addr :11211 | -unix path] [-sync] [-max-item-size n] <dir>
+//
+// It understands get, gets, set, add, replace, cas, delete, stats, version and quit.
+// Items keep their flags and cas token across restarts; they never expire, so
+// a store with a non-zero exptime is refused.
+//
+// On SIGINT or SIGTERM it stops accepting connections and closes them, waits
+// for the commands running on them to return and closes the datastore.
+package main
+
+import (
+	"bitcask"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	addr := flag.String("addr", ":11211", "TCP address to listen on")
+	unix := flag.String("unix", "", "Unix socket to listen on instead of -addr")
+	syncOnPut := flag.Bool("sync", false, "fsync every write before answering")
+	maxItemSize := flag.Int("max-item-size", 1<<20, "largest item a store accepts, in bytes")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bitcask-memcached [flags] <dir>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := []bitcask.ConfigOpt{bitcask.ReadWrite}
+	if *syncOnPut {
+		opts = append(opts, bitcask.SyncOnPut)
+	}
+	bc, err := bitcask.Open(flag.Arg(0), opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	network, address := "tcp", *addr
+	if *unix != "" {
+		network, address = "unix", *unix
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		bc.Close()
+		log.Fatal(err)
+	}
+
+	srv := newServer(bc, *maxItemSize)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		srv.Close()
+	}()
+
+	log.Printf("serving %s on %s", flag.Arg(0), listener.Addr())
+	err = srv.Serve(listener)
+	srv.Close()
+	bc.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
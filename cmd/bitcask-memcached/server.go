@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bitcask"
+	"bitcask/internal/netserver"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxKeySize is the longest key memcached accepts.
+const maxKeySize = 250
+
+// itemMagic starts the envelope of every item stored by the server.
+const itemMagic = "\x00mcitem\x00"
+
+// itemHeaderSize is the size of the envelope before the data: the magic and the flags.
+const itemHeaderSize = len(itemMagic) + 4
+
+// server serves a bitcask datastore to memcached clients over the ASCII protocol.
+//
+// The flags of an item are stored with its data in an envelope, see encodeItem,
+// and its cas token is the sequence number of the write that stored it, so both
+// survive restarts.
+type server struct {
+	bc          *bitcask.Bitcask
+	maxItemSize int
+	started     time.Time
+
+	// writeMu makes the checks of add, replace and cas atomic with the writes of other commands.
+	writeMu sync.Mutex
+
+	*netserver.Server
+
+	cmdGet, cmdSet, getHits, getMisses int64
+}
+
+func newServer(bc *bitcask.Bitcask, maxItemSize int) *server {
+	s := &server{
+		bc:          bc,
+		maxItemSize: maxItemSize,
+		started:     time.Now(),
+	}
+	s.Server = netserver.New(s.handle)
+	return s
+}
+
+// handle runs the commands of a client until it quits or its connection fails.
+func (s *server) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			io.WriteString(w, "ERROR\r\n")
+		} else {
+			switch fields[0] {
+			case "get", "gets":
+				s.get(w, fields[1:], fields[0] == "gets")
+			case "set", "add", "replace", "cas":
+				err = s.store(r, w, fields[0], fields[1:])
+			case "delete":
+				s.delete(w, fields[1:])
+			case "stats":
+				s.stats(w)
+			case "version":
+				io.WriteString(w, "VERSION bitcask\r\n")
+			case "quit":
+				w.Flush()
+				return
+			default:
+				io.WriteString(w, "ERROR\r\n")
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		// replies of pipelined commands are sent together.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// get answers "VALUE <key> <flags> <bytes> [<cas>]" and the data for each key found, then END.
+func (s *server) get(w *bufio.Writer, keys []string, withCas bool) {
+	if len(keys) == 0 {
+		io.WriteString(w, "ERROR\r\n")
+		return
+	}
+	for _, key := range keys {
+		atomic.AddInt64(&s.cmdGet, 1)
+		entry, err := s.bc.GetEntry(key)
+		if err != nil {
+			atomic.AddInt64(&s.getMisses, 1)
+			continue
+		}
+		atomic.AddInt64(&s.getHits, 1)
+		flags, data := decodeItem(entry.Value)
+		if withCas {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, flags, len(data), entry.Seq)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, flags, len(data))
+		}
+		io.WriteString(w, data)
+		io.WriteString(w, "\r\n")
+	}
+	io.WriteString(w, "END\r\n")
+}
+
+// store runs "<command> <key> <flags> <exptime> <bytes> [<cas>] [noreply]" followed by a data block.
+// It only returns an error when the connection must be dropped.
+func (s *server) store(r *bufio.Reader, w *bufio.Writer, command string, args []string) error {
+	want := 4
+	if command == "cas" {
+		want = 5
+	}
+	if len(args) != want && len(args) != want+1 {
+		io.WriteString(w, "ERROR\r\n")
+		return nil
+	}
+	noreply := len(args) == want+1 && args[want] == "noreply"
+	key := args[0]
+	flags, flagsErr := strconv.ParseUint(args[1], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[2], 10, 64)
+	size, sizeErr := strconv.Atoi(args[3])
+	var casUnique uint64
+	var casErr error
+	if command == "cas" {
+		casUnique, casErr = strconv.ParseUint(args[4], 10, 64)
+	}
+	if sizeErr != nil || size < 0 {
+		io.WriteString(w, "CLIENT_ERROR bad command line format\r\n")
+		return fmt.Errorf("bad data size %q", args[3])
+	}
+
+	reply := func(s string) {
+		if !noreply {
+			io.WriteString(w, s+"\r\n")
+		}
+	}
+
+	// the data block is read even when the command is refused, to stay in sync with the client,
+	// the one of an item too large is skipped without being held in memory.
+	if size > s.maxItemSize {
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			return err
+		}
+		if _, err := r.ReadString('\n'); err != nil {
+			return err
+		}
+		atomic.AddInt64(&s.cmdSet, 1)
+		reply("SERVER_ERROR object too large for cache")
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		io.WriteString(w, "CLIENT_ERROR bad data chunk\r\n")
+		_, err := r.ReadString('\n')
+		return err
+	}
+	atomic.AddInt64(&s.cmdSet, 1)
+
+	switch {
+	case !validKey(key) || flagsErr != nil || exptimeErr != nil || casErr != nil || len(args) == want+1 && !noreply:
+		reply("CLIENT_ERROR bad command line format")
+		return nil
+	case exptime != 0:
+		reply("CLIENT_ERROR expiry is not supported by bitcask")
+		return nil
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	entry, err := s.bc.GetEntry(key)
+	isExist := err == nil
+	switch {
+	case command == "add" && isExist, command == "replace" && !isExist:
+		reply("NOT_STORED")
+		return nil
+	case command == "cas" && !isExist:
+		reply("NOT_FOUND")
+		return nil
+	case command == "cas" && entry.Seq != casUnique:
+		reply("EXISTS")
+		return nil
+	}
+	if err := s.bc.Put(key, encodeItem(uint32(flags), string(data[:size]))); err != nil {
+		reply("SERVER_ERROR " + err.Error())
+		return nil
+	}
+	reply("STORED")
+	return nil
+}
+
+func (s *server) delete(w *bufio.Writer, args []string) {
+	if len(args) == 0 || len(args) > 2 || len(args) == 2 && args[1] != "noreply" {
+		io.WriteString(w, "ERROR\r\n")
+		return
+	}
+
+	s.writeMu.Lock()
+	err := s.bc.Delete(args[0])
+	s.writeMu.Unlock()
+	if len(args) == 2 {
+		return
+	}
+	switch {
+	case err == nil:
+		io.WriteString(w, "DELETED\r\n")
+	case strings.HasSuffix(err.Error(), bitcask.KeyDoesNotExist):
+		io.WriteString(w, "NOT_FOUND\r\n")
+	default:
+		io.WriteString(w, "SERVER_ERROR "+err.Error()+"\r\n")
+	}
+}
+
+func (s *server) stats(w *bufio.Writer) {
+	stats := s.bc.Stats()
+
+	for _, stat := range []struct {
+		name  string
+		value any
+	}{
+		{"pid", os.Getpid()},
+		{"uptime", int64(time.Since(s.started).Seconds())},
+		{"time", time.Now().Unix()},
+		{"version", "bitcask"},
+		{"curr_connections", s.Conns()},
+		{"total_connections", s.TotalConns()},
+		{"cmd_get", atomic.LoadInt64(&s.cmdGet)},
+		{"cmd_set", atomic.LoadInt64(&s.cmdSet)},
+		{"get_hits", atomic.LoadInt64(&s.getHits)},
+		{"get_misses", atomic.LoadInt64(&s.getMisses)},
+		{"curr_items", stats.Keys},
+		{"bytes", stats.DataBytes},
+		{"limit_maxbytes", 0},
+	} {
+		fmt.Fprintf(w, "STAT %s %v\r\n", stat.name, stat.value)
+	}
+	io.WriteString(w, "END\r\n")
+}
+
+// validKey reports whether key is a memcached key: at most 250 bytes without spaces or control characters.
+func validKey(key string) bool {
+	if key == "" || len(key) > maxKeySize {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeItem wraps data in the envelope stored as the value of an item:
+// itemMagic, the flags as 4 big endian bytes, then data untouched.
+func encodeItem(flags uint32, data string) string {
+	header := make([]byte, itemHeaderSize)
+	copy(header, itemMagic)
+	binary.BigEndian.PutUint32(header[len(itemMagic):], flags)
+	return string(header) + data
+}
+
+// decodeItem splits a stored value into its flags and data. A value written by
+// another client, without the envelope, is returned whole with flags 0.
+func decodeItem(value string) (uint32, string) {
+	if len(value) < itemHeaderSize || !strings.HasPrefix(value, itemMagic) {
+		return 0, value
+	}
+	return binary.BigEndian.Uint32([]byte(value[len(itemMagic):itemHeaderSize])), value[itemHeaderSize:]
+}
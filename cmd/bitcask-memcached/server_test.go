@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bitcask"
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+var testBitcaskPath = path.Join("testing_dir")
+
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// startServer serves the test datastore on a local listener, stop closes the server and the datastore.
+func startServer(t *testing.T) (c *client, stop func()) {
+	t.Helper()
+	bc, err := bitcask.Open(testBitcaskPath, bitcask.ReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(bc, 1<<10)
+	go srv.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client{conn, bufio.NewReader(conn)}, func() {
+		conn.Close()
+		srv.Close()
+		bc.Close()
+	}
+}
+
+func newTestServer(t *testing.T) *client {
+	t.Helper()
+	c, stop := startServer(t)
+	t.Cleanup(func() {
+		stop()
+		os.RemoveAll(testBitcaskPath)
+	})
+	return c
+}
+
+// do sends request and reads the reply up to its last line, END for retrievals and stats.
+func (c *client) do(t *testing.T, request string) string {
+	t.Helper()
+	fmt.Fprint(c.conn, request)
+	var reply strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply.WriteString(line)
+		if !strings.HasPrefix(line, "VALUE ") && !strings.HasPrefix(line, "STAT ") {
+			if !strings.HasPrefix(request, "get") && !strings.HasPrefix(request, "stats") || line == "END\r\n" {
+				return reply.String()
+			}
+		}
+	}
+}
+
+func assertReply(t *testing.T, got string, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// casOf returns the cas token of key.
+func casOf(t *testing.T, c *client, key string) string {
+	t.Helper()
+	fields := strings.Fields(c.do(t, "gets "+key+"\r\n"))
+	if len(fields) < 5 {
+		t.Fatalf("got no cas token for %s", key)
+	}
+	return fields[4]
+}
+
+func TestStorage(t *testing.T) {
+	t.Run("set get and delete", func(t *testing.T) {
+		c := newTestServer(t)
+
+		assertReply(t, c.do(t, "set key1 42 0 6\r\nvalue1\r\n"), "STORED\r\n")
+		assertReply(t, c.do(t, "get key1 key2\r\n"), "VALUE key1 42 6\r\nvalue1\r\nEND\r\n")
+		assertReply(t, c.do(t, "delete key1\r\n"), "DELETED\r\n")
+		assertReply(t, c.do(t, "delete key1\r\n"), "NOT_FOUND\r\n")
+		assertReply(t, c.do(t, "get key1\r\n"), "END\r\n")
+	})
+
+	t.Run("add and replace", func(t *testing.T) {
+		c := newTestServer(t)
+
+		assertReply(t, c.do(t, "replace key1 0 0 1\r\na\r\n"), "NOT_STORED\r\n")
+		assertReply(t, c.do(t, "add key1 0 0 1\r\nb\r\n"), "STORED\r\n")
+		assertReply(t, c.do(t, "add key1 0 0 1\r\nc\r\n"), "NOT_STORED\r\n")
+		assertReply(t, c.do(t, "replace key1 0 0 1\r\nd\r\n"), "STORED\r\n")
+		assertReply(t, c.do(t, "get key1\r\n"), "VALUE key1 0 1\r\nd\r\nEND\r\n")
+	})
+
+	t.Run("cas", func(t *testing.T) {
+		c := newTestServer(t)
+
+		assertReply(t, c.do(t, "cas key1 0 0 1 1\r\na\r\n"), "NOT_FOUND\r\n")
+		c.do(t, "set key1 0 0 1\r\na\r\n")
+		cas := casOf(t, c, "key1")
+		assertReply(t, c.do(t, "cas key1 0 0 1 "+cas+"\r\nb\r\n"), "STORED\r\n")
+		assertReply(t, c.do(t, "cas key1 0 0 1 "+cas+"\r\nc\r\n"), "EXISTS\r\n")
+		assertReply(t, c.do(t, "get key1\r\n"), "VALUE key1 0 1\r\nb\r\nEND\r\n")
+	})
+
+	t.Run("flags and cas survive a restart", func(t *testing.T) {
+		c, stop := startServer(t)
+		c.do(t, "set key1 7 0 6\r\nvalue1\r\n")
+		before := c.do(t, "gets key1\r\n")
+		stop()
+
+		c, stop = startServer(t)
+		defer func() {
+			stop()
+			os.RemoveAll(testBitcaskPath)
+		}()
+		assertReply(t, c.do(t, "gets key1\r\n"), before)
+		if !strings.HasPrefix(before, "VALUE key1 7 6 ") {
+			t.Errorf("got %q, want flags 7 and a cas token", before)
+		}
+	})
+
+	t.Run("values of other clients have no flags", func(t *testing.T) {
+		bc, err := bitcask.Open(testBitcaskPath, bitcask.ReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bc.Put("key1", "12 apples")
+		bc.Put("key2", "")
+		bc.Close()
+
+		c := newTestServer(t)
+		assertReply(t, c.do(t, "get key1 key2\r\n"), "VALUE key1 0 9\r\n12 apples\r\nVALUE key2 0 0\r\n\r\nEND\r\n")
+		c.do(t, "set key3 5 0 9\r\n12 apples\r\n")
+		assertReply(t, c.do(t, "get key3\r\n"), "VALUE key3 5 9\r\n12 apples\r\nEND\r\n")
+	})
+
+	t.Run("noreply and pipelining", func(t *testing.T) {
+		c := newTestServer(t)
+
+		fmt.Fprint(c.conn, "set key1 0 0 1 noreply\r\na\r\nset key2 0 0 1 noreply\r\nb\r\n")
+		assertReply(t, c.do(t, "get key1 key2\r\n"), "VALUE key1 0 1\r\na\r\nVALUE key2 0 1\r\nb\r\nEND\r\n")
+	})
+
+	t.Run("items too large are skipped without being held", func(t *testing.T) {
+		c, stop := startServer(t)
+		defer func() {
+			stop()
+			os.RemoveAll(testBitcaskPath)
+		}()
+
+		big := strings.Repeat("v", 1<<20)
+		assertReply(t, c.do(t, fmt.Sprintf("set big 0 0 %d\r\n%s\r\n", len(big), big)), "SERVER_ERROR object too large for cache\r\n")
+		assertReply(t, c.do(t, "get big\r\n"), "END\r\n")
+
+		// a size that overflows the data buffer leaves the server waiting for the data, not crashed.
+		fmt.Fprint(c.conn, "set huge 0 0 9223372036854775807\r\nvalue\r\n")
+		other, err := net.Dial("tcp", c.conn.RemoteAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		c2 := &client{other, bufio.NewReader(other)}
+		assertReply(t, c2.do(t, "version\r\n"), "VERSION bitcask\r\n")
+	})
+
+	t.Run("reject bad commands", func(t *testing.T) {
+		c := newTestServer(t)
+
+		assertReply(t, c.do(t, "nothing\r\n"), "ERROR\r\n")
+		assertReply(t, c.do(t, "set key1 0 0\r\n"), "ERROR\r\n")
+		assertReply(t, c.do(t, "set key1 0 60 1\r\na\r\n"), "CLIENT_ERROR expiry is not supported by bitcask\r\n")
+		assertReply(t, c.do(t, "set key1 x 0 1\r\na\r\n"), "CLIENT_ERROR bad command line format\r\n")
+		assertReply(t, c.do(t, "set key1 0 0 1\r\nabc\r\n"), "CLIENT_ERROR bad data chunk\r\n")
+		assertReply(t, c.do(t, "set "+strings.Repeat("k", 251)+" 0 0 1\r\na\r\n"), "CLIENT_ERROR bad command line format\r\n")
+		assertReply(t, c.do(t, fmt.Sprintf("set big 0 0 %d\r\n%s\r\n", 2<<10, strings.Repeat("v", 2<<10))), "SERVER_ERROR object too large for cache\r\n")
+		assertReply(t, c.do(t, "get key1\r\n"), "END\r\n")
+	})
+}
+
+func TestStats(t *testing.T) {
+	t.Run("count items and commands", func(t *testing.T) {
+		c := newTestServer(t)
+		c.do(t, "set key1 0 0 1\r\na\r\n")
+		c.do(t, "get key1 key2\r\n")
+
+		stats := c.do(t, "stats\r\n")
+		for _, want := range []string{"STAT curr_items 1\r\n", "STAT cmd_get 2\r\n", "STAT get_hits 1\r\n", "STAT get_misses 1\r\n", "STAT cmd_set 1\r\n"} {
+			if !strings.Contains(stats, want) {
+				t.Errorf("got stats %q, want %q", stats, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,72 @@
+// Command bitcask-redis serves a bitcask datastore to Redis clients over RESP2.
+//
+//	bitcask-redis [-addr :6379 | -unix path] [-sync] <dir>
+//
+// It understands GET, SET (NX and XX), DEL, EXISTS, KEYS, SCAN, DBSIZE, TTL, FLUSHDB,
+// SAVE, PING, ECHO, SELECT 0, QUIT and a custom MERGE command. Keys never expire,
+// so TTL answers -1 and EXPIRE is an error.
+//
+// On SIGINT or SIGTERM it stops accepting connections and closes them, waits
+// for the commands running on them to return and closes the datastore.
+package main
+
+import (
+	"bitcask"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	addr := flag.String("addr", ":6379", "TCP address to listen on")
+	unix := flag.String("unix", "", "Unix socket to listen on instead of -addr")
+	syncOnPut := flag.Bool("sync", false, "fsync every write before answering")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bitcask-redis [flags] <dir>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := []bitcask.ConfigOpt{bitcask.ReadWrite}
+	if *syncOnPut {
+		opts = append(opts, bitcask.SyncOnPut)
+	}
+	bc, err := bitcask.Open(flag.Arg(0), opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	network, address := "tcp", *addr
+	if *unix != "" {
+		network, address = "unix", *unix
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		bc.Close()
+		log.Fatal(err)
+	}
+
+	srv := newServer(bc)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		srv.Close()
+	}()
+
+	log.Printf("serving %s on %s", flag.Arg(0), listener.Addr())
+	err = srv.Serve(listener)
+	srv.Close()
+	bc.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
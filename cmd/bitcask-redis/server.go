@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bitcask"
+	"bitcask/internal/netserver"
+	"bufio"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// command runs a command on its arguments, the command name excluded.
+// arity counts the arguments with the command name as Redis does: exact when positive,
+// a minimum when negative.
+type command struct {
+	arity int
+	run   func(s *server, w writer, args []string)
+}
+
+var commands = map[string]command{
+	"PING":    {-1, ping},
+	"ECHO":    {2, echo},
+	"SELECT":  {2, selectDB},
+	"COMMAND": {-1, commandInfo},
+	"GET":     {2, get},
+	"SET":     {-3, set},
+	"DEL":     {-2, del},
+	"EXISTS":  {-2, exists},
+	"KEYS":    {2, keys},
+	"SCAN":    {-2, scan},
+	"DBSIZE":  {1, dbsize},
+	"TTL":     {2, ttl},
+	"PTTL":    {2, ttl},
+	"EXPIRE":  {-3, noExpiry},
+	"PEXPIRE": {-3, noExpiry},
+	"FLUSHDB": {-1, flushdb},
+	"SAVE":    {1, save},
+	"MERGE":   {1, merge},
+}
+
+// server serves a bitcask datastore to Redis clients over RESP2.
+type server struct {
+	bc *bitcask.Bitcask
+
+	// writeMu makes the checks of SET NX and XX atomic with the writes of other commands.
+	writeMu sync.Mutex
+
+	*netserver.Server
+}
+
+func newServer(bc *bitcask.Bitcask) *server {
+	s := &server{bc: bc}
+	s.Server = netserver.New(s.handle)
+	return s
+}
+
+// handle runs the commands of a client until it quits or its connection fails.
+func (s *server) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := writer{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if err == errProtocol {
+			w.error("ERR Protocol error")
+			w.Flush()
+			return
+		} else if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		name := strings.ToUpper(args[0])
+		if name == "QUIT" {
+			w.simple("OK")
+			w.Flush()
+			return
+		}
+		cmd, isExist := commands[name]
+		if !isExist {
+			w.error("ERR unknown command '" + args[0] + "'")
+		} else if cmd.arity > 0 && len(args) != cmd.arity || cmd.arity < 0 && len(args) < -cmd.arity {
+			w.error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		} else {
+			cmd.run(s, w, args[1:])
+		}
+
+		// replies of pipelined commands are sent together.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func ping(s *server, w writer, args []string) {
+	if len(args) > 0 {
+		w.bulk(args[0])
+		return
+	}
+	w.simple("PONG")
+}
+
+func echo(s *server, w writer, args []string) {
+	w.bulk(args[0])
+}
+
+func selectDB(s *server, w writer, args []string) {
+	if args[0] != "0" {
+		w.error("ERR DB index is out of range")
+		return
+	}
+	w.simple("OK")
+}
+
+// commandInfo answers the COMMAND calls clients make on connect with no documentation.
+func commandInfo(s *server, w writer, args []string) {
+	w.array(0)
+}
+
+func get(s *server, w writer, args []string) {
+	value, err := s.bc.Get(args[0])
+	if err != nil {
+		if strings.HasSuffix(err.Error(), bitcask.KeyDoesNotExist) {
+			w.null()
+			return
+		}
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.bulk(value)
+}
+
+// set takes the NX and XX options, the expiry options are refused.
+func set(s *server, w writer, args []string) {
+	ifAbsent, ifPresent := false, false
+	for _, opt := range args[2:] {
+		switch strings.ToUpper(opt) {
+		case "NX":
+			ifAbsent = true
+		case "XX":
+			ifPresent = true
+		case "EX", "PX", "EXAT", "PXAT", "KEEPTTL":
+			w.error("ERR expiry is not supported by bitcask")
+			return
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+	if ifAbsent && ifPresent {
+		w.error("ERR syntax error")
+		return
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if ifAbsent || ifPresent {
+		_, err := s.bc.Get(args[0])
+		if exists := err == nil; ifAbsent && exists || ifPresent && !exists {
+			w.null()
+			return
+		}
+	}
+	if err := s.bc.Put(args[0], args[1]); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+func del(s *server, w writer, args []string) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	deleted := 0
+	for _, key := range args {
+		if s.bc.Delete(key) == nil {
+			deleted++
+		}
+	}
+	w.integer(deleted)
+}
+
+func exists(s *server, w writer, args []string) {
+	found := 0
+	for _, key := range args {
+		if _, err := s.bc.Get(key); err == nil {
+			found++
+		}
+	}
+	w.integer(found)
+}
+
+func keys(s *server, w writer, args []string) {
+	list := []string{}
+	for _, key := range s.bc.ListKeys() {
+		if matchGlob(args[0], key) {
+			list = append(list, key)
+		}
+	}
+	sort.Strings(list)
+	w.bulks(list)
+}
+
+// scan walks the sorted keys, the cursor is the position of the next key to scan.
+// Like Redis, COUNT bounds the keys scanned and MATCH filters them afterwards.
+func scan(s *server, w writer, args []string) {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		w.error("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				w.error("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	all := s.bc.ListKeys()
+	sort.Strings(all)
+	end := cursor + count
+	if end >= len(all) {
+		end = len(all)
+	}
+	list := []string{}
+	for i := cursor; i < end; i++ {
+		if matchGlob(pattern, all[i]) {
+			list = append(list, all[i])
+		}
+	}
+	next := end
+	if end == len(all) {
+		next = 0
+	}
+
+	w.array(2)
+	w.bulk(strconv.Itoa(next))
+	w.bulks(list)
+}
+
+func dbsize(s *server, w writer, args []string) {
+	w.integer(s.bc.Stats().Keys)
+}
+
+// ttl answers -1 for every existing key, bitcask keys never expire, and -2 for a missing key.
+func ttl(s *server, w writer, args []string) {
+	if _, err := s.bc.Get(args[0]); err != nil {
+		w.integer(-2)
+		return
+	}
+	w.integer(-1)
+}
+
+func noExpiry(s *server, w writer, args []string) {
+	w.error("ERR expiry is not supported by bitcask")
+}
+
+// flushdb deletes every key with DeleteAll, a SET or DEL of another client lands before
+// or after it, never in the middle. A crash during the flush may leave some keys behind.
+func flushdb(s *server, w writer, args []string) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if err := s.bc.DeleteAll(); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+func save(s *server, w writer, args []string) {
+	if err := s.bc.Sync(); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+func merge(s *server, w writer, args []string) {
+	if err := s.bc.Merge(); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+// matchGlob reports whether s matches a Redis glob pattern: * ? [abc] [^a] [a-z] and \ escapes.
+func matchGlob(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']') + 1
+			if end == 0 || s == "" {
+				return false
+			}
+			if !matchClass(pattern[1:end], s[0]) {
+				return false
+			}
+			pattern = pattern[end:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+func matchClass(class string, c byte) bool {
+	negate := strings.HasPrefix(class, "^")
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				matched = true
+			}
+			i += 2
+		} else if class[i] == c {
+			matched = true
+		}
+	}
+	return matched != negate
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bitcask"
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testBitcaskPath = path.Join("testing_dir")
+
+// client is a minimal RESP2 client, replies are decoded to strings, ints, nil, []any and errors.
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestServer(t *testing.T, network string, address string) (*client, *bitcask.Bitcask) {
+	t.Helper()
+	bc, err := bitcask.Open(testBitcaskPath, bitcask.ReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(bc)
+	go srv.Serve(listener)
+
+	conn, err := net.Dial(network, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Close()
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+	return &client{conn, bufio.NewReader(conn)}, bc
+}
+
+func (c *client) do(t *testing.T, args ...string) any {
+	t.Helper()
+	fmt.Fprintf(c.conn, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.conn, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	reply, err := c.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func (c *client) read() (any, error) {
+	line, err := readLine(c.r)
+	if err != nil || line == "" {
+		return nil, fmt.Errorf("bad reply %q: %v", line, err)
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return fmt.Errorf("%s", line[1:]), nil
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '$':
+		if line == "$-1" {
+			return nil, nil
+		}
+		bulk, err := readLine(c.r)
+		return bulk, err
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		list := []any{}
+		for i := 0; i < n; i++ {
+			item, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("bad reply %q", line)
+}
+
+func assertReply(t *testing.T, got any, want any) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+func assertErrorReply(t *testing.T, got any, prefix string) {
+	t.Helper()
+	if err, ok := got.(error); !ok || !strings.HasPrefix(err.Error(), prefix) {
+		t.Errorf("got %#v, want an error starting with %q", got, prefix)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	t.Run("get set and delete over tcp", func(t *testing.T) {
+		c, _ := newTestServer(t, "tcp", "127.0.0.1:0")
+
+		assertReply(t, c.do(t, "PING"), "PONG")
+		assertReply(t, c.do(t, "SET", "key1", "value1"), "OK")
+		assertReply(t, c.do(t, "get", "key1"), "value1")
+		assertReply(t, c.do(t, "GET", "key2"), nil)
+		assertReply(t, c.do(t, "EXISTS", "key1", "key2", "key1"), 2)
+		assertReply(t, c.do(t, "DEL", "key1", "key2"), 1)
+		assertReply(t, c.do(t, "GET", "key1"), nil)
+	})
+
+	t.Run("set nx and xx over a unix socket", func(t *testing.T) {
+		socket := path.Join(os.TempDir(), fmt.Sprintf("bitcask-redis-%d.sock", os.Getpid()))
+		defer os.Remove(socket)
+		c, _ := newTestServer(t, "unix", socket)
+
+		assertReply(t, c.do(t, "SET", "key1", "value1", "XX"), nil)
+		assertReply(t, c.do(t, "SET", "key1", "value1", "NX"), "OK")
+		assertReply(t, c.do(t, "SET", "key1", "value2", "NX"), nil)
+		assertReply(t, c.do(t, "SET", "key1", "value2", "XX"), "OK")
+		assertReply(t, c.do(t, "GET", "key1"), "value2")
+	})
+
+	t.Run("keys scan and dbsize", func(t *testing.T) {
+		c, _ := newTestServer(t, "tcp", "127.0.0.1:0")
+		for _, key := range []string{"user:2", "order:1", "user:1", "user:10"} {
+			c.do(t, "SET", key, "value")
+		}
+
+		assertReply(t, c.do(t, "DBSIZE"), 4)
+		assertReply(t, c.do(t, "KEYS", "user:?"), []any{"user:1", "user:2"})
+		assertReply(t, c.do(t, "KEYS", "*r:1*"), []any{"order:1", "user:1", "user:10"})
+
+		var scanned []any
+		cursor := "0"
+		for {
+			reply := c.do(t, "SCAN", cursor, "MATCH", "user:*", "COUNT", "1").([]any)
+			scanned = append(scanned, reply[1].([]any)...)
+			if cursor = reply[0].(string); cursor == "0" {
+				break
+			}
+		}
+		assertReply(t, scanned, []any{"user:1", "user:10", "user:2"})
+
+		assertReply(t, c.do(t, "FLUSHDB"), "OK")
+		assertReply(t, c.do(t, "DBSIZE"), 0)
+	})
+
+	t.Run("flushdb is atomic with the writes of other clients", func(t *testing.T) {
+		c, _ := newTestServer(t, "tcp", "127.0.0.1:0")
+		for i := 0; i < 3000; i++ {
+			fmt.Fprintf(c.conn, "SET old%d value\r\n", i)
+		}
+		for i := 0; i < 3000; i++ {
+			if reply, err := c.read(); err != nil || reply != "OK" {
+				t.Fatalf("got reply %v and error %v to SET", reply, err)
+			}
+		}
+		conn, err := net.Dial("tcp", c.conn.RemoteAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		writer := &client{conn, bufio.NewReader(conn)}
+
+		// the writer sets new keys and overwrites old ones while the flush runs.
+		var written []string
+		for i := 0; i < 1000; i++ {
+			written = append(written, fmt.Sprintf("new%d", i), fmt.Sprintf("old%d", i))
+		}
+		started := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			for i, key := range written {
+				if i == 100 {
+					close(started)
+				}
+				fmt.Fprintf(writer.conn, "*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$5\r\nvalue\r\n", len(key), key)
+				if reply, err := writer.read(); err != nil || reply != "OK" {
+					done <- fmt.Errorf("got reply %v and error %v to SET %s", reply, err, key)
+					return
+				}
+			}
+			done <- nil
+		}()
+		<-started
+		assertReply(t, c.do(t, "FLUSHDB"), "OK")
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		// the keys written after the flush all survive it, none written before does.
+		survivors := 0
+		for i := len(written) - 1; i >= 0 && c.do(t, "EXISTS", written[i]) == 1; i-- {
+			survivors++
+		}
+		assertReply(t, c.do(t, "DBSIZE"), survivors)
+	})
+
+	t.Run("keys never expire", func(t *testing.T) {
+		c, _ := newTestServer(t, "tcp", "127.0.0.1:0")
+		c.do(t, "SET", "key1", "value1")
+
+		assertReply(t, c.do(t, "TTL", "key1"), -1)
+		assertReply(t, c.do(t, "TTL", "key2"), -2)
+		assertErrorReply(t, c.do(t, "EXPIRE", "key1", "10"), "ERR expiry")
+		assertErrorReply(t, c.do(t, "SET", "key1", "value1", "EX", "10"), "ERR expiry")
+	})
+
+	t.Run("merge and save", func(t *testing.T) {
+		c, bc := newTestServer(t, "tcp", "127.0.0.1:0")
+		for i := 0; i < 20; i++ {
+			c.do(t, "SET", "key", "value")
+		}
+
+		assertReply(t, c.do(t, "SAVE"), "OK")
+		assertReply(t, c.do(t, "MERGE"), "OK")
+		if stats := bc.Stats(); stats.Keys != 1 || stats.PendingWrites != 0 {
+			t.Errorf("got stats %+v, want 1 key and no pending writes", stats)
+		}
+	})
+
+	t.Run("inline and pipelined commands", func(t *testing.T) {
+		c, _ := newTestServer(t, "tcp", "127.0.0.1:0")
+
+		fmt.Fprint(c.conn, "SET key1 value1\r\nGET key1\r\nECHO hello\r\n")
+		for _, want := range []any{"OK", "value1", "hello"} {
+			got, err := c.read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertReply(t, got, want)
+		}
+	})
+
+	t.Run("null and negative arrays are ignored", func(t *testing.T) {
+		c, _ := newTestServer(t, "tcp", "127.0.0.1:0")
+
+		fmt.Fprint(c.conn, "*-1\r\n*-5\r\n*0\r\n")
+		assertReply(t, c.do(t, "PING"), "PONG")
+	})
+
+	t.Run("reject bad commands", func(t *testing.T) {
+		c, _ := newTestServer(t, "tcp", "127.0.0.1:0")
+
+		assertErrorReply(t, c.do(t, "NOTHING"), "ERR unknown command")
+		assertErrorReply(t, c.do(t, "GET"), "ERR wrong number of arguments")
+		assertErrorReply(t, c.do(t, "SET", "key1", "value1", "NX", "XX"), "ERR syntax error")
+		assertErrorReply(t, c.do(t, "SELECT", "1"), "ERR DB index")
+		assertReply(t, c.do(t, "QUIT"), "OK")
+	})
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*a*b", "xaxxb", true},
+	}
+	for _, test := range tests {
+		if got := matchGlob(test.pattern, test.s); got != test.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", test.pattern, test.s, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Command bitcask-server serves a bitcask datastore over HTTP and JSON.
+//
+//	bitcask-server [-addr :8080] [-sync] <dir>
+//
+// On SIGINT or SIGTERM it stops accepting requests, waits for the running ones
+// and closes the datastore, so every acknowledged write is on disk.
+package main
+
+import (
+	"bitcask"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	syncOnPut := flag.Bool("sync", false, "fsync every write before answering")
+	maxValueSize := flag.Int64("max-value-size", 64<<20, "largest value a PUT accepts, in bytes")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for running requests on shutdown")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bitcask-server [flags] <dir>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := []bitcask.ConfigOpt{bitcask.ReadWrite}
+	if *syncOnPut {
+		opts = append(opts, bitcask.SyncOnPut)
+	}
+	bc, err := bitcask.Open(flag.Arg(0), opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		bc.Close()
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("serving %s on %s", flag.Arg(0), listener.Addr())
+	if err := serve(ctx, listener, bc, *maxValueSize, *shutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve serves bc on listener until ctx is done, then shuts the server down
+// gracefully and closes bc. When the running requests outlast shutdownTimeout,
+// their connections are closed and bc is only closed once their handlers return.
+func serve(ctx context.Context, listener net.Listener, bc *bitcask.Bitcask, maxValueSize int64, shutdownTimeout time.Duration) error {
+	// closing is set under mu before waiting for the handlers, so no handler
+	// starts on bc once the wait begins.
+	var mu sync.Mutex
+	var closing bool
+	var handlers sync.WaitGroup
+	handler := newServer(bc, maxValueSize)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if closing {
+			mu.Unlock()
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		handlers.Add(1)
+		mu.Unlock()
+		defer handlers.Done()
+		handler.ServeHTTP(w, r)
+	})}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
+
+	var err error
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err = srv.Shutdown(shutdownCtx)
+		cancel()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		srv.Close()
+	}
+	mu.Lock()
+	closing = true
+	mu.Unlock()
+	handlers.Wait()
+	bc.Close()
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
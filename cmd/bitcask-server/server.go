@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bitcask"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// server serves a single bitcask datastore over HTTP:
+//
+//	GET    /keys/{key}      the value, with an ETag from the timestamp and sequence number of its write
+//	PUT    /keys/{key}      stores the request body, If-Match makes it conditional
+//	DELETE /keys/{key}      removes the key, If-Match makes it conditional
+//	GET    /keys?prefix=p   the keys starting with p as a JSON array
+//	POST   /merge           merges the data files
+//	POST   /sync            fsyncs the pending writes
+//	GET    /stats           the datastore stats as JSON
+type server struct {
+	bc           *bitcask.Bitcask
+	maxValueSize int64
+
+	// mu makes the check of If-Match and the write it guards atomic.
+	mu sync.Mutex
+}
+
+func newServer(bc *bitcask.Bitcask, maxValueSize int64) *server {
+	return &server{bc: bc, maxValueSize: maxValueSize}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/keys/"):
+		key := strings.TrimPrefix(r.URL.Path, "/keys/")
+		if key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			s.get(w, r, key)
+		case http.MethodPut:
+			s.put(w, r, key)
+		case http.MethodDelete:
+			s.delete(w, r, key)
+		default:
+			methodNotAllowed(w, "GET, HEAD, PUT, DELETE")
+		}
+	case r.URL.Path == "/keys":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		s.keys(w, r)
+	case r.URL.Path == "/merge":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		s.reply(w, s.bc.Merge())
+	case r.URL.Path == "/sync":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		s.reply(w, s.bc.Sync())
+	case r.URL.Path == "/stats":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, s.bc.Stats())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *server) get(w http.ResponseWriter, r *http.Request, key string) {
+	entry, err := s.bc.GetEntry(key)
+	if err != nil {
+		s.reply(w, err)
+		return
+	}
+
+	tag := etag(entry)
+	w.Header().Set("ETag", tag)
+	if matchesETag(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(len(entry.Value)))
+	if r.Method != http.MethodHead {
+		io.WriteString(w, entry.Value)
+	}
+}
+
+func (s *server) put(w http.ResponseWriter, r *http.Request, key string) {
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxValueSize))
+	if err != nil {
+		http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.checkPrecondition(w, r, key) {
+		return
+	}
+	if err := s.bc.Put(key, string(value)); err != nil {
+		s.reply(w, err)
+		return
+	}
+	if entry, err := s.bc.GetEntry(key); err == nil {
+		w.Header().Set("ETag", etag(entry))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) delete(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.checkPrecondition(w, r, key) {
+		return
+	}
+	s.reply(w, s.bc.Delete(key))
+}
+
+// checkPrecondition answers 412 and reports false when If-Match does not match the current value of key.
+func (s *server) checkPrecondition(w http.ResponseWriter, r *http.Request, key string) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+	entry, err := s.bc.GetEntry(key)
+	if err == nil && matchesETag(ifMatch, etag(entry)) {
+		return true
+	}
+	http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+	return false
+}
+
+func (s *server) keys(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	list := []string{}
+	for _, key := range s.bc.ListKeys() {
+		if strings.HasPrefix(key, prefix) {
+			list = append(list, key)
+		}
+	}
+	sort.Strings(list)
+	writeJSON(w, list)
+}
+
+// reply answers 204 for a nil error, 404 for a missing key and 500 otherwise.
+func (s *server) reply(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(err.Error(), bitcask.KeyDoesNotExist):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// etag identifies a write of a key by its timestamp, and its sequence number
+// for writes within the same microsecond.
+func etag(entry bitcask.Entry) string {
+	return fmt.Sprintf(`"%d.%d"`, entry.Tstamp, entry.Seq)
+}
+
+// matchesETag reports whether the If-Match or If-None-Match header value lists tag or is "*".
+func matchesETag(header string, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
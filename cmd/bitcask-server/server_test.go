@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bitcask"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testBitcaskPath = path.Join("testing_dir")
+
+func newTestServer(t *testing.T) (*httptest.Server, *bitcask.Bitcask) {
+	t.Helper()
+	bc, err := bitcask.Open(testBitcaskPath, bitcask.ReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(newServer(bc, 1<<10))
+	t.Cleanup(func() {
+		ts.Close()
+		bc.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+	return ts, bc
+}
+
+func do(t *testing.T, method string, url string, body string, header map[string]string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+func assertStatus(t *testing.T, resp *http.Response, want int) {
+	t.Helper()
+	if resp.StatusCode != want {
+		t.Errorf("%s %s: got status %d, want %d", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, want)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	t.Run("put get and delete a key", func(t *testing.T) {
+		ts, _ := newTestServer(t)
+
+		resp, _ := do(t, http.MethodPut, ts.URL+"/keys/user/1", "value\n1", nil)
+		assertStatus(t, resp, http.StatusNoContent)
+		putTag := resp.Header.Get("ETag")
+
+		resp, body := do(t, http.MethodGet, ts.URL+"/keys/user/1", "", nil)
+		assertStatus(t, resp, http.StatusOK)
+		if body != "value\n1" || resp.Header.Get("ETag") != putTag {
+			t.Errorf("got %q with ETag %s, want %q with ETag %s", body, resp.Header.Get("ETag"), "value\n1", putTag)
+		}
+
+		resp, _ = do(t, http.MethodDelete, ts.URL+"/keys/user/1", "", nil)
+		assertStatus(t, resp, http.StatusNoContent)
+		resp, _ = do(t, http.MethodGet, ts.URL+"/keys/user/1", "", nil)
+		assertStatus(t, resp, http.StatusNotFound)
+		resp, _ = do(t, http.MethodDelete, ts.URL+"/keys/user/1", "", nil)
+		assertStatus(t, resp, http.StatusNotFound)
+	})
+
+	t.Run("conditional requests", func(t *testing.T) {
+		ts, _ := newTestServer(t)
+
+		resp, _ := do(t, http.MethodPut, ts.URL+"/keys/key1", "value1", nil)
+		tag := resp.Header.Get("ETag")
+
+		resp, _ = do(t, http.MethodGet, ts.URL+"/keys/key1", "", map[string]string{"If-None-Match": tag})
+		assertStatus(t, resp, http.StatusNotModified)
+
+		resp, _ = do(t, http.MethodPut, ts.URL+"/keys/key1", "value2", map[string]string{"If-Match": tag})
+		assertStatus(t, resp, http.StatusNoContent)
+		if resp.Header.Get("ETag") == tag {
+			t.Errorf("got the same ETag %s after a write", tag)
+		}
+
+		resp, _ = do(t, http.MethodPut, ts.URL+"/keys/key1", "value3", map[string]string{"If-Match": tag})
+		assertStatus(t, resp, http.StatusPreconditionFailed)
+		resp, _ = do(t, http.MethodDelete, ts.URL+"/keys/key1", "", map[string]string{"If-Match": tag})
+		assertStatus(t, resp, http.StatusPreconditionFailed)
+
+		_, body := do(t, http.MethodGet, ts.URL+"/keys/key1", "", nil)
+		if body != "value2" {
+			t.Errorf("got %q, want %q", body, "value2")
+		}
+	})
+
+	t.Run("list keys by prefix", func(t *testing.T) {
+		ts, _ := newTestServer(t)
+		for _, key := range []string{"user/2", "order/1", "user/1"} {
+			do(t, http.MethodPut, ts.URL+"/keys/"+key, "value", nil)
+		}
+
+		_, body := do(t, http.MethodGet, ts.URL+"/keys?prefix=user/", "", nil)
+		var got []string
+		json.Unmarshal([]byte(body), &got)
+		if want := []string{"user/1", "user/2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("reject bad requests", func(t *testing.T) {
+		ts, _ := newTestServer(t)
+
+		resp, _ := do(t, http.MethodPut, ts.URL+"/keys/", "value", nil)
+		assertStatus(t, resp, http.StatusBadRequest)
+		resp, _ = do(t, http.MethodPut, ts.URL+"/keys/big", strings.Repeat("v", 2<<10), nil)
+		assertStatus(t, resp, http.StatusRequestEntityTooLarge)
+		resp, _ = do(t, http.MethodPost, ts.URL+"/keys/key1", "value", nil)
+		assertStatus(t, resp, http.StatusMethodNotAllowed)
+		resp, _ = do(t, http.MethodGet, ts.URL+"/merge", "", nil)
+		assertStatus(t, resp, http.StatusMethodNotAllowed)
+		resp, _ = do(t, http.MethodGet, ts.URL+"/nothing", "", nil)
+		assertStatus(t, resp, http.StatusNotFound)
+	})
+}
+
+func TestAdmin(t *testing.T) {
+	t.Run("merge sync and stats", func(t *testing.T) {
+		ts, _ := newTestServer(t)
+		for i := 0; i < 20; i++ {
+			do(t, http.MethodPut, ts.URL+"/keys/key", "value", nil)
+		}
+
+		resp, _ := do(t, http.MethodPost, ts.URL+"/sync", "", nil)
+		assertStatus(t, resp, http.StatusNoContent)
+		resp, _ = do(t, http.MethodPost, ts.URL+"/merge", "", nil)
+		assertStatus(t, resp, http.StatusNoContent)
+
+		resp, body := do(t, http.MethodGet, ts.URL+"/stats", "", nil)
+		assertStatus(t, resp, http.StatusOK)
+		var stats bitcask.Stats
+		json.Unmarshal([]byte(body), &stats)
+		if stats.Keys != 1 || stats.PendingWrites != 0 {
+			t.Errorf("got stats %+v, want 1 key and no pending writes", stats)
+		}
+	})
+}
+
+func TestServe(t *testing.T) {
+	t.Run("shutdown closes the datastore", func(t *testing.T) {
+		bc, _ := bitcask.Open(testBitcaskPath, bitcask.ReadWrite)
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- serve(ctx, listener, bc, 1<<10, time.Second)
+		}()
+
+		resp, _ := do(t, http.MethodPut, "http://"+listener.Addr().String()+"/keys/key1", "value1", nil)
+		assertStatus(t, resp, http.StatusNoContent)
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("got error %q, want none", err)
+		}
+
+		reader, err := bitcask.Open(testBitcaskPath)
+		if err != nil {
+			t.Fatalf("got error %q, want the writer closed", err)
+		}
+		got, _ := reader.Get("key1")
+		if got != "value1" {
+			t.Errorf("got %q, want %q", got, "value1")
+		}
+		reader.Close()
+		os.RemoveAll(testBitcaskPath)
+	})
+
+	t.Run("a request outlasting the shutdown timeout ends before the datastore is closed", func(t *testing.T) {
+		bc, _ := bitcask.Open(testBitcaskPath, bitcask.ReadWrite)
+		defer os.RemoveAll(testBitcaskPath)
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- serve(ctx, listener, bc, 1<<10, 100*time.Millisecond)
+		}()
+
+		// the body of the PUT is never sent, so its handler waits for it past the timeout.
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "PUT /keys/key1 HTTP/1.1\r\nHost: bitcask\r\nContent-Length: 6\r\n\r\n")
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+
+		if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+		reader, err := bitcask.Open(testBitcaskPath)
+		if err != nil {
+			t.Fatalf("got error %q, want the writer closed", err)
+		}
+		reader.Close()
+	})
+}
@@ -0,0 +1,417 @@
+// Command bitcask inspects and edits bitcask datastores.
+//
+//	bitcask [-read-only] [-json] <command> <dir> [args]
+//
+// get, keys, stats, dump and verify always open the datastore read only.
+// put reads the value from stdin when it is omitted or "-".
+// With -read-only put, delete and merge fail instead of opening the datastore for writing.
+// fsck checks the files of a datastore no process has open, and repairs them with -repair.
+// inspect decodes a single data, hint, keydir or checkpoint file record by record.
+package main
+
+import (
+	"bitcask"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+// errUsage is returned by a command run with wrong arguments.
+var errUsage = errors.New("wrong arguments")
+
+var (
+	readOnly   = flag.Bool("read-only", false, "never open the datastore for writing")
+	jsonOutput = flag.Bool("json", false, "print results as JSON")
+)
+
+// stdin and stdout are the input and output of the commands.
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+)
+
+var commands = []command{
+	{"get", "get <dir> <key>", get},
+	{"put", "put <dir> <key> [value]", put},
+	{"delete", "delete <dir> <key>", del},
+	{"keys", "keys <dir> [prefix]", keys},
+	{"merge", "merge <dir>", merge},
+	{"stats", "stats <dir>", stats},
+	{"dump", "dump <dir>", dump},
+	{"verify", "verify <dir>", verify},
+	{"fsck", "fsck [-repair] <dir>", fsck},
+	{"inspect", "inspect [-hex] [-width n] <file>", inspect},
+	{"migrate", "migrate <dir>", migrate},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, isExist := lookup(flag.Arg(0))
+	if !isExist {
+		usage()
+		os.Exit(2)
+	}
+	err := cmd.run(flag.Args()[1:])
+	if err == errUsage {
+		fmt.Fprintf(os.Stderr, "usage: bitcask [flags] %s\n", cmd.usage)
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// lookup returns the command named name.
+func lookup(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: bitcask [flags] <command> <dir> [args]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr, "flags:")
+	flag.PrintDefaults()
+}
+
+// open opens the datastore in dir, for writing when writes is set and -read-only is not.
+func open(dir string, writes bool) (*bitcask.Bitcask, error) {
+	if writes && !*readOnly {
+		return bitcask.Open(dir, bitcask.ReadWrite)
+	}
+	return bitcask.Open(dir)
+}
+
+// output prints v as JSON with -json, and calls text otherwise.
+func output(v any, text func()) error {
+	if *jsonOutput {
+		return json.NewEncoder(stdout).Encode(v)
+	}
+	text()
+	return nil
+}
+
+func get(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	bc, err := open(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	value, err := bc.Get(args[1])
+	if err != nil {
+		return err
+	}
+	return output(map[string]string{"key": args[1], "value": value}, func() {
+		fmt.Fprintln(stdout, value)
+	})
+}
+
+func put(args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errUsage
+	}
+	var value string
+	if len(args) == 2 || args[2] == "-" {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		value = string(data)
+	} else {
+		value = args[2]
+	}
+
+	bc, err := open(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	return bc.Put(args[1], value)
+}
+
+func del(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	bc, err := open(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	return bc.Delete(args[1])
+}
+
+func keys(args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errUsage
+	}
+	prefix := ""
+	if len(args) == 2 {
+		prefix = args[1]
+	}
+	bc, err := open(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	list := []string{}
+	for _, key := range bc.ListKeys() {
+		if strings.HasPrefix(key, prefix) {
+			list = append(list, key)
+		}
+	}
+	sort.Strings(list)
+
+	return output(list, func() {
+		for _, key := range list {
+			fmt.Fprintln(stdout, key)
+		}
+	})
+}
+
+func merge(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	bc, err := open(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	return bc.Merge()
+}
+
+func stats(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	bc, err := open(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	s := bc.Stats()
+	return output(s, func() {
+		fmt.Fprintf(stdout, "keys: %d\n", s.Keys)
+		fmt.Fprintf(stdout, "buckets: %d\n", s.Buckets)
+		fmt.Fprintf(stdout, "data files: %d\n", s.DataFiles)
+		fmt.Fprintf(stdout, "data bytes: %d\n", s.DataBytes)
+		fmt.Fprintf(stdout, "hint files: %d\n", s.HintFiles)
+	})
+}
+
+// dump prints every key and value, quoted, or one JSON object per line with -json.
+func dump(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	bc, err := open(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	encoder := json.NewEncoder(stdout)
+	err, _ = bc.Fold(func(key string, value string, acc any) any {
+		if acc != nil {
+			return acc
+		}
+		if *jsonOutput {
+			return encoder.Encode(map[string]string{"key": key, "value": value})
+		}
+		fmt.Fprintf(stdout, "%q\t%q\n", key, value)
+		return nil
+	}, nil).(error)
+	return err
+}
+
+// verify reads the value of every key and reports the keys that cannot be read.
+func verify(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	bc, err := open(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	list := bc.ListKeys()
+	failures := []string{}
+	for _, key := range list {
+		if _, err := bc.Get(key); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", key, err))
+		}
+	}
+
+	err = output(map[string]any{"keys": len(list), "failures": failures}, func() {
+		for _, failure := range failures {
+			fmt.Fprintln(stdout, failure)
+		}
+		fmt.Fprintf(stdout, "%d keys, %d unreadable\n", len(list), len(failures))
+	})
+	if err == nil && len(failures) > 0 {
+		err = fmt.Errorf("%d of %d keys unreadable", len(failures), len(list))
+	}
+	return err
+}
+
+// fsck reports the problems bitcask.Verify finds, and repairs them with -repair.
+func fsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	repair := flags.Bool("repair", false, "repair the problems found")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+
+	check := bitcask.Verify
+	if *repair {
+		check = bitcask.Repair
+	}
+	problems, err := check(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	descriptions := []string{}
+	for _, problem := range problems {
+		descriptions = append(descriptions, problem.String())
+	}
+	err = output(map[string]any{"problems": descriptions, "repaired": *repair}, func() {
+		for _, description := range descriptions {
+			fmt.Fprintln(stdout, description)
+		}
+		if *repair {
+			fmt.Fprintf(stdout, "%d problems repaired\n", len(problems))
+		} else {
+			fmt.Fprintf(stdout, "%d problems\n", len(problems))
+		}
+	})
+	if err == nil && len(problems) > 0 && !*repair {
+		err = fmt.Errorf("%d problems found, run bitcask fsck -repair", len(problems))
+	}
+	return err
+}
+
+// inspect prints every record of a file with its offset, values truncated to -width bytes.
+func inspect(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	hexValues := flags.Bool("hex", false, "print keys and values in hex")
+	width := flags.Int("width", 32, "truncate values to n bytes, 0 for no limit")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+
+	format := func(s string) string {
+		if *hexValues {
+			return hex.EncodeToString([]byte(s))
+		}
+		return strconv.Quote(s)
+	}
+
+	header, err := bitcask.ReadFileHeader(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(stdout)
+	if *jsonOutput {
+		if err := encoder.Encode(header); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(stdout, "%s file, format version %d, created %s\n", header.Kind, header.Version,
+			time.UnixMicro(header.CreatedAt).Format(time.RFC3339))
+	}
+
+	var printErr error
+	err = bitcask.ScanFile(flags.Arg(0), func(rec bitcask.FileRecord) {
+		if *width > 0 && len(rec.Value) > *width {
+			rec.Value = rec.Value[:*width]
+		}
+		if *jsonOutput {
+			if printErr == nil {
+				printErr = encoder.Encode(rec)
+			}
+			return
+		}
+
+		if rec.Malformed != "" && rec.Key == "" {
+			fmt.Fprintf(stdout, "%10d  MALFORMED: %s\n", rec.Offset, rec.Malformed)
+			return
+		}
+		line := fmt.Sprintf("%10d  tstamp %d  seq %d", rec.Offset, rec.Tstamp, rec.Seq)
+		if rec.Bucket != 0 {
+			line += fmt.Sprintf("  bucket %d", rec.Bucket)
+		}
+		line += fmt.Sprintf("  key %d bytes %s", rec.KeySize, format(rec.Key))
+		if rec.IsTompStone {
+			line += "  TOMPSTONE"
+		} else {
+			line += fmt.Sprintf("  value %d bytes", rec.ValueSize)
+		}
+		if rec.FileId != "" {
+			line += fmt.Sprintf("  in %s", rec.FileId)
+		}
+		if rec.ValuePos > 0 {
+			line += fmt.Sprintf(" at %d", rec.ValuePos)
+		}
+		if rec.Value != "" {
+			line += "  " + format(rec.Value)
+		}
+		if rec.Malformed != "" {
+			line += "  MALFORMED: " + rec.Malformed
+		}
+		fmt.Fprintln(stdout, line)
+	})
+	if err != nil {
+		return err
+	}
+	return printErr
+}
+
+// migrate converts a datastore written before file format versions to the current format.
+func migrate(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	return bitcask.Migrate(args[0])
+}
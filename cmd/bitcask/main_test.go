@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestArguments(t *testing.T) {
+	tests := []struct {
+		command string
+		args    []string
+	}{
+		{"get", nil},
+		{"get", []string{"dir"}},
+		{"get", []string{"dir", "key", "extra"}},
+		{"put", []string{"dir"}},
+		{"put", []string{"dir", "key", "value", "extra"}},
+		{"delete", []string{"dir"}},
+		{"keys", nil},
+		{"keys", []string{"dir", "prefix", "extra"}},
+		{"merge", nil},
+		{"stats", []string{"dir", "extra"}},
+		{"dump", nil},
+		{"verify", nil},
+		{"fsck", nil},
+		{"fsck", []string{"-unknown", "dir"}},
+		{"fsck", []string{"-repair", "dir", "extra"}},
+		{"inspect", nil},
+		{"inspect", []string{"-width", "wide", "file"}},
+		{"migrate", []string{"dir", "extra"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.command+" "+strings.Join(test.args, " "), func(t *testing.T) {
+			cmd, isExist := lookup(test.command)
+			if !isExist {
+				t.Fatalf("command %q not found", test.command)
+			}
+			if err := cmd.run(test.args); err != errUsage {
+				t.Errorf("got error %v, want %v", err, errUsage)
+			}
+		})
+	}
+
+	t.Run("unknown command", func(t *testing.T) {
+		if _, isExist := lookup("nothing"); isExist {
+			t.Error("found command \"nothing\", want none")
+		}
+	})
+}
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		readOnly bool
+		json     bool
+		input    string
+		args     []string
+		want     string
+		wantErr  string
+	}{
+		{name: "put a value", args: []string{"put", "{dir}", "key1", "value1"}},
+		{name: "put a value from stdin", input: "value\n2", args: []string{"put", "{dir}", "key2", "-"}},
+		{name: "put with read only", readOnly: true, args: []string{"put", "{dir}", "key3", "value3"}, wantErr: "write permission denied"},
+		{name: "get a value", args: []string{"get", "{dir}", "key1"}, want: "value1\n"},
+		{name: "get a value as json", json: true, args: []string{"get", "{dir}", "key2"}, want: `{"key":"key2","value":"value\n2"}` + "\n"},
+		{name: "get a missing key", args: []string{"get", "{dir}", "key3"}, wantErr: "key3: key does not exist"},
+		{name: "list the keys", args: []string{"keys", "{dir}"}, want: "key1\nkey2\n"},
+		{name: "list the keys with a prefix as json", json: true, args: []string{"keys", "{dir}", "key2"}, want: `["key2"]` + "\n"},
+		{name: "delete a key", args: []string{"delete", "{dir}", "key1"}},
+		{name: "delete a missing key", args: []string{"delete", "{dir}", "key1"}, wantErr: "key1: key does not exist"},
+		{name: "list the keys left", args: []string{"keys", "{dir}"}, want: "key2\n"},
+		{name: "get from a missing datastore", args: []string{"get", "{dir}/missing", "key1"}, wantErr: "read only cannot create new bitcask directory"},
+	}
+
+	dir := path.Join(t.TempDir(), "bitcask")
+	defer func() {
+		*readOnly, *jsonOutput = false, false
+		stdin, stdout = os.Stdin, os.Stdout
+	}()
+
+	// the cases run in order, each on the datastore the previous ones left.
+	for _, test := range tests {
+		*readOnly, *jsonOutput = test.readOnly, test.json
+		stdin = strings.NewReader(test.input)
+		var out bytes.Buffer
+		stdout = &out
+
+		args := make([]string, len(test.args))
+		for i, arg := range test.args {
+			args[i] = strings.Replace(arg, "{dir}", dir, 1)
+		}
+		cmd, _ := lookup(args[0])
+		err := cmd.run(args[1:])
+
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: got error %q, want none", test.name, err)
+		case test.wantErr != "" && (err == nil || err.Error() != test.wantErr):
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+		}
+		if got := out.String(); got != test.want {
+			t.Errorf("%s: got output %q, want %q", test.name, got, test.want)
+		}
+	}
+}
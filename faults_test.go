@@ -0,0 +1,518 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var errInjected = errors.New("injected fault")
+var errCrashed = errors.New("process crashed")
+
+type faultOp int
+
+const (
+    opWrite faultOp = iota
+    opSync
+    opRename
+    opRemove
+    opCreate
+)
+
+var faultOpNames = []string{"write", "sync", "rename", "remove", "create"}
+
+// fault fails the at-th operation of its kind. A failed write keeps its first keep bytes,
+// a negative keep writes nothing.
+type fault struct {
+    op faultOp
+    at int
+    keep int
+}
+
+// faultFS is a MemFS that fails chosen operations and simulates crashes.
+// It keeps the content of every file as of its last fsync, directory operations are durable at once.
+// Once the process crashed, at a given step, every file operation fails with errCrashed
+// and crash returns the files a reboot would find.
+type faultFS struct {
+    *MemFS
+    mu sync.Mutex
+    durable map[*memFileData][]byte
+    counts map[faultOp]int
+    faults []fault
+    steps int
+    crashAt int
+    isCrashed bool
+}
+
+type faultFile struct {
+    *memFile
+    fs *faultFS
+}
+
+func newFaultFS() *faultFS {
+
+    return &faultFS{
+        MemFS: NewMemFS(),
+        durable: make(map[*memFileData][]byte),
+        counts: make(map[faultOp]int),
+    }
+
+}
+
+// inject makes an operation fail, with the bytes it keeps for a write.
+func (fs *faultFS) inject(f fault) {
+
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    fs.faults = append(fs.faults, f)
+
+}
+
+// crashAfter makes the process crash at the n-th file operation from now.
+func (fs *faultFS) crashAfter(n int) {
+
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    fs.crashAt = fs.steps + n
+
+}
+
+func (fs *faultFS) crashed() bool {
+
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    return fs.isCrashed
+
+}
+
+// step counts an operation and returns, for a write, the bytes it keeps and the error it fails with.
+func (fs *faultFS) step(op faultOp) (int, error) {
+
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+
+    if fs.isCrashed {
+        return -1, errCrashed
+    }
+    fs.steps++
+    fs.counts[op]++
+    if fs.crashAt > 0 && fs.steps >= fs.crashAt {
+        fs.isCrashed = true
+        return -1, errCrashed
+    }
+    for _, f := range fs.faults {
+        if f.op == op && f.at == fs.counts[op] {
+            return f.keep, errInjected
+        }
+    }
+
+    return 0, nil
+
+}
+
+// crash returns the files left on disk: the fsynced content of every file and, of a file only
+// appended to since, a random part of what was appended, as a torn write would leave.
+func (fs *faultFS) crash(rng *rand.Rand) *MemFS {
+
+    fs.MemFS.mu.Lock()
+    defer fs.MemFS.mu.Unlock()
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+
+    fs.isCrashed = true
+    disk := NewMemFS()
+    for name := range fs.MemFS.dirs {
+        disk.dirs[name] = true
+    }
+    for name, file := range fs.MemFS.files {
+        synced := fs.durable[file]
+        data := synced
+        if bytes.HasPrefix(file.data, synced) && len(file.data) > len(synced) {
+            data = file.data[:len(synced) + rng.Intn(len(file.data) - len(synced) + 1)]
+        }
+        disk.files[name] = &memFileData{data: append([]byte(nil), data...), modTime: file.modTime}
+    }
+
+    return disk
+
+}
+
+func (fs *faultFS) wrap(file File, err error) (File, error) {
+
+    if err != nil {
+        return nil, err
+    }
+
+    return faultFile{file.(*memFile), fs}, nil
+
+}
+
+func (fs *faultFS) Open(name string) (File, error) {
+
+    return fs.wrap(fs.MemFS.Open(name))
+
+}
+
+func (fs *faultFS) Create(name string) (File, error) {
+
+    if _, err := fs.step(opCreate); err != nil {
+        return nil, err
+    }
+
+    return fs.wrap(fs.MemFS.Create(name))
+
+}
+
+func (fs *faultFS) Rename(oldName string, newName string) error {
+
+    if _, err := fs.step(opRename); err != nil {
+        return err
+    }
+
+    return fs.MemFS.Rename(oldName, newName)
+
+}
+
+func (fs *faultFS) Remove(name string) error {
+
+    if _, err := fs.step(opRemove); err != nil {
+        return err
+    }
+
+    return fs.MemFS.Remove(name)
+
+}
+
+func (fs *faultFS) Truncate(name string, size int64) error {
+
+    if _, err := fs.step(opWrite); err != nil {
+        return err
+    }
+
+    return fs.MemFS.Truncate(name, size)
+
+}
+
+func (file faultFile) Write(buf []byte) (int, error) {
+
+    keep, err := file.fs.step(opWrite)
+    if err == nil {
+        return file.memFile.Write(buf)
+    }
+    if keep > 0 && keep < len(buf) {
+        n, _ := file.memFile.Write(buf[:keep])
+        return n, err
+    }
+
+    return 0, err
+
+}
+
+func (file faultFile) WriteAt(buf []byte, offset int64) (int, error) {
+
+    keep, err := file.fs.step(opWrite)
+    if err == nil {
+        return file.memFile.WriteAt(buf, offset)
+    }
+    if keep > 0 && keep < len(buf) {
+        n, _ := file.memFile.WriteAt(buf[:keep], offset)
+        return n, err
+    }
+
+    return 0, err
+
+}
+
+func (file faultFile) Sync() error {
+
+    if _, err := file.fs.step(opSync); err != nil {
+        return err
+    }
+
+    file.fs.MemFS.mu.Lock()
+    defer file.fs.MemFS.mu.Unlock()
+    file.fs.mu.Lock()
+    defer file.fs.mu.Unlock()
+    file.fs.durable[file.file] = append([]byte(nil), file.file.data...)
+
+    return nil
+
+}
+
+// faultModel records the writes of a workload, whether each was acknowledged,
+// and checks a reopened datastore against them.
+type faultModel struct {
+    history map[string][]modelWrite
+    order []string
+}
+
+type modelWrite struct {
+    value string
+    isDeleted bool
+    isAcked bool
+}
+
+func newFaultModel() *faultModel {
+
+    return &faultModel{history: make(map[string][]modelWrite)}
+
+}
+
+func (model *faultModel) write(key string, write modelWrite) {
+
+    if _, isExist := model.history[key]; !isExist {
+        model.order = append(model.order, key)
+    }
+    model.history[key] = append(model.history[key], write)
+
+}
+
+// put records a Put, acknowledged when it returned no error under SyncOnPut.
+func (model *faultModel) put(key string, value string, isAcked bool) {
+
+    model.write(key, modelWrite{value: value, isAcked: isAcked})
+
+}
+
+// delete records a Delete, one that found no key writes nothing.
+func (model *faultModel) delete(key string, err error, isAcked bool) {
+
+    if err != nil && strings.HasSuffix(err.Error(), KeyDoesNotExist) {
+        return
+    }
+    model.write(key, modelWrite{isDeleted: true, isAcked: isAcked && err == nil})
+
+}
+
+// sync acknowledges every write so far.
+func (model *faultModel) sync() {
+
+    for _, writes := range model.history {
+        for i := range writes {
+            writes[i].isAcked = true
+        }
+    }
+
+}
+
+// check asserts that every key holds its last acknowledged write or a later one,
+// so no acknowledged write is lost, and that no key holds a value it was never given.
+func (model *faultModel) check(t *testing.T, b *Bitcask) {
+
+    t.Helper()
+
+    for _, key := range model.order {
+        writes := model.history[key]
+        lastAcked := -1
+        for i, write := range writes {
+            if write.isAcked {
+                lastAcked = i
+            }
+        }
+
+        value, err := b.Get(key)
+        isFound := false
+        if lastAcked == -1 && err != nil {
+            isFound = true
+        }
+        for i := lastAcked; i < len(writes) && !isFound; i++ {
+            if i == -1 {
+                continue
+            }
+            if writes[i].isDeleted {
+                isFound = err != nil
+            } else {
+                isFound = err == nil && value == writes[i].value
+            }
+        }
+        if !isFound {
+            t.Errorf("key %s: got %q, error %v, want one of %+v after write %d", key, value, err, writes, lastAcked)
+        }
+    }
+
+    for _, key := range b.ListKeys() {
+        if _, isExist := model.history[key]; !isExist {
+            t.Errorf("got phantom key %s", key)
+        }
+    }
+
+}
+
+// runFaultWorkload puts and deletes keys, syncing and merging now and then, until the process crashes.
+func runFaultWorkload(rng *rand.Rand, b *Bitcask, fs *faultFS, model *faultModel, ops int, merges bool) {
+
+    for i := 0; i < ops && !fs.crashed(); i++ {
+        key := fmt.Sprintf("key%d", rng.Intn(20))
+        switch n := rng.Intn(20); {
+        case n < 14:
+            value := fmt.Sprintf("value%d-%d", i, rng.Intn(1000))
+            err := b.Put(key, value)
+            model.put(key, value, err == nil && b.config.syncOption == syncAlways)
+        case n < 18:
+            err := b.Delete(key)
+            model.delete(key, err, b.config.syncOption == syncAlways)
+        case n < 19 || !merges:
+            if b.Sync() == nil {
+                model.sync()
+            }
+        default:
+            b.Merge()
+        }
+    }
+
+}
+
+// reboot repairs the files a crash left, as an operator would before restarting,
+// and opens the datastore for writing again.
+func reboot(t *testing.T, disk *MemFS) *Bitcask {
+
+    t.Helper()
+
+    if _, err := Repair(testBitcaskPath, FileSystem(disk)); err != nil {
+        t.Fatalf("repair: %v", err)
+    }
+    b, err := Open(testBitcaskPath, ReadWrite, FileSystem(disk))
+    if err != nil {
+        t.Fatalf("open after crash: %v", err)
+    }
+
+    return b
+
+}
+
+func TestFaults(t *testing.T) {
+
+    t.Run("crash at every step of merge", func(t *testing.T) {
+
+        for n := 1; ; n++ {
+            rng := rand.New(rand.NewSource(int64(n)))
+            fs := newFaultFS()
+            model := newFaultModel()
+            b, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut, FileSystem(fs))
+            runFaultWorkload(rng, b, fs, model, 200, false)
+
+            fs.crashAfter(n)
+            b.Merge()
+            isDone := !fs.crashed()
+            b.Close()
+
+            b = reboot(t, fs.crash(rng))
+            model.check(t, b)
+            b.Close()
+            if t.Failed() {
+                t.Fatalf("crash at step %d of merge", n)
+            }
+            if isDone {
+                break
+            }
+        }
+
+    })
+
+    t.Run("crash at every step of sync", func(t *testing.T) {
+
+        for n := 1; ; n++ {
+            rng := rand.New(rand.NewSource(int64(n)))
+            fs := newFaultFS()
+            model := newFaultModel()
+            b, _ := Open(testBitcaskPath, ReadWrite, MaxPendingBytes(1 << 20), FileSystem(fs))
+            runFaultWorkload(rng, b, fs, model, 100, true)
+
+            fs.crashAfter(n)
+            if b.Sync() == nil {
+                model.sync()
+            }
+            isDone := !fs.crashed()
+            b.Close()
+
+            b = reboot(t, fs.crash(rng))
+            model.check(t, b)
+            b.Close()
+            if t.Failed() {
+                t.Fatalf("crash at step %d of sync", n)
+            }
+            if isDone {
+                break
+            }
+        }
+
+    })
+
+    t.Run("crash at random steps of a workload", func(t *testing.T) {
+
+        for seed := int64(1); seed <= 50; seed++ {
+            rng := rand.New(rand.NewSource(seed))
+            fs := newFaultFS()
+            model := newFaultModel()
+            b, _ := Open(testBitcaskPath, ReadWrite, SyncOnPut, FileSystem(fs))
+            fs.crashAfter(1 + rng.Intn(400))
+            runFaultWorkload(rng, b, fs, model, 300, true)
+            b.Close()
+
+            b = reboot(t, fs.crash(rng))
+            model.check(t, b)
+            b.Close()
+            if t.Failed() {
+                t.Fatalf("seed %d", seed)
+            }
+        }
+
+    })
+
+    t.Run("fail one write, sync, rename, remove or create", func(t *testing.T) {
+
+        for op := opWrite; op <= opCreate; op++ {
+            for at := 1; at <= 30; at++ {
+                rng := rand.New(rand.NewSource(int64(at)))
+                fs := newFaultFS()
+                fs.inject(fault{op: op, at: at, keep: -1})
+                model := newFaultModel()
+                b, err := Open(testBitcaskPath, ReadWrite, SyncOnPut, FileSystem(fs))
+                if err != nil {
+                    continue
+                }
+                runFaultWorkload(rng, b, fs, model, 150, true)
+                b.Close()
+
+                b = reboot(t, fs.crash(rng))
+                model.check(t, b)
+                b.Close()
+                if t.Failed() {
+                    t.Fatalf("failed %s %d", faultOpNames[op], at)
+                }
+            }
+        }
+
+    })
+
+    t.Run("torn writes", func(t *testing.T) {
+
+        for at := 1; at <= 30; at++ {
+            for _, keep := range []int{1, fileHeaderSize - 1, fileHeaderSize + 7, 150} {
+                rng := rand.New(rand.NewSource(int64(at)))
+                fs := newFaultFS()
+                fs.inject(fault{op: opWrite, at: at, keep: keep})
+                model := newFaultModel()
+                b, err := Open(testBitcaskPath, ReadWrite, SyncOnPut, FileSystem(fs))
+                if err != nil {
+                    continue
+                }
+                runFaultWorkload(rng, b, fs, model, 150, true)
+                b.Close()
+
+                b = reboot(t, fs.crash(rng))
+                model.check(t, b)
+                b.Close()
+                if t.Failed() {
+                    t.Fatalf("write %d torn after %d bytes", at, keep)
+                }
+            }
+        }
+
+    })
+
+}
@@ -0,0 +1,175 @@
+package bitcask
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+    fileMagic = "BITCASK"
+    formatVersion = 2
+    fileHeaderSize = len(fileMagic) + 2 * numberFieldSize + 1
+
+    valueKind int64 = 0
+    tompStoneKind int64 = 1
+)
+
+// writeFileHeader writes the header line every data, hint, keydir and checkpoint file starts with,
+// the magic, the format version and the creation time.
+func writeFileHeader(writer io.Writer) error {
+
+    header := fileMagic + padWithZero(formatVersion) + padWithZero(time.Now().UnixMicro()) + "\n"
+    _, err := io.WriteString(writer, header)
+
+    return err
+
+}
+
+// readFileHeader reads the header line of a file and returns its creation time.
+// It returns io.EOF for a file too short to hold a header, which only a crash leaves behind,
+// UnknownFormat for a file without the magic, OldVersion for a version Migrate converts
+// and UnsupportedVersion for any other version but formatVersion.
+func readFileHeader(reader io.Reader) (int64, error) {
+
+    version, createdAt, err := readFileVersion(reader)
+    if err != nil {
+        return 0, err
+    }
+    if version >= 1 && version < formatVersion {
+        return 0, BitcaskError(OldVersion)
+    }
+    if version != formatVersion {
+        return 0, BitcaskError(UnsupportedVersion)
+    }
+
+    return createdAt, nil
+
+}
+
+// readFileVersion reads the header line of a file, as readFileHeader, and returns its format version
+// and creation time whatever the version.
+func readFileVersion(reader io.Reader) (int64, int64, error) {
+
+    header := make([]byte, fileHeaderSize)
+    if _, err := io.ReadFull(reader, header); err == io.ErrUnexpectedEOF {
+        return 0, 0, io.EOF
+    } else if err != nil {
+        return 0, 0, err
+    }
+
+    if string(header[:len(fileMagic)]) != fileMagic || header[fileHeaderSize - 1] != '\n' {
+        return 0, 0, BitcaskError(UnknownFormat)
+    }
+    version, err := strconv.ParseInt(string(header[len(fileMagic):len(fileMagic) + numberFieldSize]), 10, 64)
+    if err != nil {
+        return 0, 0, BitcaskError(UnknownFormat)
+    }
+    createdAt, err := strconv.ParseInt(string(header[len(fileMagic) + numberFieldSize:fileHeaderSize - 1]), 10, 64)
+    if err != nil {
+        return 0, 0, BitcaskError(UnknownFormat)
+    }
+
+    return version, createdAt, nil
+
+}
+
+// createFileWithHeader creates, or truncates, the file at filePath and writes its header.
+func (bitcask *Bitcask) createFileWithHeader(filePath string) (File, error) {
+
+    file, err := bitcask.config.fs.Create(filePath)
+    if err != nil {
+        return nil, err
+    }
+    if err := writeFileHeader(file); err != nil {
+        file.Close()
+        return nil, err
+    }
+
+    return file, nil
+
+}
+
+// formatError names the file a header error was found in.
+func formatError(name string, err error) error {
+
+    return BitcaskError(fmt.Sprintf("%s: %s", name, err))
+
+}
+
+// compressFileLine builds a data file record: crc tstamp seq kind bucket keySize valueSize key value.
+// The crc covers everything after it, a tompstone has tompStoneKind and no value.
+func compressFileLine(bucket int64, key string, value string, tstamp int64, seq uint64, isTompStone bool) []byte {
+
+    kind := valueKind
+    if isTompStone {
+        kind = tompStoneKind
+    }
+
+    tstampStr := padWithZero(tstamp)
+    seqStr := padWithZero(int64(seq))
+    kindStr := padWithZero(kind)
+    bucketStr := padWithZero(bucket)
+    keySize := padWithZero(int64(len([]byte(key))))
+    valueSize := padWithZero(int64(len([]byte(value))))
+    body := tstampStr + seqStr + kindStr + bucketStr + keySize + valueSize + string(key) + value
+
+    return []byte(padWithZero(int64(crc32.ChecksumIEEE([]byte(body)))) + body)
+
+}
+
+// parseFields parses the count number fields a data, hint or keydir line starts with.
+// returns MalformedLine if the line is shorter than its fields or a field is not a number.
+func parseFields(line string, count int) ([]int64, error) {
+
+    if len(line) < count * numberFieldSize {
+        return nil, BitcaskError(MalformedLine)
+    }
+
+    fields := make([]int64, count)
+    for i := range fields {
+        field, err := strconv.ParseInt(line[i * numberFieldSize:(i + 1) * numberFieldSize], 10, 64)
+        if err != nil {
+            return nil, BitcaskError(MalformedLine)
+        }
+        fields[i] = field
+    }
+
+    return fields, nil
+
+}
+
+// extractFileLine returns the bucket, key, value, timestamp, sequence number and kind of a data file record.
+// returns MalformedLine if the sizes in its header do not match the line.
+func extractFileLine(line string) (int64, string, string, int64, uint64, bool, error) {
+
+    fields, err := parseFields(line, staticFields)
+    if err != nil {
+        return 0, "", "", 0, 0, false, err
+    }
+    tstamp, seq, kind, bucket, keySize, valueSize := fields[1], fields[2], fields[3], fields[4], fields[5], fields[6]
+    bodySize := int64(len(line) - staticFields * numberFieldSize)
+    if seq < 0 || (kind != valueKind && kind != tompStoneKind) || bucket < shardBucket ||
+        keySize < 0 || keySize > bodySize || valueSize != bodySize - keySize {
+        return 0, "", "", 0, 0, false, BitcaskError(MalformedLine)
+    }
+    key := line[staticFields * numberFieldSize:staticFields * numberFieldSize + keySize]
+    value := line[staticFields * numberFieldSize + keySize:]
+
+    return bucket, key, value, tstamp, uint64(seq), kind == tompStoneKind, nil
+
+}
+
+// checkFileLine reports whether the crc of a data file record matches its content.
+func checkFileLine(line string) bool {
+
+    if len(line) < numberFieldSize {
+        return false
+    }
+    crc, err := strconv.ParseUint(line[0:19], 10, 32)
+
+    return err == nil && uint32(crc) == crc32.ChecksumIEEE([]byte(line[19:]))
+
+}
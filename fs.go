@@ -0,0 +1,147 @@
+package bitcask
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FS is the file system a datastore is stored in, selected with the FileSystem option.
+// Names are slash separated paths as built by path.Join.
+type FS interface {
+    // Open opens a file for reading.
+    Open(name string) (File, error)
+    // Create creates a file for reading and writing, truncating it if it exists.
+    Create(name string) (File, error)
+    // Rename replaces newName by oldName, the rename is on stable storage once it returns.
+    Rename(oldName string, newName string) error
+    Remove(name string) error
+    // ReadDir lists a directory, returns an error wrapping os.ErrNotExist if it does not exist.
+    ReadDir(dirName string) ([]os.FileInfo, error)
+    MkdirAll(dirName string) error
+    Stat(name string) (os.FileInfo, error)
+    Truncate(name string, size int64) error
+}
+
+// File is a file opened from an FS.
+type File interface {
+    io.Reader
+    io.Writer
+    io.ReaderAt
+    io.WriterAt
+    io.Seeker
+    io.Closer
+    // Sync commits the content of the file to stable storage.
+    Sync() error
+}
+
+// OSFS is the FS of the operating system, the default.
+type OSFS struct{}
+
+type fileSystemOpt struct {
+    fs FS
+}
+
+// FileSystem makes a process store its datastore in fs instead of the operating system files,
+// a MemFS for one that lives in memory.
+func FileSystem(fs FS) ConfigOpt {
+
+    return fileSystemOpt{fs}
+
+}
+
+func (opt fileSystemOpt) apply(config *options) {
+
+    config.fs = opt.fs
+
+}
+
+// newOptions returns the options of a process that touches the files of a datastore
+// without opening it, only the FileSystem option is used.
+func newOptions(opts []ConfigOpt) options {
+
+    config := options{writePermission: ReadWrite, fs: OSFS{}}
+    for _, opt := range opts {
+        if fsOpt, isFS := opt.(fileSystemOpt); isFS {
+            fsOpt.apply(&config)
+        }
+    }
+
+    return config
+
+}
+
+func (OSFS) Open(name string) (File, error) {
+
+    file, err := os.Open(name)
+    if err != nil {
+        return nil, err
+    }
+
+    return file, nil
+
+}
+
+func (OSFS) Create(name string) (File, error) {
+
+    file, err := os.OpenFile(name, os.O_CREATE | os.O_TRUNC | os.O_RDWR, fileMode)
+    if err != nil {
+        return nil, err
+    }
+
+    return file, nil
+
+}
+
+// Rename renames oldName to newName and fsyncs the directory of newName, without which the rename
+// can be lost on a crash.
+func (OSFS) Rename(oldName string, newName string) error {
+
+    if err := os.Rename(oldName, newName); err != nil {
+        return err
+    }
+    dir, err := os.Open(filepath.Dir(newName))
+    if err != nil {
+        return err
+    }
+    defer dir.Close()
+
+    return dir.Sync()
+
+}
+
+func (OSFS) Remove(name string) error {
+
+    return os.Remove(name)
+
+}
+
+func (OSFS) ReadDir(dirName string) ([]os.FileInfo, error) {
+
+    dir, err := os.Open(dirName)
+    if err != nil {
+        return nil, err
+    }
+    defer dir.Close()
+
+    return dir.Readdir(0)
+
+}
+
+func (OSFS) MkdirAll(dirName string) error {
+
+    return os.MkdirAll(dirName, dirMode)
+
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+
+    return os.Stat(name)
+
+}
+
+func (OSFS) Truncate(name string, size int64) error {
+
+    return os.Truncate(name, size)
+
+}
@@ -0,0 +1,155 @@
+package bitcask
+
+import (
+	"bytes"
+	"path"
+	"strconv"
+	"testing"
+)
+
+// The seed corpus of every target is in testdata/fuzz, taken from the files of a real datastore.
+// Run a target with go test -fuzz=FuzzOpen, a crash it finds is added to the corpus.
+
+func FuzzReadFileHeader(f *testing.F) {
+
+    var header bytes.Buffer
+    writeFileHeader(&header)
+    f.Add(header.Bytes())
+
+    f.Fuzz(func(t *testing.T, data []byte) {
+
+        readFileHeader(bytes.NewReader(data))
+
+    })
+
+}
+
+func FuzzExtractFileLine(f *testing.F) {
+
+    f.Add(string(compressFileLine(defaultBucket, "key", "value", 1, 1, false)))
+    f.Add(string(compressFileLine(catalogBucket, "users", "2", 2, 2, false)))
+    f.Add(string(compressFileLine(2, "key", "", 3, 3, true)))
+
+    f.Fuzz(func(t *testing.T, line string) {
+
+        bucket, key, value, tstamp, seq, isTompStone, err := extractFileLine(line)
+        if err != nil {
+            return
+        }
+        line = string(compressFileLine(bucket, key, value, tstamp, seq, isTompStone))
+        bucket2, key2, value2, tstamp2, seq2, isTompStone2, err := extractFileLine(line)
+        if err != nil || bucket2 != bucket || key2 != key || value2 != value || tstamp2 != tstamp || seq2 != seq ||
+            isTompStone2 != isTompStone {
+            t.Errorf("%q does not decode to what it was built from", line)
+        }
+        if !checkFileLine(line) {
+            t.Errorf("%q fails its checksum", line)
+        }
+
+    })
+
+}
+
+func FuzzExtractHintFileLine(f *testing.F) {
+
+    f.Add(buildHintFileLine(record{valueSize: 5, valuePos: 180, tstamp: 1, seq: 1}, defaultBucket, "key"))
+    f.Add(buildHintFileLine(record{valueSize: tompStoneSize, valuePos: 180, tstamp: 2, seq: 2}, 2, "key"))
+
+    f.Fuzz(func(t *testing.T, line string) {
+
+        bucket, key, valueSize, valuePos, tstamp, seq, err := extractHintFileLine(line)
+        if err != nil {
+            return
+        }
+        line = buildHintFileLine(record{valueSize: valueSize, valuePos: valuePos, tstamp: tstamp, seq: seq}, bucket, key)
+        bucket2, key2, valueSize2, valuePos2, tstamp2, seq2, err := extractHintFileLine(line)
+        if err != nil || bucket2 != bucket || key2 != key || valueSize2 != valueSize || valuePos2 != valuePos ||
+            tstamp2 != tstamp || seq2 != seq {
+            t.Errorf("%q does not decode to what it was built from", line)
+        }
+
+    })
+
+}
+
+func FuzzExtractKeyDirFileLine(f *testing.F) {
+
+    f.Add(buildKeyDirFileLine(record{fileId: "1", valueSize: 5, valuePos: 180, tstamp: 1, seq: 1}, defaultBucket, "key"))
+    f.Add(buildKeyDirFileLine(record{fileId: "1", valueSize: 1, valuePos: 240, tstamp: 2, seq: 2}, catalogBucket, "users"))
+
+    f.Fuzz(func(t *testing.T, line string) {
+
+        bucket, key, fileId, valueSize, valuePos, tstamp, seq, err := extractKeyDirFileLine(line)
+        if err != nil {
+            return
+        }
+        line = buildKeyDirFileLine(record{fileId: fileId, valueSize: valueSize, valuePos: valuePos, tstamp: tstamp, seq: seq}, bucket, key)
+        bucket2, key2, fileId2, valueSize2, valuePos2, tstamp2, seq2, err := extractKeyDirFileLine(line)
+        if err != nil || bucket2 != bucket || key2 != key || fileId2 != fileId || valueSize2 != valueSize ||
+            valuePos2 != valuePos || tstamp2 != tstamp || seq2 != seq {
+            t.Errorf("%q does not decode to what it was built from", line)
+        }
+
+    })
+
+}
+
+func FuzzExtractLegacyFileLine(f *testing.F) {
+
+    f.Fuzz(func(t *testing.T, line string) {
+
+        _, key, value, err := extractLegacyFileLine(line)
+        if err == nil && legacyStaticFields * numberFieldSize + len(key) + len(value) != len(line) {
+            t.Errorf("%q decodes to key %q and value %q", line, key, value)
+        }
+
+    })
+
+}
+
+func FuzzExtractV1FileLine(f *testing.F) {
+
+    f.Fuzz(func(t *testing.T, line string) {
+
+        key, value, _, _, _, err := extractV1FileLine(line)
+        if err == nil && v1StaticFields * numberFieldSize + len(key) + len(value) != len(line) {
+            t.Errorf("%q decodes to key %q and value %q", line, key, value)
+        }
+
+    })
+
+}
+
+// FuzzOpen opens a datastore made of one data file, its hint file and a checkpoint, and reads every key.
+// Whatever the files hold, Open and Get return errors rather than panic.
+func FuzzOpen(f *testing.F) {
+
+    f.Add([]byte{}, []byte{}, []byte{})
+
+    f.Fuzz(func(t *testing.T, data []byte, hint []byte, checkpoint []byte) {
+
+        fs := NewMemFS()
+        fs.MkdirAll(testBitcaskPath)
+        for name, content := range map[string][]byte{"1": data, hintFilePrefix + "1": hint, checkpointFileName: checkpoint} {
+            file, _ := fs.Create(path.Join(testBitcaskPath, name))
+            file.Write(content)
+            file.Close()
+        }
+
+        if _, err := Verify(testBitcaskPath, FileSystem(fs)); err != nil {
+            return
+        }
+        b, err := Open(testBitcaskPath, ReadWrite, FileSystem(fs))
+        if err != nil {
+            return
+        }
+        for _, key := range b.ListKeys() {
+            b.Get(key)
+        }
+        b.Put("key", strconv.Itoa(len(data)))
+        b.Merge()
+        b.Close()
+
+    })
+
+}
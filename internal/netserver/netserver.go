@@ -0,0 +1,108 @@
+// Package netserver accepts and tracks the connections of the bitcask protocol
+// front ends, so each of them only implements the loop serving one connection.
+package netserver
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Server runs a handler for every connection accepted on its listeners.
+type Server struct {
+	handle func(conn net.Conn)
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[net.Conn]struct{}
+	closed     bool
+	handlers   sync.WaitGroup
+	totalConns int64
+}
+
+// New returns a server that runs handle in a goroutine of its own for every connection.
+// The connection is closed once handle returns.
+func New(handle func(conn net.Conn)) *Server {
+	return &Server{
+		handle:    handle,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on listener until the server is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	s.listeners[listener] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.handlers.Add(1)
+		s.mu.Unlock()
+		atomic.AddInt64(&s.totalConns, 1)
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners, closes every connection right away and waits for
+// their handlers to return. A command running on a connection is not interrupted,
+// but its reply is lost.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.handlers.Wait()
+}
+
+// Conns returns the number of open connections.
+func (s *Server) Conns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// TotalConns returns the number of connections accepted since the server started.
+func (s *Server) TotalConns() int64 {
+	return atomic.LoadInt64(&s.totalConns)
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.handlers.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	s.handle(conn)
+}
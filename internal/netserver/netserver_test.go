@@ -0,0 +1,65 @@
+package netserver
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	t.Run("close ends the connections and waits for their handlers", func(t *testing.T) {
+		handled := make(chan struct{})
+		s := New(func(conn net.Conn) {
+			io.Copy(io.Discard, conn)
+			close(handled)
+		})
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		served := make(chan error)
+		go func() {
+			served <- s.Serve(listener)
+		}()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		for s.Conns() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		if got := s.TotalConns(); got != 1 {
+			t.Errorf("got %d connections in total, want 1", got)
+		}
+
+		s.Close()
+		select {
+		case <-handled:
+		default:
+			t.Error("Close returned before the handler")
+		}
+		if err := <-served; err != nil {
+			t.Errorf("got error %q from Serve, want none", err)
+		}
+		if got := s.Conns(); got != 0 {
+			t.Errorf("got %d open connections, want none", got)
+		}
+	})
+
+	t.Run("serve after close", func(t *testing.T) {
+		s := New(func(conn net.Conn) {})
+		s.Close()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Serve(listener); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("got error %v, want %v", err, net.ErrClosed)
+		}
+	})
+}
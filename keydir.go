@@ -0,0 +1,439 @@
+package bitcask
+
+import "math"
+
+// keyDirectory maps every live key to the position of its last write.
+type keyDirectory interface {
+    get(key string) (record, bool)
+    put(key string, recValue record)
+    delete(key string)
+    len() int
+    forEach(fun func(key string, recValue record))
+}
+
+type mapKeyDir map[string]record
+
+// bucketKeyDir is the keydir of a datastore, one keyDirectory per bucket,
+// so the keys of a bucket are listed without going over the others and a bucket is dropped at once.
+type bucketKeyDir struct {
+    newPartition func() keyDirectory
+    partitions map[int64]keyDirectory
+}
+
+// compactKeyDir is the keyDirectory selected by CompactKeyDir.
+// Keys are packed in one arena and indexed by an open addressing hash table,
+// file ids are numbered, and positions and sizes are stored in 32 bits.
+// A key costs a 40 bytes entry and a 4 bytes hash slot on top of its own bytes,
+// against more than 100 bytes for a map entry.
+type compactKeyDir struct {
+    fileIds []string
+    fileIndexes map[string]uint32
+    entries []compactEntry
+    freeEntries []uint32
+    keys []byte
+    garbage int
+    slots []uint32
+    count int
+}
+
+// compactEntry is a record in a compactKeyDir, fileIndex 0 is kept for pending records.
+type compactEntry struct {
+    keyOffset uint64
+    tstamp int64
+    seq uint64
+    keySize uint32
+    fileIndex uint32
+    valuePos uint32
+    valueSize uint32
+}
+
+const (
+    compactMinSlots = 16
+    compactMinGarbage = 1 << 20
+)
+
+func (bitcask *Bitcask) newKeyDir() keyDirectory {
+
+    if bitcask.config.compactKeyDir {
+        return newCompactKeyDir()
+    }
+
+    return make(mapKeyDir)
+
+}
+
+func (bitcask *Bitcask) newBucketKeyDir() *bucketKeyDir {
+
+    return &bucketKeyDir{
+        newPartition: bitcask.newKeyDir,
+        partitions: make(map[int64]keyDirectory),
+    }
+
+}
+
+func (keyDir *bucketKeyDir) get(bucket int64, key string) (record, bool) {
+
+    partition, isExist := keyDir.partitions[bucket]
+    if !isExist {
+        return record{}, false
+    }
+
+    return partition.get(key)
+
+}
+
+func (keyDir *bucketKeyDir) put(bucket int64, key string, recValue record) {
+
+    partition, isExist := keyDir.partitions[bucket]
+    if !isExist {
+        partition = keyDir.newPartition()
+        keyDir.partitions[bucket] = partition
+    }
+
+    partition.put(key, recValue)
+
+}
+
+func (keyDir *bucketKeyDir) delete(bucket int64, key string) {
+
+    if partition, isExist := keyDir.partitions[bucket]; isExist {
+        partition.delete(key)
+    }
+
+}
+
+// len returns the number of keys of bucket.
+func (keyDir *bucketKeyDir) len(bucket int64) int {
+
+    if partition, isExist := keyDir.partitions[bucket]; isExist {
+        return partition.len()
+    }
+
+    return 0
+
+}
+
+// forEachIn calls fun with every key of bucket.
+func (keyDir *bucketKeyDir) forEachIn(bucket int64, fun func(key string, recValue record)) {
+
+    if partition, isExist := keyDir.partitions[bucket]; isExist {
+        partition.forEach(fun)
+    }
+
+}
+
+// forEach calls fun with every key of every bucket.
+func (keyDir *bucketKeyDir) forEach(fun func(bucket int64, key string, recValue record)) {
+
+    for bucket, partition := range keyDir.partitions {
+        partition.forEach(func(key string, recValue record) {
+            fun(bucket, key, recValue)
+        })
+    }
+
+}
+
+// drop removes the partition of bucket with all its keys.
+func (keyDir *bucketKeyDir) drop(bucket int64) {
+
+    delete(keyDir.partitions, bucket)
+
+}
+
+// releaseFileIds drops the file ids no key of a compact partition points to any more.
+func (keyDir *bucketKeyDir) releaseFileIds() {
+
+    for _, partition := range keyDir.partitions {
+        if compact, isCompact := partition.(*compactKeyDir); isCompact {
+            compact.releaseFileIds()
+        }
+    }
+
+}
+
+func (keyDir mapKeyDir) get(key string) (record, bool) {
+
+    recValue, isExist := keyDir[key]
+    return recValue, isExist
+
+}
+
+func (keyDir mapKeyDir) put(key string, recValue record) {
+
+    keyDir[key] = recValue
+
+}
+
+func (keyDir mapKeyDir) delete(key string) {
+
+    delete(keyDir, key)
+
+}
+
+func (keyDir mapKeyDir) len() int {
+
+    return len(keyDir)
+
+}
+
+func (keyDir mapKeyDir) forEach(fun func(key string, recValue record)) {
+
+    for key, recValue := range keyDir {
+        fun(key, recValue)
+    }
+
+}
+
+func newCompactKeyDir() *compactKeyDir {
+
+    return &compactKeyDir{
+        fileIds: []string{""},
+        fileIndexes: map[string]uint32{"": 0},
+        slots: make([]uint32, compactMinSlots),
+    }
+
+}
+
+func (keyDir *compactKeyDir) get(key string) (record, bool) {
+
+    slot, isExist := keyDir.find(key)
+    if !isExist {
+        return record{}, false
+    }
+
+    return keyDir.record(keyDir.entries[keyDir.slots[slot] - 1]), true
+
+}
+
+func (keyDir *compactKeyDir) put(key string, recValue record) {
+
+    if (keyDir.count + 1) * 4 > len(keyDir.slots) * 3 {
+        keyDir.resize(len(keyDir.slots) * 2)
+    }
+
+    slot, isExist := keyDir.find(key)
+    if isExist {
+        entry := &keyDir.entries[keyDir.slots[slot] - 1]
+        keyDir.setRecord(entry, recValue)
+        return
+    }
+
+    entry := compactEntry{keyOffset: uint64(len(keyDir.keys)), keySize: uint32(len(key))}
+    keyDir.keys = append(keyDir.keys, key...)
+    keyDir.setRecord(&entry, recValue)
+
+    var index uint32
+    if n := len(keyDir.freeEntries); n > 0 {
+        index = keyDir.freeEntries[n - 1]
+        keyDir.freeEntries = keyDir.freeEntries[:n - 1]
+        keyDir.entries[index] = entry
+    } else {
+        index = uint32(len(keyDir.entries))
+        keyDir.entries = append(keyDir.entries, entry)
+    }
+
+    keyDir.slots[slot] = index + 1
+    keyDir.count++
+
+}
+
+// delete removes key with backward shift deletion, so lookups never have to skip deleted slots.
+func (keyDir *compactKeyDir) delete(key string) {
+
+    slot, isExist := keyDir.find(key)
+    if !isExist {
+        return
+    }
+
+    index := keyDir.slots[slot] - 1
+    keyDir.garbage += int(keyDir.entries[index].keySize)
+    keyDir.entries[index] = compactEntry{}
+    keyDir.freeEntries = append(keyDir.freeEntries, index)
+    keyDir.count--
+
+    mask := len(keyDir.slots) - 1
+    next := slot
+    for {
+        next = (next + 1) & mask
+        if keyDir.slots[next] == 0 {
+            break
+        }
+        home := int(fnv1a(keyDir.key(keyDir.entries[keyDir.slots[next] - 1])) & uint64(mask))
+        if (next > slot && (home <= slot || home > next)) || (next < slot && home <= slot && home > next) {
+            keyDir.slots[slot] = keyDir.slots[next]
+            slot = next
+        }
+    }
+    keyDir.slots[slot] = 0
+
+    if keyDir.garbage > compactMinGarbage && keyDir.garbage > len(keyDir.keys) / 2 {
+        keyDir.compactKeys()
+    }
+
+}
+
+func (keyDir *compactKeyDir) len() int {
+
+    return keyDir.count
+
+}
+
+func (keyDir *compactKeyDir) forEach(fun func(key string, recValue record)) {
+
+    for _, slot := range keyDir.slots {
+        if slot != 0 {
+            entry := keyDir.entries[slot - 1]
+            fun(string(keyDir.key(entry)), keyDir.record(entry))
+        }
+    }
+
+}
+
+func (keyDir *compactKeyDir) find(key string) (int, bool) {
+
+    mask := len(keyDir.slots) - 1
+    slot := int(fnv1a(key) & uint64(mask))
+
+    for {
+        index := keyDir.slots[slot]
+        if index == 0 {
+            return slot, false
+        }
+        if string(keyDir.key(keyDir.entries[index - 1])) == key {
+            return slot, true
+        }
+        slot = (slot + 1) & mask
+    }
+
+}
+
+func (keyDir *compactKeyDir) resize(size int) {
+
+    mask := size - 1
+    slots := make([]uint32, size)
+
+    for _, index := range keyDir.slots {
+        if index == 0 {
+            continue
+        }
+        slot := int(fnv1a(keyDir.key(keyDir.entries[index - 1])) & uint64(mask))
+        for slots[slot] != 0 {
+            slot = (slot + 1) & mask
+        }
+        slots[slot] = index
+    }
+
+    keyDir.slots = slots
+
+}
+
+// compactKeys drops the bytes of deleted keys from the arena.
+func (keyDir *compactKeyDir) compactKeys() {
+
+    keys := make([]byte, 0, len(keyDir.keys) - keyDir.garbage)
+
+    for _, index := range keyDir.slots {
+        if index == 0 {
+            continue
+        }
+        entry := &keyDir.entries[index - 1]
+        offset := uint64(len(keys))
+        keys = append(keys, keyDir.key(*entry)...)
+        entry.keyOffset = offset
+    }
+
+    keyDir.keys = keys
+    keyDir.garbage = 0
+
+}
+
+// releaseFileIds renumbers the file ids still in use, so the ids of the files removed by a merge are dropped.
+func (keyDir *compactKeyDir) releaseFileIds() {
+
+    isUsed := make([]bool, len(keyDir.fileIds))
+    isUsed[0] = true
+    for _, index := range keyDir.slots {
+        if index != 0 {
+            isUsed[keyDir.entries[index - 1].fileIndex] = true
+        }
+    }
+
+    fileIds := []string{""}
+    fileIndexes := map[string]uint32{"": 0}
+    newIndexes := make([]uint32, len(keyDir.fileIds))
+    for i := 1; i < len(keyDir.fileIds); i++ {
+        if isUsed[i] {
+            newIndexes[i] = uint32(len(fileIds))
+            fileIndexes[keyDir.fileIds[i]] = uint32(len(fileIds))
+            fileIds = append(fileIds, keyDir.fileIds[i])
+        }
+    }
+    if len(fileIds) == len(keyDir.fileIds) {
+        return
+    }
+
+    for _, index := range keyDir.slots {
+        if index != 0 {
+            entry := &keyDir.entries[index - 1]
+            entry.fileIndex = newIndexes[entry.fileIndex]
+        }
+    }
+    keyDir.fileIds = fileIds
+    keyDir.fileIndexes = fileIndexes
+
+}
+
+func (keyDir *compactKeyDir) key(entry compactEntry) []byte {
+
+    return keyDir.keys[entry.keyOffset:entry.keyOffset + uint64(entry.keySize)]
+
+}
+
+func (keyDir *compactKeyDir) setRecord(entry *compactEntry, recValue record) {
+
+    fileIndex, isExist := keyDir.fileIndexes[recValue.fileId]
+    if !isExist {
+        fileIndex = uint32(len(keyDir.fileIds))
+        keyDir.fileIds = append(keyDir.fileIds, recValue.fileId)
+        keyDir.fileIndexes[recValue.fileId] = fileIndex
+    }
+
+    entry.tstamp = recValue.tstamp
+    entry.seq = recValue.seq
+    entry.fileIndex = fileIndex
+    entry.valuePos = uint32(recValue.valuePos)
+    entry.valueSize = uint32(recValue.valueSize)
+
+}
+
+func (keyDir *compactKeyDir) record(entry compactEntry) record {
+
+    return record{
+        fileId:    keyDir.fileIds[entry.fileIndex],
+        valueSize: int64(entry.valueSize),
+        valuePos:  int64(entry.valuePos),
+        tstamp:    entry.tstamp,
+        seq:       entry.seq,
+        isPending: entry.fileIndex == 0,
+    }
+
+}
+
+func fnv1a[K string | []byte](key K) uint64 {
+
+    var hash uint64 = 14695981039346656037
+    for i := 0; i < len(key); i++ {
+        hash ^= uint64(key[i])
+        hash *= 1099511628211
+    }
+
+    return hash
+
+}
+
+// fitsCompactKeyDir reports whether a value of size bytes can be indexed by a compactKeyDir.
+func fitsCompactKeyDir(size int) bool {
+
+    return int64(size) <= math.MaxUint32
+
+}
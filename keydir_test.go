@@ -0,0 +1,104 @@
+package bitcask
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestCompactKeyDir(t *testing.T) {
+
+    t.Run("matches a map keydir after random puts and deletes", func(t *testing.T) {
+
+        random := rand.New(rand.NewSource(1))
+        compact := newCompactKeyDir()
+        want := make(mapKeyDir)
+
+        for i := 0; i < 20000; i++ {
+            key := fmt.Sprintf("key%d", random.Intn(3000))
+            if random.Intn(3) == 0 {
+                compact.delete(key)
+                want.delete(key)
+                continue
+            }
+            recValue := record{
+                fileId:    fmt.Sprint(random.Intn(50) + 1),
+                valueSize: int64(random.Intn(1000)),
+                valuePos:  int64(random.Intn(1000)),
+                tstamp:    int64(i),
+                seq:       uint64(i),
+            }
+            compact.put(key, recValue)
+            want.put(key, recValue)
+        }
+        compact.compactKeys()
+
+        if compact.len() != want.len() {
+            t.Fatalf("got %d keys, want %d", compact.len(), want.len())
+        }
+        got := make(mapKeyDir)
+        compact.forEach(func(key string, recValue record) {
+            got.put(key, recValue)
+        })
+        if !reflect.DeepEqual(got, want) {
+            t.Error("compact keydir content differs from map keydir")
+        }
+        for key, wantRecValue := range want {
+            gotRecValue, isExist := compact.get(key)
+            if !isExist || gotRecValue != wantRecValue {
+                t.Fatalf("got %v for %q, want %v", gotRecValue, key, wantRecValue)
+            }
+        }
+
+    })
+
+    t.Run("file ids no key points to are released", func(t *testing.T) {
+
+        compact := newCompactKeyDir()
+        for i := 0; i < 100; i++ {
+            compact.put(fmt.Sprintf("key%d", i), record{fileId: fmt.Sprint(i % 10 + 1), seq: uint64(i)})
+        }
+        compact.put("pending", record{valueSize: 10, seq: 100, isPending: true})
+        // a merge moves the keys of the files 1 to 5 to the file 11.
+        for i := 0; i < 100; i++ {
+            if i % 10 < 5 {
+                compact.put(fmt.Sprintf("key%d", i), record{fileId: "11", seq: uint64(i)})
+            }
+        }
+        compact.releaseFileIds()
+
+        if len(compact.fileIds) != 7 || len(compact.fileIndexes) != 7 {
+            t.Errorf("got file ids %v, want the pending id, 6 to 10 and 11", compact.fileIds)
+        }
+        for i := 0; i < 100; i++ {
+            want := fmt.Sprint(i % 10 + 1)
+            if i % 10 < 5 {
+                want = "11"
+            }
+            got, _ := compact.get(fmt.Sprintf("key%d", i))
+            assertString(t, got.fileId, want)
+        }
+        if got, _ := compact.get("pending"); !got.isPending {
+            t.Errorf("got %v, want a pending record", got)
+        }
+        compact.put("key0", record{fileId: "12", seq: 200})
+        if got, _ := compact.get("key0"); got.fileId != "12" || len(compact.fileIds) != 8 {
+            t.Errorf("got %v, want a new file id numbered after the released ones", got)
+        }
+
+    })
+
+    t.Run("pending records keep their pending flag", func(t *testing.T) {
+
+        compact := newCompactKeyDir()
+        compact.put("key12", record{valueSize: 10, seq: 1, isPending: true})
+
+        got, _ := compact.get("key12")
+        if !got.isPending || got.fileId != "" {
+            t.Errorf("got %v, want a pending record", got)
+        }
+
+    })
+
+}
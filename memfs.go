@@ -0,0 +1,406 @@
+package bitcask
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemFS is an FS that keeps its files in memory, for tests and datastores that need no persistence.
+// Every process opened on the same MemFS sees the same files, as on a disk.
+// Sync does nothing, the content of a MemFS is lost with it.
+type MemFS struct {
+    mu sync.Mutex
+    dirs map[string]bool
+    files map[string]*memFileData
+}
+
+type memFileData struct {
+    data []byte
+    modTime time.Time
+}
+
+// memFile is an open file of a MemFS. A removed or renamed file stays readable through it.
+type memFile struct {
+    fs *MemFS
+    name string
+    file *memFileData
+    pos int64
+    isWritable bool
+    isClosed bool
+}
+
+type memFileInfo struct {
+    name string
+    size int64
+    modTime time.Time
+    isDir bool
+}
+
+// NewMemFS returns an empty MemFS, holding only its root directory.
+func NewMemFS() *MemFS {
+
+    return &MemFS{
+        dirs: map[string]bool{".": true, "/": true},
+        files: make(map[string]*memFileData),
+    }
+
+}
+
+func memPathError(op string, name string, err error) error {
+
+    return &os.PathError{Op: op, Path: name, Err: err}
+
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+
+    file, isExist := fs.files[path.Clean(name)]
+    if !isExist {
+        return nil, memPathError("open", name, os.ErrNotExist)
+    }
+
+    return &memFile{fs: fs, name: name, file: file}, nil
+
+}
+
+func (fs *MemFS) Create(name string) (File, error) {
+
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+
+    name = path.Clean(name)
+    if !fs.dirs[path.Dir(name)] {
+        return nil, memPathError("open", name, os.ErrNotExist)
+    }
+    if fs.dirs[name] {
+        return nil, memPathError("open", name, os.ErrExist)
+    }
+    file := &memFileData{modTime: time.Now()}
+    fs.files[name] = file
+
+    return &memFile{fs: fs, name: name, file: file, isWritable: true}, nil
+
+}
+
+func (fs *MemFS) Rename(oldName string, newName string) error {
+
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+
+    oldName, newName = path.Clean(oldName), path.Clean(newName)
+    file, isExist := fs.files[oldName]
+    if !isExist {
+        return memPathError("rename", oldName, os.ErrNotExist)
+    }
+    if !fs.dirs[path.Dir(newName)] {
+        return memPathError("rename", newName, os.ErrNotExist)
+    }
+    delete(fs.files, oldName)
+    fs.files[newName] = file
+
+    return nil
+
+}
+
+// Remove removes a file or an empty directory.
+func (fs *MemFS) Remove(name string) error {
+
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+
+    name = path.Clean(name)
+    if _, isExist := fs.files[name]; isExist {
+        delete(fs.files, name)
+        return nil
+    }
+    if !fs.dirs[name] {
+        return memPathError("remove", name, os.ErrNotExist)
+    }
+    for other := range fs.files {
+        if path.Dir(other) == name {
+            return memPathError("remove", name, os.ErrExist)
+        }
+    }
+    delete(fs.dirs, name)
+
+    return nil
+
+}
+
+func (fs *MemFS) ReadDir(dirName string) ([]os.FileInfo, error) {
+
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+
+    dirName = path.Clean(dirName)
+    if !fs.dirs[dirName] {
+        return nil, memPathError("open", dirName, os.ErrNotExist)
+    }
+
+    var infos []os.FileInfo
+    for name, file := range fs.files {
+        if path.Dir(name) == dirName {
+            infos = append(infos, memFileInfo{path.Base(name), int64(len(file.data)), file.modTime, false})
+        }
+    }
+    for name := range fs.dirs {
+        if name != dirName && path.Dir(name) == dirName {
+            infos = append(infos, memFileInfo{path.Base(name), 0, time.Time{}, true})
+        }
+    }
+    sort.Slice(infos, func(i, j int) bool {
+        return infos[i].Name() < infos[j].Name()
+    })
+
+    return infos, nil
+
+}
+
+func (fs *MemFS) MkdirAll(dirName string) error {
+
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+
+    for dirName = path.Clean(dirName); !fs.dirs[dirName]; dirName = path.Dir(dirName) {
+        if _, isExist := fs.files[dirName]; isExist {
+            return memPathError("mkdir", dirName, os.ErrExist)
+        }
+        fs.dirs[dirName] = true
+    }
+
+    return nil
+
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+
+    name = path.Clean(name)
+    if file, isExist := fs.files[name]; isExist {
+        return memFileInfo{path.Base(name), int64(len(file.data)), file.modTime, false}, nil
+    }
+    if fs.dirs[name] {
+        return memFileInfo{path.Base(name), 0, time.Time{}, true}, nil
+    }
+
+    return nil, memPathError("stat", name, os.ErrNotExist)
+
+}
+
+func (fs *MemFS) Truncate(name string, size int64) error {
+
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+
+    file, isExist := fs.files[path.Clean(name)]
+    if !isExist {
+        return memPathError("truncate", name, os.ErrNotExist)
+    }
+    file.resize(size)
+
+    return nil
+
+}
+
+// resize cuts data to size, or extends it with zeros.
+func (file *memFileData) resize(size int64) {
+
+    if size <= int64(len(file.data)) {
+        file.data = file.data[:size]
+    } else {
+        file.data = append(file.data, make([]byte, size - int64(len(file.data)))...)
+    }
+    file.modTime = time.Now()
+
+}
+
+func (file *memFile) check(op string, write bool) error {
+
+    if file.isClosed {
+        return memPathError(op, file.name, os.ErrClosed)
+    }
+    if write && !file.isWritable {
+        return memPathError(op, file.name, os.ErrPermission)
+    }
+
+    return nil
+
+}
+
+func (file *memFile) Read(buf []byte) (int, error) {
+
+    file.fs.mu.Lock()
+    defer file.fs.mu.Unlock()
+
+    if err := file.check("read", false); err != nil {
+        return 0, err
+    }
+    if file.pos >= int64(len(file.file.data)) {
+        return 0, io.EOF
+    }
+    n := copy(buf, file.file.data[file.pos:])
+    file.pos += int64(n)
+
+    return n, nil
+
+}
+
+func (file *memFile) ReadAt(buf []byte, offset int64) (int, error) {
+
+    file.fs.mu.Lock()
+    defer file.fs.mu.Unlock()
+
+    if err := file.check("read", false); err != nil {
+        return 0, err
+    }
+    if offset < 0 {
+        return 0, memPathError("read", file.name, os.ErrInvalid)
+    }
+    if offset >= int64(len(file.file.data)) {
+        return 0, io.EOF
+    }
+    n := copy(buf, file.file.data[offset:])
+    if n < len(buf) {
+        return n, io.EOF
+    }
+
+    return n, nil
+
+}
+
+func (file *memFile) Write(buf []byte) (int, error) {
+
+    file.fs.mu.Lock()
+    defer file.fs.mu.Unlock()
+
+    if err := file.check("write", true); err != nil {
+        return 0, err
+    }
+    file.writeAt(buf, file.pos)
+    file.pos += int64(len(buf))
+
+    return len(buf), nil
+
+}
+
+func (file *memFile) WriteAt(buf []byte, offset int64) (int, error) {
+
+    file.fs.mu.Lock()
+    defer file.fs.mu.Unlock()
+
+    if err := file.check("write", true); err != nil {
+        return 0, err
+    }
+    if offset < 0 {
+        return 0, memPathError("write", file.name, os.ErrInvalid)
+    }
+    file.writeAt(buf, offset)
+
+    return len(buf), nil
+
+}
+
+func (file *memFile) writeAt(buf []byte, offset int64) {
+
+    if end := offset + int64(len(buf)); end > int64(len(file.file.data)) {
+        file.file.resize(end)
+    }
+    copy(file.file.data[offset:], buf)
+    file.file.modTime = time.Now()
+
+}
+
+func (file *memFile) Seek(offset int64, whence int) (int64, error) {
+
+    file.fs.mu.Lock()
+    defer file.fs.mu.Unlock()
+
+    if err := file.check("seek", false); err != nil {
+        return 0, err
+    }
+    switch whence {
+    case io.SeekCurrent:
+        offset += file.pos
+    case io.SeekEnd:
+        offset += int64(len(file.file.data))
+    }
+    if offset < 0 {
+        return 0, memPathError("seek", file.name, os.ErrInvalid)
+    }
+    file.pos = offset
+
+    return offset, nil
+
+}
+
+func (file *memFile) Sync() error {
+
+    file.fs.mu.Lock()
+    defer file.fs.mu.Unlock()
+
+    return file.check("sync", false)
+
+}
+
+func (file *memFile) Close() error {
+
+    file.fs.mu.Lock()
+    defer file.fs.mu.Unlock()
+
+    if err := file.check("close", false); err != nil {
+        return err
+    }
+    file.isClosed = true
+
+    return nil
+
+}
+
+func (info memFileInfo) Name() string {
+
+    return info.name
+
+}
+
+func (info memFileInfo) Size() int64 {
+
+    return info.size
+
+}
+
+func (info memFileInfo) Mode() os.FileMode {
+
+    if info.isDir {
+        return os.ModeDir | dirMode
+    }
+
+    return fileMode
+
+}
+
+func (info memFileInfo) ModTime() time.Time {
+
+    return info.modTime
+
+}
+
+func (info memFileInfo) IsDir() bool {
+
+    return info.isDir
+
+}
+
+func (info memFileInfo) Sys() any {
+
+    return nil
+
+}
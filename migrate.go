@@ -0,0 +1,304 @@
+package bitcask
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+    legacyStaticFields = 3
+    v1StaticFields = 6
+
+    // legacyVersion is the version given to the data files written before format versions.
+    legacyVersion = 0
+)
+
+// legacyRecord places a record of a data file written before format versions.
+type legacyRecord struct {
+    tstamp int64
+    fileIndex int
+    lineIndex int
+}
+
+// Migrate converts a bitcask datastore written before file format versions, or in an older version, to the current format.
+// Every data file is rewritten under a file header with a checksum, a kind and a bucket per record.
+// Records written before format versions get sequence numbers in timestamp order, the order they used to be
+// resolved by, records of version 1 keep their sequence numbers and tompstones. All of them go to the default bucket.
+// Hint, keydir and checkpoint files are dropped and hint files are rebuilt from the data files.
+// Files already in the current format are kept, so an interrupted Migrate can be run again.
+// It takes the FileSystem option.
+// returns an error if another process has the datastore open.
+func Migrate(dirPath string, opts ...ConfigOpt) error {
+
+    bitcask := Bitcask{
+        directoryPath: dirPath,
+        config: newOptions(opts),
+    }
+
+    files, err := bitcask.config.fs.ReadDir(dirPath)
+    if err != nil {
+        return BitcaskError(fmt.Sprintf("%s: %s", dirPath, CannotOpenThisDir))
+    }
+
+    if bitcask.lockCheck() != noProcess {
+        return BitcaskError(DatastoreInUse)
+    }
+
+    var fileNames []string
+    for _, file := range files {
+        name := file.Name()
+        if _, err := strconv.ParseInt(name, 10, 64); err == nil {
+            fileNames = append(fileNames, name)
+        }
+    }
+    sort.Slice(fileNames, func(i, j int) bool {
+        first, _ := strconv.ParseInt(fileNames[i], 10, 64)
+        second, _ := strconv.ParseInt(fileNames[j], 10, 64)
+        return first < second
+    })
+
+    // the records of every file are ranked, even in files an interrupted run already
+    // converted, so a second run gives the same sequence numbers as the first.
+    var records []legacyRecord
+    versions := make([]int64, len(fileNames))
+    lineCounts := make([]int, len(fileNames))
+    for fileIndex, name := range fileNames {
+        tstamps, version, err := bitcask.readTimestamps(name)
+        if err != nil {
+            return err
+        }
+        versions[fileIndex] = version
+        lineCounts[fileIndex] = len(tstamps)
+        for lineIndex, tstamp := range tstamps {
+            records = append(records, legacyRecord{tstamp, fileIndex, lineIndex})
+        }
+    }
+    sort.SliceStable(records, func(i, j int) bool {
+        return records[i].tstamp < records[j].tstamp
+    })
+
+    seqs := make([][]uint64, len(fileNames))
+    for fileIndex := range fileNames {
+        seqs[fileIndex] = make([]uint64, lineCounts[fileIndex])
+    }
+    for rank, rec := range records {
+        seqs[rec.fileIndex][rec.lineIndex] = uint64(rank + 1)
+    }
+
+    for _, file := range files {
+        name := file.Name()
+        if strings.HasPrefix(name, hintFilePrefix) || strings.HasPrefix(name, keyDirFilePrefix) ||
+        strings.HasPrefix(name, ".") || name == checkpointFileName {
+            if err := bitcask.config.fs.Remove(path.Join(dirPath, name)); err != nil {
+                return err
+            }
+        }
+    }
+
+    for fileIndex, name := range fileNames {
+        if versions[fileIndex] == formatVersion {
+            continue
+        }
+        hints, err := bitcask.migrateDataFile(name, versions[fileIndex], seqs[fileIndex])
+        if err != nil {
+            return err
+        }
+        if err := bitcask.writeHintFile(name, hints); err != nil {
+            return err
+        }
+    }
+
+    return nil
+
+}
+
+// readTimestamps returns the timestamps of the records of a data file in file order,
+// and the format version of the file, legacyVersion for a file written before file format versions.
+func (bitcask *Bitcask) readTimestamps(name string) ([]int64, int64, error) {
+
+    var tstamps []int64
+
+    dataFile, err := bitcask.config.fs.Open(path.Join(bitcask.directoryPath, name))
+    if err != nil {
+        return nil, 0, err
+    }
+    defer dataFile.Close()
+    dataReader := bufio.NewReader(dataFile)
+
+    version, _, err := readFileVersion(dataReader)
+    if err == io.EOF {
+        return nil, formatVersion, nil
+    } else if err == BitcaskError(UnknownFormat) {
+        version = legacyVersion
+        if _, err := dataFile.Seek(0, io.SeekStart); err != nil {
+            return nil, 0, err
+        }
+        dataReader.Reset(dataFile)
+    } else if err != nil {
+        return nil, 0, formatError(name, err)
+    } else if version < 1 || version > formatVersion {
+        return nil, 0, formatError(name, BitcaskError(UnsupportedVersion))
+    }
+
+    for {
+        _, _, tstamp, _, _, err := readVersionedFileLine(dataReader, version)
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, 0, formatError(name, BitcaskError(MalformedLine))
+        }
+        tstamps = append(tstamps, tstamp)
+    }
+
+    return tstamps, version, nil
+
+}
+
+// readVersionedFileLine reads the next record of a data file in format version and returns
+// its key, value, timestamp, sequence number and kind, or io.EOF after the last record.
+// Records written before format versions have no sequence number and are never tompstones.
+// A torn or corrupted record of version 1 ends the file, as it did for Open.
+func readVersionedFileLine(dataReader *bufio.Reader, version int64) (string, string, int64, uint64, bool, error) {
+
+    switch version {
+    case legacyVersion:
+        line, err := readSizedLine(dataReader, legacyStaticFields * numberFieldSize, 1, 2)
+        if err != nil {
+            return "", "", 0, 0, false, err
+        }
+        tstamp, key, value, err := extractLegacyFileLine(line)
+        return key, value, tstamp, 0, false, err
+    case 1:
+        line, err := readSizedLine(dataReader, v1StaticFields * numberFieldSize, 4, 5)
+        if err != nil || !checkFileLine(line) {
+            return "", "", 0, 0, false, io.EOF
+        }
+        key, value, tstamp, seq, isTompStone, err := extractV1FileLine(line)
+        if err != nil {
+            return "", "", 0, 0, false, io.EOF
+        }
+        return key, value, tstamp, seq, isTompStone, nil
+    default:
+        line, err := readSizedLine(dataReader, staticFields * numberFieldSize, 5, 6)
+        if err != nil {
+            return "", "", 0, 0, false, err
+        }
+        _, key, value, tstamp, seq, isTompStone, err := extractFileLine(line)
+        return key, value, tstamp, seq, isTompStone, err
+    }
+
+}
+
+// migrateDataFile rewrites a data file in an older format version in the current format, its records in the
+// default bucket, and returns the hints of the new file. Records written before format versions get the
+// sequence numbers seqs. The new file is written under a hidden name and renamed over the old one once synced.
+func (bitcask *Bitcask) migrateDataFile(name string, version int64, seqs []uint64) (map[bucketKey]record, error) {
+
+    hints := make(map[bucketKey]record)
+    var currentPos int64 = int64(fileHeaderSize)
+
+    dataFile, err := bitcask.config.fs.Open(path.Join(bitcask.directoryPath, name))
+    if err != nil {
+        return nil, err
+    }
+    defer dataFile.Close()
+    dataReader := bufio.NewReader(dataFile)
+    if version != legacyVersion {
+        if _, _, err := readFileVersion(dataReader); err != nil {
+            return nil, formatError(name, err)
+        }
+    }
+
+    tmpPath := path.Join(bitcask.directoryPath, "." + name)
+    migratedFile, err := bitcask.createFileWithHeader(tmpPath)
+    if err != nil {
+        return nil, err
+    }
+    migratedWriter := bufio.NewWriter(migratedFile)
+
+    for _, legacySeq := range seqs {
+        key, value, tstamp, seq, isTompStone, err := readVersionedFileLine(dataReader, version)
+        if err != nil {
+            migratedFile.Close()
+            bitcask.config.fs.Remove(tmpPath)
+            return nil, formatError(name, BitcaskError(MalformedLine))
+        }
+        if version == legacyVersion {
+            seq = legacySeq
+        }
+
+        n, _ := fmt.Fprintln(migratedWriter, string(compressFileLine(defaultBucket, key, value, tstamp, seq, isTompStone)))
+        hintKey := bucketKey{defaultBucket, key}
+        if current, isExist := hints[hintKey]; !isExist || current.seq < seq {
+            hints[hintKey] = hintRecord(record{
+                fileId:    name,
+                valueSize: int64(len(value)),
+                valuePos:  currentPos + staticFields * numberFieldSize + int64(len(key)),
+                tstamp:    tstamp,
+                seq:       seq,
+                isPending: false,
+            }, isTompStone)
+        }
+        currentPos += int64(n)
+    }
+
+    err = migratedWriter.Flush()
+    if err == nil {
+        err = syncAndClose(migratedFile)
+    } else {
+        migratedFile.Close()
+    }
+    if err != nil {
+        bitcask.config.fs.Remove(tmpPath)
+        return nil, err
+    }
+
+    return hints, bitcask.config.fs.Rename(tmpPath, path.Join(bitcask.directoryPath, name))
+
+}
+
+// extractLegacyFileLine reads a record written before file format versions: tstamp keySize valueSize key value.
+// returns MalformedLine if the sizes in its header do not match the line.
+func extractLegacyFileLine(line string) (int64, string, string, error) {
+
+    fields, err := parseFields(line, legacyStaticFields)
+    if err != nil {
+        return 0, "", "", err
+    }
+    tstamp, keySize, valueSize := fields[0], fields[1], fields[2]
+    bodySize := int64(len(line) - legacyStaticFields * numberFieldSize)
+    if keySize < 0 || keySize > bodySize || valueSize != bodySize - keySize {
+        return 0, "", "", BitcaskError(MalformedLine)
+    }
+    key := line[legacyStaticFields * numberFieldSize:legacyStaticFields * numberFieldSize + keySize]
+    value := line[legacyStaticFields * numberFieldSize + keySize:]
+
+    return tstamp, key, value, nil
+
+}
+
+// extractV1FileLine reads a data file record of format version 1: crc tstamp seq kind keySize valueSize key value.
+// returns MalformedLine if the sizes in its header do not match the line.
+func extractV1FileLine(line string) (string, string, int64, uint64, bool, error) {
+
+    fields, err := parseFields(line, v1StaticFields)
+    if err != nil {
+        return "", "", 0, 0, false, err
+    }
+    tstamp, seq, kind, keySize, valueSize := fields[1], fields[2], fields[3], fields[4], fields[5]
+    bodySize := int64(len(line) - v1StaticFields * numberFieldSize)
+    if seq < 0 || (kind != valueKind && kind != tompStoneKind) ||
+        keySize < 0 || keySize > bodySize || valueSize != bodySize - keySize {
+        return "", "", 0, 0, false, BitcaskError(MalformedLine)
+    }
+    key := line[v1StaticFields * numberFieldSize:v1StaticFields * numberFieldSize + keySize]
+    value := line[v1StaticFields * numberFieldSize + keySize:]
+
+    return key, value, tstamp, uint64(seq), kind == tompStoneKind, nil
+
+}
@@ -0,0 +1,292 @@
+package bitcask
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var modelSeed = flag.Int64("model.seed", 0, "run the model test with this seed only")
+var modelRuns = flag.Int("model.runs", 200, "number of random sequences the model test runs per configuration")
+
+type modelOpKind int
+
+const (
+    modelPut modelOpKind = iota
+    modelDelete
+    modelGet
+    modelSync
+    modelMerge
+    modelReopen
+)
+
+// modelOp is one step of a sequence run against both a datastore and its model.
+type modelOp struct {
+    kind modelOpKind
+    key string
+    value string
+}
+
+func (op modelOp) String() string {
+
+    switch op.kind {
+    case modelPut:
+        return fmt.Sprintf("Put(%q, %q)", op.key, op.value)
+    case modelDelete:
+        return fmt.Sprintf("Delete(%q)", op.key)
+    case modelGet:
+        return fmt.Sprintf("Get(%q)", op.key)
+    case modelSync:
+        return "Sync()"
+    case modelMerge:
+        return "Merge()"
+    }
+
+    return "Close() and Open()"
+
+}
+
+// genModelOps returns n random operations on a few keys, so that keys are often overwritten and deleted.
+// Values are long enough for a sequence to fill several data files.
+func genModelOps(rng *rand.Rand, n int) []modelOp {
+
+    ops := make([]modelOp, n)
+    for i := range ops {
+        key := fmt.Sprintf("key%d", rng.Intn(12))
+        switch n := rng.Intn(100); {
+        case n < 45:
+            value := fmt.Sprintf("value%d-%s", i, strings.Repeat("x", rng.Intn(60)))
+            ops[i] = modelOp{kind: modelPut, key: key, value: value}
+        case n < 65:
+            ops[i] = modelOp{kind: modelDelete, key: key}
+        case n < 85:
+            ops[i] = modelOp{kind: modelGet, key: key}
+        case n < 90:
+            ops[i] = modelOp{kind: modelSync}
+        case n < 95:
+            ops[i] = modelOp{kind: modelMerge}
+        default:
+            ops[i] = modelOp{kind: modelReopen}
+        }
+    }
+
+    return ops
+
+}
+
+// runModel runs ops against a new datastore and a map.
+// returns the index of the first operation whose result differs from the map, and how, or -1.
+func runModel(ops []modelOp, opts []ConfigOpt) (int, string) {
+
+    fs := NewMemFS()
+    opts = append([]ConfigOpt{ReadWrite, FileSystem(fs)}, opts...)
+    b, err := Open(testBitcaskPath, opts...)
+    if err != nil {
+        return 0, fmt.Sprintf("open: %v", err)
+    }
+    defer func() {
+        b.Close()
+    }()
+    model := make(map[string]string)
+
+    for i, op := range ops {
+        switch op.kind {
+        case modelPut:
+            if err := b.Put(op.key, op.value); err != nil {
+                return i, fmt.Sprintf("unexpected error %v", err)
+            }
+            model[op.key] = op.value
+        case modelDelete:
+            err := b.Delete(op.key)
+            if _, isExist := model[op.key]; isExist && err != nil {
+                return i, fmt.Sprintf("unexpected error %v", err)
+            } else if !isExist && err == nil {
+                return i, "deleted a key that does not exist"
+            }
+            delete(model, op.key)
+        case modelGet:
+            if problem := checkModelKey(b, model, op.key); problem != "" {
+                return i, problem
+            }
+        case modelSync:
+            if err := b.Sync(); err != nil {
+                return i, fmt.Sprintf("unexpected error %v", err)
+            }
+        case modelMerge:
+            if err := b.Merge(); err != nil {
+                return i, fmt.Sprintf("unexpected error %v", err)
+            }
+        case modelReopen:
+            b.Close()
+            if b, err = Open(testBitcaskPath, opts...); err != nil {
+                return i, fmt.Sprintf("reopen: %v", err)
+            }
+            if problem := checkModel(b, model); problem != "" {
+                return i, problem
+            }
+        }
+    }
+    if problem := checkModel(b, model); problem != "" {
+        return len(ops), problem
+    }
+
+    return -1, ""
+
+}
+
+func checkModelKey(b *Bitcask, model map[string]string, key string) string {
+
+    value, err := b.Get(key)
+    expected, isExist := model[key]
+    switch {
+    case isExist && err != nil:
+        return fmt.Sprintf("%q: expected %q, got error %v", key, expected, err)
+    case !isExist && err == nil:
+        return fmt.Sprintf("%q: expected no value, got %q", key, value)
+    case value != expected:
+        return fmt.Sprintf("%q: expected %q, got %q", key, expected, value)
+    }
+
+    return ""
+
+}
+
+// checkModel compares every key of a datastore and of its model.
+func checkModel(b *Bitcask, model map[string]string) string {
+
+    keys := b.ListKeys()
+    for key := range model {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for i, key := range keys {
+        if i > 0 && keys[i - 1] == key {
+            continue
+        }
+        if problem := checkModelKey(b, model, key); problem != "" {
+            return problem
+        }
+    }
+
+    return ""
+
+}
+
+// shrinkModelOps removes operations from a failing sequence, in chunks that halve down to single operations,
+// for as long as the shorter sequence still fails. run returns the index of the failing operation, or -1.
+func shrinkModelOps(ops []modelOp, run func([]modelOp) int) []modelOp {
+
+    if at := run(ops); at >= 0 && at < len(ops) {
+        ops = ops[:at + 1]
+    }
+
+    for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+        for start := 0; start + chunk <= len(ops); {
+            candidate := append(append([]modelOp{}, ops[:start]...), ops[start + chunk:]...)
+            if at := run(candidate); at >= 0 {
+                if at < len(candidate) {
+                    candidate = candidate[:at + 1]
+                }
+                ops = candidate
+            } else {
+                start += chunk
+            }
+        }
+    }
+
+    return ops
+
+}
+
+func TestModel(t *testing.T) {
+
+    configs := []struct {
+        name string
+        opts []ConfigOpt
+    }{
+        {"sync on demand", []ConfigOpt{SyncOnDemand}},
+        {"sync on put", []ConfigOpt{SyncOnPut}},
+        {"compact keydir", []ConfigOpt{CompactKeyDir}},
+    }
+
+    for _, config := range configs {
+        t.Run(config.name, func(t *testing.T) {
+
+            seeds := make([]int64, 0, *modelRuns)
+            if *modelSeed != 0 {
+                seeds = append(seeds, *modelSeed)
+            } else {
+                for seed := int64(1); seed <= int64(*modelRuns); seed++ {
+                    seeds = append(seeds, seed)
+                }
+            }
+            if testing.Short() && len(seeds) > 20 {
+                seeds = seeds[:20]
+            }
+
+            for _, seed := range seeds {
+                ops := genModelOps(rand.New(rand.NewSource(seed)), 150)
+                if at, _ := runModel(ops, config.opts); at < 0 {
+                    continue
+                }
+
+                ops = shrinkModelOps(ops, func(ops []modelOp) int {
+                    at, _ := runModel(ops, config.opts)
+                    return at
+                })
+                _, problem := runModel(ops, config.opts)
+                var steps strings.Builder
+                for _, op := range ops {
+                    fmt.Fprintf(&steps, "\n    %v", op)
+                }
+                t.Fatalf("seed %d (rerun with -model.seed=%d), %d operations: %s%s",
+                    seed, seed, len(ops), problem, steps.String())
+            }
+
+        })
+    }
+
+}
+
+func TestShrinkModelOps(t *testing.T) {
+
+    t.Run("shrinks to the operations that fail", func(t *testing.T) {
+
+        // a Get of the value "bad" fails, the shrunk sequence is the Put and the Get of it only.
+        ops := []modelOp{
+            {kind: modelPut, key: "key0", value: "value0"},
+            {kind: modelSync},
+            {kind: modelPut, key: "key1", value: "value1"},
+            {kind: modelDelete, key: "key0"},
+            {kind: modelMerge},
+            {kind: modelPut, key: "key1", value: "bad"},
+            {kind: modelPut, key: "key2", value: "value2"},
+            {kind: modelReopen},
+            {kind: modelGet, key: "key1"},
+            {kind: modelPut, key: "key3", value: "value3"},
+        }
+
+        ops = shrinkModelOps(ops, func(ops []modelOp) int {
+            values := make(map[string]string)
+            for i, op := range ops {
+                switch {
+                case op.kind == modelPut:
+                    values[op.key] = op.value
+                case op.kind == modelGet && values[op.key] == "bad":
+                    return i
+                }
+            }
+            return -1
+        })
+        var got []string
+        for _, op := range ops {
+            got = append(got, op.String())
+        }
+        assertString(t, strings.Join(got, "; "), `Put("key1", "bad"); Get("key1")`)
+
+    })
+
+}
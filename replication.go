@@ -0,0 +1,558 @@
+package bitcask
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+    replicationFileName = "replication"
+    replicationBatch = 256
+    replicationPoll = 10 * time.Millisecond
+
+    changesMessage messageKind = 0
+    snapshotMessage messageKind = 1
+    snapshotEndMessage messageKind = 2
+)
+
+type messageKind int
+
+// replicationMessage is sent by a primary to its replicas. A snapshot message carries the last sequence
+// number of the primary when the snapshot started, the changes and snapshot end messages the position
+// the replica acknowledges once it applied them.
+type replicationMessage struct {
+    Kind messageKind
+    Changes []Change
+    Position Position
+    Seq uint64
+}
+
+// Primary streams the records of the data files of a datastore to the replicas connected to it.
+type Primary struct {
+    bitcask *Bitcask
+    listener net.Listener
+    mu sync.Mutex
+    replicas map[net.Conn]ReplicaStatus
+    done chan struct{}
+    connections sync.WaitGroup
+}
+
+// ReplicaStatus is a replica connected to a primary and the last position it acknowledged.
+type ReplicaStatus struct {
+    Address string `json:"address"`
+    Position Position `json:"position"`
+}
+
+// Replica applies the records a primary streams to it to its own datastore.
+type Replica struct {
+    bitcask *Bitcask
+    conn net.Conn
+    mu sync.Mutex
+    position Position
+    err error
+    isClosed bool
+    done chan struct{}
+}
+
+// ServeReplicas accepts replicas on listener until the returned Primary is closed.
+// Every replica is sent the records written from the position it acknowledged last,
+// sealed and active data files alike, as a Tailer reads them. A replica without a position,
+// or whose position was compacted by a Merge, is sent a snapshot of every data file first.
+func (bitcask *Bitcask) ServeReplicas(listener net.Listener) *Primary {
+
+    primary := &Primary{
+        bitcask: bitcask,
+        listener: listener,
+        replicas: make(map[net.Conn]ReplicaStatus),
+        done: make(chan struct{}),
+    }
+
+    primary.connections.Add(1)
+    go func() {
+        defer primary.connections.Done()
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            primary.connections.Add(1)
+            go func() {
+                defer primary.connections.Done()
+                primary.serve(conn)
+            }()
+        }
+    }()
+
+    return primary
+
+}
+
+// Replicas returns the replicas connected to the primary.
+func (primary *Primary) Replicas() []ReplicaStatus {
+
+    primary.mu.Lock()
+    defer primary.mu.Unlock()
+
+    var replicas []ReplicaStatus
+    for _, status := range primary.replicas {
+        replicas = append(replicas, status)
+    }
+
+    return replicas
+
+}
+
+// Close stops accepting replicas and disconnects the connected ones.
+func (primary *Primary) Close() error {
+
+    err := primary.listener.Close()
+    close(primary.done)
+    primary.mu.Lock()
+    for conn := range primary.replicas {
+        conn.Close()
+    }
+    primary.mu.Unlock()
+    primary.connections.Wait()
+
+    return err
+
+}
+
+// serve streams records to a replica until it disconnects or the primary is closed.
+func (primary *Primary) serve(conn net.Conn) {
+
+    defer conn.Close()
+    encoder := gob.NewEncoder(conn)
+    decoder := gob.NewDecoder(conn)
+
+    var from Position
+    if err := decoder.Decode(&from); err != nil {
+        return
+    }
+    primary.mu.Lock()
+    select {
+    case <-primary.done:
+        primary.mu.Unlock()
+        return
+    default:
+    }
+    primary.replicas[conn] = ReplicaStatus{conn.RemoteAddr().String(), from}
+    primary.mu.Unlock()
+    defer func() {
+        primary.mu.Lock()
+        delete(primary.replicas, conn)
+        primary.mu.Unlock()
+    }()
+
+    go func() {
+        for {
+            var acked Position
+            if err := decoder.Decode(&acked); err != nil {
+                conn.Close()
+                return
+            }
+            primary.mu.Lock()
+            if _, isExist := primary.replicas[conn]; isExist {
+                primary.replicas[conn] = ReplicaStatus{conn.RemoteAddr().String(), acked}
+            }
+            primary.mu.Unlock()
+        }
+    }()
+
+    var tailer *Tailer
+    var err error
+    if from.FileId != "" {
+        tailer, err = Tail(primary.bitcask.directoryPath, from, FileSystem(primary.bitcask.config.fs))
+    }
+    isSnapshot := from.FileId == "" || err != nil && strings.HasSuffix(err.Error(), PositionCompacted)
+    if err != nil && !isSnapshot {
+        return
+    }
+    defer func() {
+        if tailer != nil {
+            tailer.Close()
+        }
+    }()
+
+    // a snapshot ends once the tailer started for it has caught up.
+    isSnapshotRead := true
+    for {
+        if isSnapshot {
+            if tailer, err = primary.startSnapshot(encoder, tailer); err != nil {
+                return
+            }
+            isSnapshot, isSnapshotRead = false, false
+        }
+
+        var changes []Change
+        var nextErr error
+        for len(changes) < replicationBatch {
+            var change Change
+            if change, nextErr = tailer.Next(); nextErr != nil {
+                break
+            }
+            changes = append(changes, change)
+        }
+        if nextErr != nil && nextErr != io.EOF {
+            if !strings.HasSuffix(nextErr.Error(), PositionCompacted) {
+                return
+            }
+            // the replica fell behind a Merge, a new snapshot replaces the changes read.
+            isSnapshot = true
+            continue
+        }
+
+        if len(changes) > 0 {
+            if encoder.Encode(replicationMessage{Kind: changesMessage, Changes: changes, Position: tailer.Position()}) != nil {
+                return
+            }
+        }
+        if nextErr == nil {
+            continue
+        }
+
+        if !isSnapshotRead {
+            if encoder.Encode(replicationMessage{Kind: snapshotEndMessage, Position: tailer.Position()}) != nil {
+                return
+            }
+            isSnapshotRead = true
+        }
+        select {
+        case <-primary.done:
+            return
+        case <-time.After(replicationPoll):
+        }
+    }
+
+}
+
+// startSnapshot tells the replica a snapshot starts and returns a Tailer reading every data file.
+// The pending writes are written out first, so the records before the last sequence number
+// sent with the snapshot are all in the files the Tailer reads.
+func (primary *Primary) startSnapshot(encoder *gob.Encoder, tailer *Tailer) (*Tailer, error) {
+
+    if tailer != nil {
+        tailer.Close()
+    }
+
+    primary.bitcask.mu.RLock()
+    seq := primary.bitcask.lastSeq
+    primary.bitcask.mu.RUnlock()
+    if primary.bitcask.config.writePermission == ReadWrite {
+        if err := primary.bitcask.Sync(); err != nil {
+            return nil, err
+        }
+    }
+
+    if err := encoder.Encode(replicationMessage{Kind: snapshotMessage, Seq: seq}); err != nil {
+        return nil, err
+    }
+
+    return Tail(primary.bitcask.directoryPath, Position{}, FileSystem(primary.bitcask.config.fs))
+
+}
+
+// Replicate connects to the primary at address and applies the records it streams to the datastore,
+// with their sequence numbers, until the returned Replica is closed. Applied records are fsynced
+// before their position is saved in the datastore and acknowledged, the next Replicate resumes from it.
+// A snapshot replaces the keys of the datastore by those of the primary, the keys the primary removed
+// are deleted once it is complete. The datastore must not be written to while it replicates.
+// returns an error if ReadWrite permission is not set or the primary cannot be reached.
+func (bitcask *Bitcask) Replicate(address string) (*Replica, error) {
+
+    if bitcask.config.writePermission == ReadOnly {
+        return nil, BitcaskError(WriteDenied)
+    }
+
+    position, err := bitcask.readReplicationPosition()
+    if err != nil {
+        return nil, err
+    }
+    conn, err := net.Dial("tcp", address)
+    if err != nil {
+        return nil, err
+    }
+    encoder := gob.NewEncoder(conn)
+    if err := encoder.Encode(position); err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    replica := &Replica{
+        bitcask: bitcask,
+        conn: conn,
+        position: position,
+        done: make(chan struct{}),
+    }
+    go replica.run(encoder, gob.NewDecoder(conn))
+
+    return replica, nil
+
+}
+
+// Position returns the last position the replica applied and acknowledged.
+func (replica *Replica) Position() Position {
+
+    replica.mu.Lock()
+    defer replica.mu.Unlock()
+
+    return replica.position
+
+}
+
+// Done returns a channel closed once the replica stops, on Close or on an error.
+func (replica *Replica) Done() <-chan struct{} {
+
+    return replica.done
+
+}
+
+// Close disconnects the replica from the primary, the datastore can be written to once it returns.
+// returns the error that stopped the replica before Close was called, if any.
+func (replica *Replica) Close() error {
+
+    replica.mu.Lock()
+    replica.isClosed = true
+    replica.mu.Unlock()
+    replica.conn.Close()
+    <-replica.done
+
+    replica.mu.Lock()
+    defer replica.mu.Unlock()
+
+    return replica.err
+
+}
+
+func (replica *Replica) run(encoder *gob.Encoder, decoder *gob.Decoder) {
+
+    defer close(replica.done)
+    defer replica.conn.Close()
+
+    // stale holds the keys a snapshot has not written yet.
+    var stale map[bucketKey]bool
+    var snapshotSeq uint64
+
+    for {
+        var message replicationMessage
+        err := decoder.Decode(&message)
+
+        switch {
+        case err != nil:
+        case message.Kind == snapshotMessage:
+            stale = make(map[bucketKey]bool)
+            snapshotSeq = message.Seq
+            replica.bitcask.mu.RLock()
+            replica.bitcask.keyDir.forEach(func(bucket int64, key string, recValue record) {
+                stale[bucketKey{bucket, key}] = true
+            })
+            replica.bitcask.mu.RUnlock()
+            // a replica stopped during a snapshot starts a new one.
+            err = replica.bitcask.writeReplicationPosition(Position{})
+            replica.mu.Lock()
+            replica.position = Position{}
+            replica.mu.Unlock()
+        case message.Kind == snapshotEndMessage:
+            for key := range stale {
+                if err == nil {
+                    err = replica.bitcask.apply(Change{
+                        Bucket: key.bucket,
+                        Key: key.key,
+                        Tstamp: time.Now().UnixMicro(),
+                        Seq: snapshotSeq,
+                        IsTompStone: true,
+                    })
+                }
+            }
+            stale = nil
+            if err == nil {
+                err = replica.acknowledge(encoder, message.Position)
+            }
+        default:
+            for _, change := range message.Changes {
+                if err == nil {
+                    err = replica.bitcask.apply(change)
+                    delete(stale, bucketKey{change.Bucket, change.Key})
+                }
+            }
+            if err == nil && stale == nil {
+                err = replica.acknowledge(encoder, message.Position)
+            }
+        }
+
+        if err != nil {
+            replica.mu.Lock()
+            if !replica.isClosed {
+                replica.err = err
+            }
+            replica.mu.Unlock()
+            return
+        }
+    }
+
+}
+
+// acknowledge fsyncs the applied records, saves the position and sends it to the primary.
+func (replica *Replica) acknowledge(encoder *gob.Encoder, position Position) error {
+
+    if err := replica.bitcask.Sync(); err != nil {
+        return err
+    }
+    if err := replica.bitcask.writeReplicationPosition(position); err != nil {
+        return err
+    }
+    replica.mu.Lock()
+    replica.position = position
+    replica.mu.Unlock()
+
+    return encoder.Encode(position)
+
+}
+
+// apply writes a record replicated from another datastore with its sequence number and timestamp,
+// unless the key already has a write with a sequence number as high. The records of the catalog
+// create and drop buckets as in the datastore they come from.
+func (bitcask *Bitcask) apply(change Change) error {
+
+    if bitcask.config.writePermission == ReadOnly {
+        return BitcaskError(WriteDenied)
+    }
+
+    if !change.IsTompStone && bitcask.config.compactKeyDir && !fitsCompactKeyDir(len(change.Value)) {
+        return BitcaskError(ValueTooLarge)
+    }
+
+    bitcask.mu.Lock()
+
+    current, isExist := bitcask.keyDir.get(change.Bucket, change.Key)
+    if isExist && current.seq >= change.Seq || !isExist && change.IsTompStone {
+        bitcask.mu.Unlock()
+        return nil
+    }
+
+    // a commit only writes out the pending writes when lastSeq moved past the last one,
+    // so lastSeq moves on for a record older than the last one applied too.
+    if change.Seq > bitcask.lastSeq {
+        bitcask.lastSeq = change.Seq
+    } else {
+        bitcask.lastSeq++
+    }
+    seq := bitcask.lastSeq
+
+    kind := PutEvent
+    isFull := bitcask.addPendingWrite(change.Bucket, change.Key, change.Value, change.Tstamp, change.Seq, change.IsTompStone)
+    if change.IsTompStone {
+        kind = DeleteEvent
+        bitcask.keyDir.delete(change.Bucket, change.Key)
+    } else {
+        bitcask.keyDir.put(change.Bucket, change.Key, record{
+            fileId:    "",
+            valueSize: int64(len(change.Value)),
+            valuePos:  0,
+            tstamp:    change.Tstamp,
+            seq:       change.Seq,
+            isPending: true,
+        })
+    }
+    if change.Bucket == catalogBucket {
+        bitcask.applyCatalog(change)
+    }
+    isWatched := bitcask.queueEvent(change.Bucket, kind, change.Key, change.Tstamp, change.Seq)
+    unsyncedBytes := bitcask.unsyncedBytes
+    bitcask.mu.Unlock()
+
+    if isWatched {
+        bitcask.deliverEvents()
+    }
+
+    return bitcask.awaitWrite(seq, isFull, unsyncedBytes)
+
+}
+
+// applyCatalog creates or drops the bucket of a replicated catalog record, mu must be held.
+func (bitcask *Bitcask) applyCatalog(change Change) {
+
+    if id, isExist := bitcask.buckets[change.Key]; isExist {
+        bitcask.keyDir.drop(id)
+        delete(bitcask.buckets, change.Key)
+        delete(bitcask.bucketNames, id)
+    }
+    if change.IsTompStone {
+        return
+    }
+
+    if id, err := strconv.ParseInt(change.Value, 10, 64); err == nil && id > defaultBucket {
+        bitcask.buckets[change.Key] = id
+        bitcask.bucketNames[id] = change.Key
+    }
+
+}
+
+// readReplicationPosition returns the position a replica saved last, the zero Position if there is none.
+// returns an error if the file cannot be read.
+func (bitcask *Bitcask) readReplicationPosition() (Position, error) {
+
+    var position Position
+
+    positionFile, err := bitcask.config.fs.Open(path.Join(bitcask.directoryPath, replicationFileName))
+    if errors.Is(err, os.ErrNotExist) {
+        return position, nil
+    } else if err != nil {
+        return position, err
+    }
+    defer positionFile.Close()
+
+    positionReader := bufio.NewReader(positionFile)
+    if _, err := readFileHeader(positionReader); err != nil {
+        return position, formatError(replicationFileName, err)
+    }
+    line := make([]byte, 2 * numberFieldSize)
+    if _, err := io.ReadFull(positionReader, line); err != nil {
+        return position, BitcaskError(fmt.Sprintf("%s: %s", replicationFileName, MalformedLine))
+    }
+    fields, err := parseFields(string(line), 2)
+    if err != nil {
+        return position, BitcaskError(fmt.Sprintf("%s: %s", replicationFileName, MalformedLine))
+    }
+    if fields[0] > 0 {
+        position = Position{FileId: strconv.FormatInt(fields[0], 10), Offset: fields[1]}
+    }
+
+    return position, nil
+
+}
+
+// writeReplicationPosition saves the position a replica applied, replacing the previous one at once.
+func (bitcask *Bitcask) writeReplicationPosition(position Position) error {
+
+    tmpPath := path.Join(bitcask.directoryPath, "." + replicationFileName)
+    positionFile, err := bitcask.createFileWithHeader(tmpPath)
+    if err != nil {
+        return err
+    }
+
+    fileId, _ := strconv.ParseInt(position.FileId, 10, 64)
+    _, err = io.WriteString(positionFile, padWithZero(fileId) + padWithZero(position.Offset) + "\n")
+    if err == nil {
+        err = syncAndClose(positionFile)
+    } else {
+        positionFile.Close()
+    }
+    if err != nil {
+        bitcask.config.fs.Remove(tmpPath)
+        return err
+    }
+
+    return bitcask.config.fs.Rename(tmpPath, path.Join(bitcask.directoryPath, replicationFileName))
+
+}
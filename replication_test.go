@@ -0,0 +1,167 @@
+package bitcask
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testReplicaPath = "testing_replica_dir"
+
+func TestReplication(t *testing.T) {
+
+    t.Run("replica applies the records of the primary", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        defer b.Close()
+        primary := serveReplicas(t, b)
+        defer primary.Close()
+        b.Put("before", "value")
+        users, _ := b.Bucket("users")
+        users.Put("ada", "36")
+        b.Sync()
+
+        r, _ := Open(testReplicaPath, ReadWrite, FileSystem(NewMemFS()))
+        defer r.Close()
+        replica, err := r.Replicate(primary.listener.Addr().String())
+        if err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        defer replica.Close()
+
+        for i := 0; i < 30; i++ {
+            b.Put(fmt.Sprintf("key%d", i), strings.Repeat("v", 50))
+        }
+        b.Delete("before")
+        b.Put("last", "value")
+        b.Sync()
+        waitForKey(t, r, "last")
+
+        assertKeys(t, r.ListKeys(), b.ListKeys()...)
+        got, _ := r.Get("key7")
+        assertString(t, got, strings.Repeat("v", 50))
+        replicaUsers, err := r.Bucket("users")
+        if err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        got, _ = replicaUsers.Get("ada")
+        assertString(t, got, "36")
+        entry, _ := r.GetEntry("last")
+        primaryEntry, _ := b.GetEntry("last")
+        if entry.Seq != primaryEntry.Seq {
+            t.Errorf("replica has seq %d, want the seq %d of the primary", entry.Seq, primaryEntry.Seq)
+        }
+
+        waitFor(t, "the replica to acknowledge", func() bool {
+            replicas := primary.Replicas()
+            return len(replicas) == 1 && replicas[0].Position == replica.Position()
+        })
+
+    })
+
+    t.Run("replica resumes from its position and catches up after a merge", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        defer b.Close()
+        primary := serveReplicas(t, b)
+        defer primary.Close()
+        for i := 0; i < 20; i++ {
+            b.Put(fmt.Sprintf("key%d", i), strings.Repeat("v", 50))
+        }
+        b.Sync()
+
+        replicaFS := NewMemFS()
+        r, _ := Open(testReplicaPath, ReadWrite, FileSystem(replicaFS))
+        replica, _ := r.Replicate(primary.listener.Addr().String())
+        waitForKey(t, r, "key19")
+        if err := replica.Close(); err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        r.Close()
+
+        b.Put("resumed", "value")
+        b.Sync()
+        r, _ = Open(testReplicaPath, ReadWrite, FileSystem(replicaFS))
+        replica, _ = r.Replicate(primary.listener.Addr().String())
+        waitForKey(t, r, "resumed")
+        replica.Close()
+        r.Close()
+
+        // the replica falls behind while the tompstones of the deleted keys are merged away.
+        for i := 0; i < 10; i++ {
+            b.Delete(fmt.Sprintf("key%d", i))
+        }
+        for i := 20; i < 40; i++ {
+            b.Put(fmt.Sprintf("key%d", i), strings.Repeat("v", 50))
+        }
+        if err := b.Merge(); err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        b.Put("merged", "value")
+        b.Sync()
+
+        r, _ = Open(testReplicaPath, ReadWrite, FileSystem(replicaFS))
+        replica, _ = r.Replicate(primary.listener.Addr().String())
+        waitForKey(t, r, "merged")
+        waitFor(t, "the snapshot to end", func() bool {
+            return replica.Position().FileId != ""
+        })
+        assertKeys(t, r.ListKeys(), b.ListKeys()...)
+        replica.Close()
+        r.Close()
+
+        r, _ = Open(testReplicaPath, ReadWrite, FileSystem(replicaFS))
+        defer r.Close()
+        assertKeys(t, r.ListKeys(), b.ListKeys()...)
+
+    })
+
+    t.Run("a read only replica is refused", func(t *testing.T) {
+
+        fs := NewMemFS()
+        r, _ := Open(testReplicaPath, ReadWrite, FileSystem(fs))
+        r.Close()
+        r, _ = Open(testReplicaPath, FileSystem(fs))
+        defer r.Close()
+        _, err := r.Replicate("127.0.0.1:1")
+        assertError(t, err, WriteDenied)
+
+    })
+
+}
+
+func serveReplicas(t testing.TB, b *Bitcask) *Primary {
+
+    t.Helper()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("got error %q, want none", err)
+    }
+
+    return b.ServeReplicas(listener)
+
+}
+
+func waitForKey(t testing.TB, b *Bitcask, key string) {
+
+    t.Helper()
+    waitFor(t, key, func() bool {
+        _, err := b.Get(key)
+        return err == nil
+    })
+
+}
+
+func waitFor(t testing.TB, what string, isDone func() bool) {
+
+    t.Helper()
+    for deadline := time.Now().Add(5 * time.Second); !isDone(); {
+        if time.Now().After(deadline) {
+            t.Fatalf("timed out waiting for %s", what)
+        }
+        time.Sleep(time.Millisecond)
+    }
+
+}
@@ -0,0 +1,158 @@
+package bitcask
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+    DataFile = "data"
+    HintFile = "hint"
+    KeyDirFile = "keydir"
+    CheckpointFile = "checkpoint"
+
+    ChecksumMismatch = "checksum mismatch"
+    UnknownFileKind = "not a data, hint, keydir or checkpoint file"
+)
+
+// FileHeader is the header a data, hint, keydir or checkpoint file starts with.
+// Kind is DataFile, HintFile, KeyDirFile or CheckpointFile, told from the file name.
+type FileHeader struct {
+    Kind string `json:"kind"`
+    Version int64 `json:"version"`
+    CreatedAt int64 `json:"created_at"`
+}
+
+// FileRecord is a record of a file as read by ScanFile.
+// Bucket is 0 for the keys of the plain API, -1 for the names of buckets and -2 for the marker of a shard being added.
+// Value is only read from data files, ValuePos and FileId only from hint and keydir files.
+// Malformed tells why the record cannot be trusted, it is empty for an intact record.
+type FileRecord struct {
+    Offset int64 `json:"offset"`
+    Tstamp int64 `json:"tstamp"`
+    Seq uint64 `json:"seq"`
+    Bucket int64 `json:"bucket,omitempty"`
+    KeySize int64 `json:"key_size"`
+    ValueSize int64 `json:"value_size"`
+    Key string `json:"key"`
+    Value string `json:"value,omitempty"`
+    ValuePos int64 `json:"value_pos,omitempty"`
+    FileId string `json:"file_id,omitempty"`
+    IsTompStone bool `json:"tompstone,omitempty"`
+    Malformed string `json:"malformed,omitempty"`
+}
+
+// ReadFileHeader returns the header of a data, hint, keydir or checkpoint file.
+// A file too short to hold a header, which only a crash leaves behind, has a zero Version.
+// It takes the FileSystem option.
+// returns an error if the file cannot be read or is not in the current format.
+func ReadFileHeader(filePath string, opts ...ConfigOpt) (FileHeader, error) {
+
+    var header FileHeader
+
+    name := strings.TrimPrefix(path.Base(filePath), ".")
+    if _, err := strconv.ParseInt(name, 10, 64); err == nil {
+        header.Kind = DataFile
+    } else if strings.HasPrefix(name, hintFilePrefix) {
+        header.Kind = HintFile
+    } else if strings.HasPrefix(name, keyDirFilePrefix) {
+        header.Kind = KeyDirFile
+    } else if name == checkpointFileName {
+        header.Kind = CheckpointFile
+    } else {
+        return header, BitcaskError(UnknownFileKind)
+    }
+
+    headerFile, err := newOptions(opts).fs.Open(filePath)
+    if err != nil {
+        return header, err
+    }
+    defer headerFile.Close()
+
+    header.CreatedAt, err = readFileHeader(headerFile)
+    if err == io.EOF {
+        return header, nil
+    } else if err != nil {
+        return header, err
+    }
+    header.Version = formatVersion
+
+    return header, nil
+
+}
+
+// ScanFile decodes a data, hint, keydir or checkpoint file and calls fun on each of its records in file order.
+// A record with a bad checksum is passed with Malformed set, and scanning goes on.
+// A record that cannot be framed or decoded, or a torn last record, is passed with Malformed set and ends the scan.
+// It takes the FileSystem option.
+// returns an error if the file cannot be read or is not in the current format.
+func ScanFile(filePath string, fun func(FileRecord), opts ...ConfigOpt) error {
+
+    header, err := ReadFileHeader(filePath, opts...)
+    if err != nil || header.Version == 0 {
+        return err
+    }
+
+    scanFile, err := newOptions(opts).fs.Open(filePath)
+    if err != nil {
+        return err
+    }
+    defer scanFile.Close()
+    scanReader := bufio.NewReader(scanFile)
+
+    var currentPos int64 = int64(fileHeaderSize)
+    if header.Kind == CheckpointFile {
+        currentPos += checkpointHeaderSize + 1
+    }
+    if _, err := scanReader.Discard(int(currentPos)); err != nil {
+        return nil
+    }
+
+    for {
+        var line string
+        var err error
+        var rec FileRecord
+
+        switch header.Kind {
+        case DataFile:
+            line, err = readSizedLine(scanReader, staticFields * numberFieldSize, 5, 6)
+            if err == nil {
+                rec.Bucket, rec.Key, rec.Value, rec.Tstamp, rec.Seq, rec.IsTompStone, err = extractFileLine(line)
+                rec.ValueSize = int64(len(rec.Value))
+                if err == nil && !checkFileLine(line) {
+                    rec.Malformed = ChecksumMismatch
+                }
+            }
+        case HintFile:
+            line, err = readSizedLine(scanReader, hintHeaderSize, 3)
+            if err == nil {
+                rec.Bucket, rec.Key, rec.ValueSize, rec.ValuePos, rec.Tstamp, rec.Seq, err = extractHintFileLine(line)
+                rec.IsTompStone = rec.ValueSize == tompStoneSize
+            }
+        default:
+            line, err = readSizedLine(scanReader, keyDirHeaderSize, 6)
+            if err == nil {
+                rec.Bucket, rec.Key, rec.FileId, rec.ValueSize, rec.ValuePos, rec.Tstamp, rec.Seq, err = extractKeyDirFileLine(line)
+            }
+        }
+
+        if err == io.EOF {
+            return nil
+        } else if err == io.ErrUnexpectedEOF {
+            fun(FileRecord{Offset: currentPos, Malformed: TornRecord})
+            return nil
+        } else if err != nil {
+            fun(FileRecord{Offset: currentPos, Malformed: err.Error()})
+            return nil
+        }
+
+        rec.Offset = currentPos
+        rec.KeySize = int64(len(rec.Key))
+        fun(rec)
+        currentPos += int64(len(line) + 1)
+    }
+
+}
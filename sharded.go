@@ -0,0 +1,454 @@
+package bitcask
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+    NoShards = "no shard directories"
+    ShardExists = "shard already exists"
+
+    ringPointsPerShard = 128
+    migrationChunk = 256
+
+    // a shard added by AddShard holds migratingKey in shardBucket until the keys it takes over are moved to it.
+    migratingKey = "migrating"
+)
+
+// Sharded spreads the keys of a datastore over several bitcask directories, possibly on different disks,
+// each with its own writer lock. Keys are routed by a consistent-hash ring, so a shard added later only
+// takes over its share of the keys. A shard is known on the ring by its directory path, which must be given
+// the same on every open. Only the keys of the plain API are sharded.
+type Sharded struct {
+    mu sync.RWMutex
+    addMu sync.Mutex
+    opts []ConfigOpt
+    shards []*Bitcask
+    dirPaths []string
+    ring hashRing
+    // previousRing routes the keys not moved yet while a shard is added, nil otherwise.
+    previousRing hashRing
+}
+
+type ringPoint struct {
+    hash uint32
+    shard *Bitcask
+}
+
+// hashRing holds ringPointsPerShard points per shard, sorted by hash.
+type hashRing []ringPoint
+
+// OpenSharded opens the bitcask directories of a sharded datastore with the options of Open.
+// A shard added by an interrupted AddShard is finished first when ReadWrite permission is set,
+// with ReadOnly the keys not moved yet are still read from the shard they were on.
+// returns an error if there is no directory, a directory is given twice or a shard cannot be opened.
+func OpenSharded(dirPaths []string, opts ...ConfigOpt) (*Sharded, error) {
+
+    if len(dirPaths) == 0 {
+        return nil, BitcaskError(NoShards)
+    }
+
+    sharded := &Sharded{opts: opts}
+    var previous []int
+    for i, dirPath := range dirPaths {
+        for _, other := range dirPaths[:i] {
+            if other == dirPath {
+                sharded.Close()
+                return nil, BitcaskError(fmt.Sprintf("%s: %s", dirPath, ShardExists))
+            }
+        }
+        shard, err := Open(dirPath, opts...)
+        if err != nil {
+            sharded.Close()
+            return nil, err
+        }
+        sharded.shards = append(sharded.shards, shard)
+        sharded.dirPaths = append(sharded.dirPaths, dirPath)
+        if !isMigrating(shard) {
+            previous = append(previous, i)
+        }
+    }
+
+    sharded.ring = sharded.buildRing(nil)
+    if len(previous) == len(dirPaths) {
+        return sharded, nil
+    }
+    sharded.previousRing = sharded.buildRing(previous)
+    if sharded.shards[0].config.writePermission == ReadOnly {
+        return sharded, nil
+    }
+
+    if err := sharded.migrate(); err != nil {
+        sharded.Close()
+        return nil, err
+    }
+
+    return sharded, nil
+
+}
+
+// Get retrieves the value by key from the shard it is routed to.
+// returns an error if key does not exist in the datastore.
+func (sharded *Sharded) Get(key string) (string, error) {
+
+    sharded.mu.RLock()
+    defer sharded.mu.RUnlock()
+
+    shard := sharded.ring.owner(key)
+    value, err := shard.Get(key)
+    if err != nil && sharded.previousRing != nil {
+        if previous := sharded.previousRing.owner(key); previous != shard {
+            return previous.Get(key)
+        }
+    }
+
+    return value, err
+
+}
+
+// Put stores a value by key in the shard it is routed to.
+// returns an error if ReadWrite permission is not set.
+func (sharded *Sharded) Put(key string, value string) error {
+
+    sharded.mu.RLock()
+    defer sharded.mu.RUnlock()
+
+    return sharded.ring.owner(key).Put(key, value)
+
+}
+
+// Delete removes a key from the shard it is routed to, and from the shard it is moved from while a shard is added.
+// returns an error if key does not exist in the datastore or ReadWrite permission is not set.
+func (sharded *Sharded) Delete(key string) error {
+
+    sharded.mu.RLock()
+    defer sharded.mu.RUnlock()
+
+    shard := sharded.ring.owner(key)
+    err := shard.Delete(key)
+    if sharded.previousRing == nil {
+        return err
+    }
+    previous := sharded.previousRing.owner(key)
+    if previous == shard {
+        return err
+    }
+
+    // the key is deleted if either shard had it, a failed write fails the delete.
+    previousErr := previous.Delete(key)
+    if isKeyMissing(err) {
+        return previousErr
+    }
+    if err == nil && !isKeyMissing(previousErr) {
+        return previousErr
+    }
+
+    return err
+
+}
+
+// ListKeys list all keys of every shard.
+func (sharded *Sharded) ListKeys() []string {
+
+    sharded.mu.RLock()
+    defer sharded.mu.RUnlock()
+
+    var list []string
+    seen := make(map[string]bool)
+    for _, shard := range sharded.shards {
+        for _, key := range shard.ListKeys() {
+            if !seen[key] {
+                seen[key] = true
+                list = append(list, key)
+            }
+        }
+    }
+
+    return list
+
+}
+
+// Fold folds over all key/value pairs of every shard.
+// fun is expected to be in the form: F(K, V, Acc) -> Acc
+func (sharded *Sharded) Fold(fun func(string, string, any) any, acc any) any {
+
+    for _, key := range sharded.ListKeys() {
+        value, err := sharded.Get(key)
+        if err != nil {
+            continue
+        }
+        acc = fun(key, value, acc)
+    }
+    return acc
+
+}
+
+// Merge merges every shard, all at once.
+// returns the first error a shard returned.
+func (sharded *Sharded) Merge() error {
+
+    return sharded.forEachShard((*Bitcask).Merge)
+
+}
+
+// Sync forces the pending writes of every shard to be written and fsynced, all at once.
+// returns the first error a shard returned.
+func (sharded *Sharded) Sync() error {
+
+    return sharded.forEachShard((*Bitcask).Sync)
+
+}
+
+// Close closes every shard.
+func (sharded *Sharded) Close() {
+
+    sharded.addMu.Lock()
+    defer sharded.addMu.Unlock()
+    sharded.mu.Lock()
+    defer sharded.mu.Unlock()
+
+    for _, shard := range sharded.shards {
+        shard.Close()
+    }
+    sharded.shards = nil
+
+}
+
+// Shards returns the directories of the shards, in the order they were given and added.
+func (sharded *Sharded) Shards() []string {
+
+    sharded.mu.RLock()
+    defer sharded.mu.RUnlock()
+
+    return append([]string(nil), sharded.dirPaths...)
+
+}
+
+// AddShard opens dirPath as a new shard and moves to it the keys the ring now routes to it.
+// The datastore stays online while the keys are moved: writes go to the new shard at once,
+// and a key not moved yet is read from the shard it is on. If the process stops before AddShard returns,
+// the next OpenSharded given dirPath finishes moving the keys.
+// returns an error if ReadWrite permission is not set, dirPath is a shard already or a key cannot be moved.
+func (sharded *Sharded) AddShard(dirPath string) error {
+
+    sharded.addMu.Lock()
+    defer sharded.addMu.Unlock()
+
+    sharded.mu.RLock()
+    isReadOnly := len(sharded.shards) == 0 || sharded.shards[0].config.writePermission == ReadOnly
+    isExist := false
+    for _, other := range sharded.dirPaths {
+        isExist = isExist || other == dirPath
+    }
+    sharded.mu.RUnlock()
+    if isReadOnly {
+        return BitcaskError(WriteDenied)
+    }
+    if isExist {
+        return BitcaskError(fmt.Sprintf("%s: %s", dirPath, ShardExists))
+    }
+
+    shard, err := Open(dirPath, sharded.opts...)
+    if err != nil {
+        return err
+    }
+    err = shard.put(shardBucket, "", migratingKey, "")
+    if err == nil {
+        err = shard.Sync()
+    }
+    if err != nil {
+        shard.Close()
+        return err
+    }
+
+    sharded.mu.Lock()
+    sharded.previousRing = sharded.ring
+    sharded.shards = append(sharded.shards, shard)
+    sharded.dirPaths = append(sharded.dirPaths, dirPath)
+    sharded.ring = sharded.buildRing(nil)
+    sharded.mu.Unlock()
+
+    return sharded.migrate()
+
+}
+
+// migrate moves every key to the shard the ring routes it to, then clears the markers of the added shards.
+// Keys are moved in chunks, with one fsync of the shards they move to per chunk.
+func (sharded *Sharded) migrate() error {
+
+    sharded.mu.RLock()
+    shards := append([]*Bitcask(nil), sharded.shards...)
+    sharded.mu.RUnlock()
+
+    for _, shard := range shards {
+        if isMigrating(shard) {
+            continue
+        }
+        keys := shard.ListKeys()
+        for start := 0; start < len(keys); start += migrationChunk {
+            end := start + migrationChunk
+            if end > len(keys) {
+                end = len(keys)
+            }
+            if err := sharded.moveKeys(shard, keys[start:end]); err != nil {
+                return err
+            }
+        }
+    }
+
+    for _, shard := range shards {
+        if isMigrating(shard) {
+            if err := shard.delete(shardBucket, "", migratingKey); err != nil {
+                return err
+            }
+            if err := shard.Sync(); err != nil {
+                return err
+            }
+        }
+    }
+
+    sharded.mu.Lock()
+    sharded.previousRing = nil
+    sharded.mu.Unlock()
+
+    return nil
+
+}
+
+// moveKeys moves keys from shard to the shards the ring routes them to, unless they were written there since.
+// Writes wait while a chunk of keys is moved.
+func (sharded *Sharded) moveKeys(shard *Bitcask, keys []string) error {
+
+    sharded.mu.Lock()
+    defer sharded.mu.Unlock()
+
+    var moved []string
+    targets := make(map[*Bitcask]bool)
+    for _, key := range keys {
+        target := sharded.ring.owner(key)
+        if target == shard {
+            continue
+        }
+        if _, err := target.Get(key); err != nil {
+            value, err := shard.Get(key)
+            if err != nil {
+                continue
+            }
+            if err := target.Put(key, value); err != nil {
+                return err
+            }
+            targets[target] = true
+        }
+        moved = append(moved, key)
+    }
+
+    // the keys are on disk in their new shard before they are deleted from the old one.
+    for target := range targets {
+        if err := target.Sync(); err != nil {
+            return err
+        }
+    }
+    for _, key := range moved {
+        if err := shard.Delete(key); err != nil && !isKeyMissing(err) {
+            return err
+        }
+    }
+
+    return nil
+
+}
+
+// forEachShard calls fun on every shard concurrently and returns the first error.
+func (sharded *Sharded) forEachShard(fun func(*Bitcask) error) error {
+
+    sharded.mu.RLock()
+    defer sharded.mu.RUnlock()
+
+    errs := make([]error, len(sharded.shards))
+    var calls sync.WaitGroup
+    for i, shard := range sharded.shards {
+        calls.Add(1)
+        go func(i int, shard *Bitcask) {
+            defer calls.Done()
+            errs[i] = fun(shard)
+        }(i, shard)
+    }
+    calls.Wait()
+
+    for _, err := range errs {
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+
+}
+
+// buildRing returns the ring of the shards at indexes, of every shard when indexes is nil.
+func (sharded *Sharded) buildRing(indexes []int) hashRing {
+
+    if indexes == nil {
+        for i := range sharded.shards {
+            indexes = append(indexes, i)
+        }
+    }
+
+    var ring hashRing
+    for _, i := range indexes {
+        for point := 0; point < ringPointsPerShard; point++ {
+            ring = append(ring, ringPoint{
+                hash: ringHash(sharded.dirPaths[i] + "#" + strconv.Itoa(point)),
+                shard: sharded.shards[i],
+            })
+        }
+    }
+    sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+    return ring
+
+}
+
+// owner returns the shard of the first point of the ring at or after the hash of key.
+func (ring hashRing) owner(key string) *Bitcask {
+
+    hash := ringHash(key)
+    i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+    if i == len(ring) {
+        i = 0
+    }
+
+    return ring[i].shard
+
+}
+
+func ringHash(s string) uint32 {
+
+    hash := fnv.New32a()
+    hash.Write([]byte(s))
+
+    return hash.Sum32()
+
+}
+
+// isMigrating reports whether shard was added by an AddShard that has not moved all its keys yet.
+func isMigrating(shard *Bitcask) bool {
+
+    shard.mu.RLock()
+    _, isExist := shard.keyDir.get(shardBucket, migratingKey)
+    shard.mu.RUnlock()
+
+    return isExist
+
+}
+
+func isKeyMissing(err error) bool {
+
+    return err != nil && strings.HasSuffix(err.Error(), KeyDoesNotExist)
+
+}
@@ -0,0 +1,183 @@
+package bitcask
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSharded(t *testing.T) {
+
+    shardPaths := []string{testBitcaskPath + "/0", testBitcaskPath + "/1", testBitcaskPath + "/2"}
+
+    t.Run("keys are routed to the shards and fanned out", func(t *testing.T) {
+
+        fs := NewMemFS()
+        sharded, err := OpenSharded(shardPaths, ReadWrite, FileSystem(fs))
+        if err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        var want []string
+        for i := 0; i < 300; i++ {
+            key := fmt.Sprintf("key%d", i)
+            sharded.Put(key, "value" + key)
+            want = append(want, key)
+        }
+        sharded.Delete("key0")
+        assertError(t, sharded.Delete("key0"), "key0: key does not exist")
+        want = want[1:]
+        if err := sharded.Sync(); err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        if err := sharded.Merge(); err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+
+        assertKeys(t, sharded.ListKeys(), want...)
+        for i, shard := range sharded.shards {
+            if n := len(shard.ListKeys()); n < 50 {
+                t.Errorf("shard %d has %d of 299 keys", i, n)
+            }
+        }
+        count := sharded.Fold(func(key string, value string, acc any) any {
+            if value != "value" + key {
+                t.Errorf("got value %q for %s", value, key)
+            }
+            return acc.(int) + 1
+        }, 0)
+        if count != 299 {
+            t.Errorf("Fold() went over %d keys, want 299", count)
+        }
+        sharded.Close()
+
+        sharded, _ = OpenSharded(shardPaths, FileSystem(fs))
+        defer sharded.Close()
+        got, _ := sharded.Get("key42")
+        assertString(t, got, "valuekey42")
+        assertError(t, sharded.Put("key42", "value"), WriteDenied)
+        assertError(t, sharded.AddShard(testBitcaskPath + "/3"), WriteDenied)
+
+        _, err = OpenSharded(nil)
+        assertError(t, err, NoShards)
+        _, err = OpenSharded([]string{shardPaths[0], shardPaths[0]}, FileSystem(fs))
+        assertError(t, err, shardPaths[0] + ": " + ShardExists)
+
+    })
+
+    t.Run("a shard is added while keys are written", func(t *testing.T) {
+
+        sharded, _ := OpenSharded(shardPaths, ReadWrite, FileSystem(NewMemFS()))
+        defer sharded.Close()
+        for i := 0; i < 1000; i++ {
+            sharded.Put(fmt.Sprintf("key%d", i), "old")
+        }
+        before := make(map[string]*Bitcask)
+        for _, key := range sharded.ListKeys() {
+            before[key] = sharded.ring.owner(key)
+        }
+
+        var writers sync.WaitGroup
+        writers.Add(1)
+        go func() {
+            defer writers.Done()
+            for i := 0; i < 1000; i += 3 {
+                sharded.Put(fmt.Sprintf("key%d", i), "new")
+                if i % 2 == 0 {
+                    sharded.Delete(fmt.Sprintf("key%d", i))
+                }
+            }
+        }()
+        if err := sharded.AddShard(testBitcaskPath + "/3"); err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        writers.Wait()
+        assertError(t, sharded.AddShard(testBitcaskPath + "/3"), testBitcaskPath + "/3: " + ShardExists)
+
+        moved := 0
+        for i := 0; i < 1000; i++ {
+            key := fmt.Sprintf("key%d", i)
+            want := "old"
+            if i % 3 == 0 {
+                want = "new"
+            }
+            got, err := sharded.Get(key)
+            if i % 6 == 0 {
+                assertError(t, err, key + ": key does not exist")
+                continue
+            }
+            assertString(t, got, want)
+            owner := sharded.ring.owner(key)
+            for _, shard := range sharded.shards {
+                if _, err := shard.Get(key); err == nil && shard != owner {
+                    t.Errorf("%s is still on a shard it is not routed to", key)
+                }
+            }
+            if owner != before[key] {
+                moved++
+            }
+        }
+        // the new shard takes a quarter of the keys, the others stay where they were.
+        if moved < 100 || moved > 350 {
+            t.Errorf("%d of 833 keys moved, want about a quarter", moved)
+        }
+        if len(sharded.Shards()) != 4 || sharded.previousRing != nil || isMigrating(sharded.shards[3]) {
+            t.Errorf("the added shard is still migrating")
+        }
+
+    })
+
+    t.Run("an interrupted add is finished on open", func(t *testing.T) {
+
+        fs := NewMemFS()
+        sharded, _ := OpenSharded(shardPaths, ReadWrite, FileSystem(fs))
+        var want []string
+        for i := 0; i < 200; i++ {
+            sharded.Put(fmt.Sprintf("key%d", i), "value")
+            want = append(want, fmt.Sprintf("key%d", i))
+        }
+        sharded.Close()
+
+        // the process stopped once the new shard was marked, before any key moved.
+        added, _ := Open(testBitcaskPath + "/3", ReadWrite, FileSystem(fs))
+        added.put(shardBucket, "", migratingKey, "")
+        added.Close()
+
+        // the marker is out of reach of the buckets of the shard.
+        added, _ = Open(testBitcaskPath + "/3", ReadWrite, FileSystem(fs))
+        if !isMigrating(added) || len(added.ListBuckets()) != 0 {
+            t.Errorf("got buckets %v and migrating %v after reopen, want the marker only", added.ListBuckets(), isMigrating(added))
+        }
+        assertError(t, added.DropBucket("sharded"), "sharded: " + BucketDoesNotExist)
+        users, _ := added.Bucket("sharded")
+        users.Put(migratingKey, "")
+        users.Delete(migratingKey)
+        added.DropBucket("sharded")
+        if !isMigrating(added) {
+            t.Error("a bucket of the shard removed the marker")
+        }
+        added.Close()
+        allPaths := append(append([]string(nil), shardPaths...), testBitcaskPath + "/3")
+
+        readOnly, _ := OpenSharded(allPaths, FileSystem(fs))
+        assertKeys(t, readOnly.ListKeys(), want...)
+        for i := 0; i < 200; i++ {
+            if _, err := readOnly.Get(fmt.Sprintf("key%d", i)); err != nil {
+                t.Fatalf("got error %q, want none", err)
+            }
+        }
+        readOnly.Close()
+
+        sharded, _ = OpenSharded(allPaths, ReadWrite, FileSystem(fs))
+        defer sharded.Close()
+        if n := len(sharded.shards[3].ListKeys()); n == 0 || isMigrating(sharded.shards[3]) {
+            t.Errorf("the added shard has %d keys, want its share moved to it", n)
+        }
+        for i := 0; i < 200; i++ {
+            if _, err := sharded.Get(fmt.Sprintf("key%d", i)); err != nil {
+                t.Fatalf("got error %q, want none", err)
+            }
+        }
+
+    })
+
+}
@@ -0,0 +1,307 @@
+package bitcask
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+const (
+    PositionCompacted = "position compacted by merge"
+    BadPosition = "position is not at a record of the data file"
+)
+
+// Position is where a Tailer reads, a data file and the offset of a record in it.
+// The zero Position is the start of the oldest data file.
+type Position struct {
+    FileId string `json:"file_id"`
+    Offset int64 `json:"offset"`
+}
+
+// Change is a record of a data file read by a Tailer, a put or, with IsTompStone, a delete.
+// Bucket is 0 for the keys of the plain API and -1 for the names of buckets.
+// Position is where the record after it starts, a Tailer resumed from it reads on from there.
+type Change struct {
+    Position Position `json:"position"`
+    Bucket int64 `json:"bucket,omitempty"`
+    Key string `json:"key"`
+    Value string `json:"value,omitempty"`
+    Tstamp int64 `json:"tstamp"`
+    Seq uint64 `json:"seq"`
+    IsTompStone bool `json:"tompstone,omitempty"`
+}
+
+// Tailer reads the records of the data files of a datastore in file order, following the writer.
+// It is not safe for concurrent use.
+type Tailer struct {
+    fs FS
+    directoryPath string
+    position Position
+    file File
+    reader *bufio.Reader
+    // snapshotEnd is the newest data file when the tailer started, lastSeq the highest sequence
+    // number read. A newer file starting below lastSeq was written by a Merge, it holds copies.
+    snapshotEnd int64
+    lastSeq uint64
+    isFirst bool
+    isCopy bool
+    isSealed bool
+}
+
+// Tail returns a Tailer reading the data files of the datastore in dirPath from a position,
+// written by another process or not. Every file there when it starts is read whole, so the zero
+// Position reads all the records of the datastore, the files written by a Merge after it are skipped.
+// It takes the FileSystem option.
+// returns an error if from is in a data file a Merge removed.
+func Tail(dirPath string, from Position, opts ...ConfigOpt) (*Tailer, error) {
+
+    config := newOptions(opts)
+    tailer := &Tailer{
+        fs: config.fs,
+        directoryPath: dirPath,
+    }
+
+    fileIds, err := tailer.dataFileIds()
+    if err != nil {
+        return nil, err
+    }
+    if len(fileIds) > 0 {
+        tailer.snapshotEnd = fileIds[len(fileIds) - 1]
+    }
+    if from.FileId == "" {
+        return tailer, nil
+    }
+
+    if err := tailer.openFile(from.FileId); errors.Is(err, os.ErrNotExist) {
+        return nil, BitcaskError(fmt.Sprintf("%s: %s", from.FileId, PositionCompacted))
+    } else if err == io.EOF {
+        return nil, BitcaskError(fmt.Sprintf("%s: %s", from.FileId, BadPosition))
+    } else if err != nil {
+        return nil, err
+    }
+
+    // the records before the position give the sequence numbers already read.
+    for tailer.position.Offset < from.Offset {
+        line, err := readSizedLine(tailer.reader, staticFields * numberFieldSize, 5, 6)
+        if err != nil || !checkFileLine(line) {
+            tailer.Close()
+            return nil, BitcaskError(fmt.Sprintf("%s: %s", from.FileId, BadPosition))
+        }
+        _, _, _, _, seq, _, err := extractFileLine(line)
+        if err != nil {
+            tailer.Close()
+            return nil, BitcaskError(fmt.Sprintf("%s: %s", from.FileId, BadPosition))
+        }
+        if seq > tailer.lastSeq {
+            tailer.lastSeq = seq
+        }
+        tailer.position.Offset += int64(len(line) + 1)
+        tailer.isFirst = false
+    }
+    if tailer.position.Offset != from.Offset {
+        tailer.Close()
+        return nil, BitcaskError(fmt.Sprintf("%s: %s", from.FileId, BadPosition))
+    }
+
+    return tailer, nil
+
+}
+
+// Next returns the next record, or io.EOF once every record written so far has been read,
+// Next may be called again after more writes. A data file is left for the next one at its first
+// torn or corrupted record once a newer data file exists, the writer never appends to it again.
+// returns an error if the data file read was removed by a Merge before it was read whole.
+func (tailer *Tailer) Next() (Change, error) {
+
+    for {
+        if tailer.file == nil {
+            if err := tailer.nextFile(); err != nil {
+                return Change{}, err
+            }
+        }
+        if tailer.reader == nil {
+            if _, err := tailer.file.Seek(tailer.position.Offset, io.SeekStart); err != nil {
+                return Change{}, err
+            }
+            tailer.reader = bufio.NewReader(tailer.file)
+        }
+
+        var change Change
+        line, err := readSizedLine(tailer.reader, staticFields * numberFieldSize, 5, 6)
+        if err == nil && !checkFileLine(line) {
+            err = BitcaskError(ChecksumMismatch)
+        }
+        if err == nil {
+            change.Bucket, change.Key, change.Value, change.Tstamp, change.Seq, change.IsTompStone, err = extractFileLine(line)
+        }
+
+        if err != nil {
+            // the end of the file is read once more after a newer file is seen,
+            // records may have been appended before the writer moved on.
+            tailer.reader = nil
+            if tailer.isSealed {
+                if err := tailer.closeFile(); err != nil {
+                    return Change{}, err
+                }
+                continue
+            }
+            isNewer, err := tailer.isNewerFile()
+            if err != nil {
+                return Change{}, err
+            }
+            if !isNewer {
+                return Change{}, io.EOF
+            }
+            tailer.isSealed = true
+            continue
+        }
+
+        fileId, _ := strconv.ParseInt(tailer.position.FileId, 10, 64)
+        if tailer.isFirst && fileId > tailer.snapshotEnd && change.Seq <= tailer.lastSeq {
+            tailer.isCopy = true
+        }
+        tailer.isFirst = false
+        tailer.position.Offset += int64(len(line) + 1)
+        if tailer.isCopy {
+            continue
+        }
+
+        if change.Seq > tailer.lastSeq {
+            tailer.lastSeq = change.Seq
+        }
+        change.Position = tailer.position
+
+        return change, nil
+    }
+
+}
+
+// Position returns where the next record is read.
+func (tailer *Tailer) Position() Position {
+
+    return tailer.position
+
+}
+
+// Close closes the data file the tailer reads.
+func (tailer *Tailer) Close() {
+
+    if tailer.file != nil {
+        tailer.file.Close()
+        tailer.file = nil
+        tailer.reader = nil
+    }
+
+}
+
+// dataFileIds returns the ids of the data files of the datastore, oldest first.
+func (tailer *Tailer) dataFileIds() ([]int64, error) {
+
+    files, err := tailer.fs.ReadDir(tailer.directoryPath)
+    if err != nil {
+        return nil, err
+    }
+
+    var fileIds []int64
+    for _, file := range files {
+        if fileId, err := strconv.ParseInt(file.Name(), 10, 64); err == nil {
+            fileIds = append(fileIds, fileId)
+        }
+    }
+    sort.Slice(fileIds, func(i, j int) bool { return fileIds[i] < fileIds[j] })
+
+    return fileIds, nil
+
+}
+
+func (tailer *Tailer) isNewerFile() (bool, error) {
+
+    fileIds, err := tailer.dataFileIds()
+    if err != nil {
+        return false, err
+    }
+    fileId, _ := strconv.ParseInt(tailer.position.FileId, 10, 64)
+
+    return len(fileIds) > 0 && fileIds[len(fileIds) - 1] > fileId, nil
+
+}
+
+// openFile opens a data file and reads its header, the tailer is then at its first record.
+func (tailer *Tailer) openFile(name string) error {
+
+    file, err := tailer.fs.Open(path.Join(tailer.directoryPath, name))
+    if err != nil {
+        return err
+    }
+    reader := bufio.NewReader(file)
+    if _, err := readFileHeader(reader); err != nil {
+        file.Close()
+        if err == io.EOF {
+            return err
+        }
+        return formatError(name, err)
+    }
+
+    tailer.file = file
+    tailer.reader = reader
+    tailer.position = Position{FileId: name, Offset: int64(fileHeaderSize)}
+    tailer.isFirst = true
+    tailer.isCopy = false
+    tailer.isSealed = false
+
+    return nil
+
+}
+
+// closeFile leaves a data file read whole. A Merge removes old files oldest first,
+// so once the file is removed the files after it may be gone without having been read,
+// unless it held no record, as the active file a Merge replaces before anything was written to it.
+func (tailer *Tailer) closeFile() error {
+
+    tailer.Close()
+    _, err := tailer.fs.Stat(path.Join(tailer.directoryPath, tailer.position.FileId))
+    if errors.Is(err, os.ErrNotExist) && tailer.position.Offset > int64(fileHeaderSize) {
+        return BitcaskError(fmt.Sprintf("%s: %s", tailer.position.FileId, PositionCompacted))
+    }
+
+    return nil
+
+}
+
+// nextFile opens the oldest data file after the one read, a file too short to hold a header
+// is waited for unless a newer file exists.
+// returns io.EOF if there is none.
+func (tailer *Tailer) nextFile() error {
+
+    fileIds, err := tailer.dataFileIds()
+    if err != nil {
+        return err
+    }
+
+    var fileId int64 = -1
+    if tailer.position.FileId != "" {
+        fileId, _ = strconv.ParseInt(tailer.position.FileId, 10, 64)
+    }
+    for i, nextId := range fileIds {
+        if nextId <= fileId {
+            continue
+        }
+        err := tailer.openFile(strconv.FormatInt(nextId, 10))
+        if errors.Is(err, os.ErrNotExist) && tailer.position.FileId != "" {
+            return BitcaskError(fmt.Sprintf("%s: %s", tailer.position.FileId, PositionCompacted))
+        }
+        if errors.Is(err, os.ErrNotExist) || err == io.EOF && i < len(fileIds) - 1 {
+            continue
+        }
+
+        return err
+    }
+
+    return io.EOF
+
+}
@@ -0,0 +1,138 @@
+package bitcask
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTail(t *testing.T) {
+
+    t.Run("records in file order across rotations", func(t *testing.T) {
+
+        fs := NewMemFS()
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(fs))
+        defer b.Close()
+        for i := 0; i < 40; i++ {
+            b.Put(fmt.Sprintf("key%d", i), strings.Repeat("v", 50))
+        }
+        b.Delete("key3")
+        users, _ := b.Bucket("users")
+        users.Put("ada", "36")
+        b.Sync()
+
+        tailer, _ := Tail(testBitcaskPath, Position{}, FileSystem(fs))
+        defer tailer.Close()
+        changes := readChanges(t, tailer)
+        if len(changes) != 43 {
+            t.Fatalf("got %d changes, want 43", len(changes))
+        }
+        fileIds := make(map[string]bool)
+        for i, change := range changes {
+            fileIds[change.Position.FileId] = true
+            if change.Seq != uint64(i + 1) {
+                t.Fatalf("change %d has seq %d", i, change.Seq)
+            }
+        }
+        if len(fileIds) < 2 {
+            t.Errorf("got changes from %d data files, want the active file rotated", len(fileIds))
+        }
+        if last := changes[40]; last.Key != "key3" || !last.IsTompStone {
+            t.Errorf("got change %+v, want the delete of key3", last)
+        }
+        if last := changes[42]; last.Key != "ada" || last.Bucket == defaultBucket {
+            t.Errorf("got change %+v, want ada in a bucket", last)
+        }
+
+        b.Put("late", "value")
+        b.Sync()
+        if change, err := tailer.Next(); err != nil || change.Key != "late" {
+            t.Errorf("got change %+v and error %v, want late", change, err)
+        }
+
+        resumed, err := Tail(testBitcaskPath, changes[19].Position, FileSystem(fs))
+        if err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        defer resumed.Close()
+        rest := readChanges(t, resumed)
+        if len(rest) != 24 || !reflect.DeepEqual(rest[:23], changes[20:]) {
+            t.Errorf("resumed tailer read %d changes, want the 24 after the position", len(rest))
+        }
+
+        _, err = Tail(testBitcaskPath, Position{changes[0].Position.FileId, changes[0].Position.Offset - 1}, FileSystem(fs))
+        assertError(t, err, changes[0].Position.FileId + ": " + BadPosition)
+
+    })
+
+    t.Run("merge copies are skipped and removed positions reported", func(t *testing.T) {
+
+        fs := NewMemFS()
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(fs))
+        defer b.Close()
+        for i := 0; i < 40; i++ {
+            b.Put(fmt.Sprintf("key%d", i % 20), strings.Repeat("v", 50))
+        }
+        b.Sync()
+
+        caughtUp, _ := Tail(testBitcaskPath, Position{}, FileSystem(fs))
+        defer caughtUp.Close()
+        changes := readChanges(t, caughtUp)
+        behind, _ := Tail(testBitcaskPath, Position{}, FileSystem(fs))
+        defer behind.Close()
+        behind.Next()
+
+        if err := b.Merge(); err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        b.Put("after", "value")
+        b.Sync()
+
+        if got := readChanges(t, caughtUp); len(got) != 1 || got[0].Key != "after" {
+            t.Errorf("got changes %+v after the merge, want after only", got)
+        }
+
+        removed := changes[0].Position.FileId
+        _, err := Tail(testBitcaskPath, changes[0].Position, FileSystem(fs))
+        assertError(t, err, removed + ": " + PositionCompacted)
+        // the tailer still reads the file it has open, but not the files removed after it.
+        var nextErr error
+        for nextErr == nil {
+            _, nextErr = behind.Next()
+        }
+        assertError(t, nextErr, removed + ": " + PositionCompacted)
+
+        // a tailer started after the merge reads the merged files.
+        fresh, _ := Tail(testBitcaskPath, Position{}, FileSystem(fs))
+        defer fresh.Close()
+        keys := make(map[string]bool)
+        for _, change := range readChanges(t, fresh) {
+            keys[change.Key] = true
+        }
+        if len(keys) != 21 {
+            t.Errorf("got %d keys from the merged datastore, want 21", len(keys))
+        }
+
+    })
+
+}
+
+// readChanges reads the changes of a tailer until it is caught up.
+func readChanges(t testing.TB, tailer *Tailer) []Change {
+
+    t.Helper()
+    var changes []Change
+    for {
+        change, err := tailer.Next()
+        if err == io.EOF {
+            return changes
+        }
+        if err != nil {
+            t.Fatalf("got error %q, want none", err)
+        }
+        changes = append(changes, change)
+    }
+
+}
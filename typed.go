@@ -0,0 +1,355 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Codec encodes the values of a Typed view to the strings a datastore stores.
+type Codec[V any] interface {
+    Encode(value V) (string, error)
+    Decode(data string) (V, error)
+}
+
+// JSONCodec stores values as JSON.
+type JSONCodec[V any] struct{}
+
+// GobCodec stores values as gob, every value with its own type description.
+type GobCodec[V any] struct{}
+
+// BytesCodec stores byte slices as they are.
+type BytesCodec struct{}
+
+// KeyEncoder encodes the keys of a Typed view to strings whose byte order is the order of the keys,
+// so that iterating over the sorted strings visits the keys in order.
+type KeyEncoder[K any] interface {
+    EncodeKey(key K) string
+    // DecodeKey returns a MalformedKey error for a string EncodeKey never returns.
+    DecodeKey(data string) (K, error)
+}
+
+// Integer is the type set of the keys IntKey encodes.
+type Integer interface {
+    ~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// StringKey uses string keys as they are.
+type StringKey struct{}
+
+// IntKey encodes integer keys in 8 big endian bytes, the sign bit of signed keys flipped,
+// so negative keys sort before positive ones.
+type IntKey[K Integer] struct{}
+
+// Pair is a composite key of two parts, ordered by First then Second.
+type Pair[A any, B any] struct {
+    First A
+    Second B
+}
+
+// PairKey encodes Pair keys with the encoders of their parts.
+// Every part is escaped and terminated, so a part that is a prefix of another sorts first.
+type PairKey[A any, B any] struct {
+    First KeyEncoder[A]
+    Second KeyEncoder[B]
+}
+
+// Typed is a view of a datastore with keys of type K and values of type V,
+// encoded by a KeyEncoder and a Codec.
+type Typed[K any, V any] struct {
+    bitcask *Bitcask
+    keys KeyEncoder[K]
+    codec Codec[V]
+}
+
+// NewTyped returns a view of bitcask that stores keys with keys and values with codec.
+func NewTyped[K any, V any](bitcask *Bitcask, keys KeyEncoder[K], codec Codec[V]) *Typed[K, V] {
+
+    return &Typed[K, V]{bitcask: bitcask, keys: keys, codec: codec}
+
+}
+
+// Get returns the value of key.
+// returns an error if key does not exist or its value cannot be decoded.
+func (typed *Typed[K, V]) Get(key K) (V, error) {
+
+    var value V
+    data, err := typed.bitcask.Get(typed.keys.EncodeKey(key))
+    if err != nil {
+        return value, err
+    }
+
+    return typed.codec.Decode(data)
+
+}
+
+// Put stores value by key.
+func (typed *Typed[K, V]) Put(key K, value V) error {
+
+    data, err := typed.codec.Encode(value)
+    if err != nil {
+        return err
+    }
+
+    return typed.bitcask.Put(typed.keys.EncodeKey(key), data)
+
+}
+
+// Delete removes key.
+// returns an error if key does not exist.
+func (typed *Typed[K, V]) Delete(key K) error {
+
+    return typed.bitcask.Delete(typed.keys.EncodeKey(key))
+
+}
+
+// Keys returns the keys of the view in order.
+// Keys of the datastore that the KeyEncoder cannot decode belong to another view and are skipped.
+func (typed *Typed[K, V]) Keys() []K {
+
+    var keys []K
+    for _, encoded := range typed.sortedKeys() {
+        if key, err := typed.keys.DecodeKey(encoded); err == nil {
+            keys = append(keys, key)
+        }
+    }
+
+    return keys
+
+}
+
+// ForEach calls fun with every key and value of the view in key order, until fun returns false.
+// A key deleted while ForEach runs is skipped.
+// returns an error if a value cannot be decoded.
+func (typed *Typed[K, V]) ForEach(fun func(key K, value V) bool) error {
+
+    return typed.forEachEncoded(typed.sortedKeys(), fun)
+
+}
+
+// Range calls fun with every key from from, included, to to, excluded, and its value in key order,
+// until fun returns false.
+// returns an error if a value cannot be decoded.
+func (typed *Typed[K, V]) Range(from K, to K, fun func(key K, value V) bool) error {
+
+    low, high := typed.keys.EncodeKey(from), typed.keys.EncodeKey(to)
+    encoded := typed.sortedKeys()
+    start := sort.SearchStrings(encoded, low)
+    end := sort.SearchStrings(encoded, high)
+    if end < start {
+        end = start
+    }
+
+    return typed.forEachEncoded(encoded[start:end], fun)
+
+}
+
+// FoldTyped folds over the keys and values of a Typed view in key order.
+// returns an error if a value cannot be decoded.
+func FoldTyped[K any, V any, A any](typed *Typed[K, V], fun func(key K, value V, acc A) A, acc A) (A, error) {
+
+    err := typed.ForEach(func(key K, value V) bool {
+        acc = fun(key, value, acc)
+        return true
+    })
+
+    return acc, err
+
+}
+
+func (typed *Typed[K, V]) sortedKeys() []string {
+
+    keys := typed.bitcask.ListKeys()
+    sort.Strings(keys)
+
+    return keys
+
+}
+
+func (typed *Typed[K, V]) forEachEncoded(encoded []string, fun func(key K, value V) bool) error {
+
+    for _, encodedKey := range encoded {
+        key, err := typed.keys.DecodeKey(encodedKey)
+        if err != nil {
+            continue
+        }
+        data, err := typed.bitcask.Get(encodedKey)
+        if err != nil {
+            continue
+        }
+        value, err := typed.codec.Decode(data)
+        if err != nil {
+            return err
+        }
+        if !fun(key, value) {
+            break
+        }
+    }
+
+    return nil
+
+}
+
+func (JSONCodec[V]) Encode(value V) (string, error) {
+
+    data, err := json.Marshal(value)
+
+    return string(data), err
+
+}
+
+func (JSONCodec[V]) Decode(data string) (V, error) {
+
+    var value V
+    err := json.Unmarshal([]byte(data), &value)
+
+    return value, err
+
+}
+
+func (GobCodec[V]) Encode(value V) (string, error) {
+
+    var buf bytes.Buffer
+    err := gob.NewEncoder(&buf).Encode(value)
+
+    return buf.String(), err
+
+}
+
+func (GobCodec[V]) Decode(data string) (V, error) {
+
+    var value V
+    err := gob.NewDecoder(strings.NewReader(data)).Decode(&value)
+
+    return value, err
+
+}
+
+func (BytesCodec) Encode(value []byte) (string, error) {
+
+    return string(value), nil
+
+}
+
+func (BytesCodec) Decode(data string) ([]byte, error) {
+
+    return []byte(data), nil
+
+}
+
+func (StringKey) EncodeKey(key string) string {
+
+    return key
+
+}
+
+func (StringKey) DecodeKey(data string) (string, error) {
+
+    return data, nil
+
+}
+
+func (IntKey[K]) EncodeKey(key K) string {
+
+    var buf [8]byte
+    binary.BigEndian.PutUint64(buf[:], uint64(key) ^ intKeySignBit[K]())
+
+    return string(buf[:])
+
+}
+
+func (IntKey[K]) DecodeKey(data string) (K, error) {
+
+    if len(data) != 8 {
+        return 0, BitcaskError(fmt.Sprintf("%q: %s", data, MalformedKey))
+    }
+    bits := binary.BigEndian.Uint64([]byte(data)) ^ intKeySignBit[K]()
+    key := K(bits)
+    if uint64(key) != bits {
+        return 0, BitcaskError(fmt.Sprintf("%q: %s", data, MalformedKey))
+    }
+
+    return key, nil
+
+}
+
+// intKeySignBit returns the bit IntKey flips, the sign bit for a signed K and none for an unsigned one.
+func intKeySignBit[K Integer]() uint64 {
+
+    var zero K
+    if zero - 1 < zero {
+        return 1 << 63
+    }
+
+    return 0
+
+}
+
+func (pair PairKey[A, B]) EncodeKey(key Pair[A, B]) string {
+
+    return escapeKeyPart(pair.First.EncodeKey(key.First)) + escapeKeyPart(pair.Second.EncodeKey(key.Second))
+
+}
+
+func (pair PairKey[A, B]) DecodeKey(data string) (Pair[A, B], error) {
+
+    var key Pair[A, B]
+    first, rest, isOk := unescapeKeyPart(data)
+    if !isOk {
+        return key, BitcaskError(fmt.Sprintf("%q: %s", data, MalformedKey))
+    }
+    second, rest, isOk := unescapeKeyPart(rest)
+    if !isOk || rest != "" {
+        return key, BitcaskError(fmt.Sprintf("%q: %s", data, MalformedKey))
+    }
+
+    var err error
+    if key.First, err = pair.First.DecodeKey(first); err != nil {
+        return key, err
+    }
+    if key.Second, err = pair.Second.DecodeKey(second); err != nil {
+        return key, err
+    }
+
+    return key, nil
+
+}
+
+// escapeKeyPart escapes every 0x00 of a composite key part as 0x00 0xff and terminates it with 0x00 0x01,
+// which sorts before any byte the part may go on with.
+func escapeKeyPart(part string) string {
+
+    return strings.ReplaceAll(part, "\x00", "\x00\xff") + "\x00\x01"
+
+}
+
+// unescapeKeyPart returns the first part of a composite key and what follows it.
+func unescapeKeyPart(data string) (string, string, bool) {
+
+    var part strings.Builder
+    for i := 0; i < len(data); i++ {
+        if data[i] != 0 {
+            part.WriteByte(data[i])
+            continue
+        }
+        if i + 1 == len(data) {
+            return "", "", false
+        }
+        switch data[i + 1] {
+        case 0xff:
+            part.WriteByte(0)
+            i++
+        case 0x01:
+            return part.String(), data[i + 2:], true
+        default:
+            return "", "", false
+        }
+    }
+
+    return "", "", false
+
+}
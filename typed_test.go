@@ -0,0 +1,187 @@
+package bitcask
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type testUser struct {
+    Name string
+    Age int
+}
+
+func TestTyped(t *testing.T) {
+
+    t.Run("put get and delete with the json codec", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        defer b.Close()
+        users := NewTyped[string, testUser](b, StringKey{}, JSONCodec[testUser]{})
+
+        users.Put("ada", testUser{"Ada", 36})
+        got, err := users.Get("ada")
+        if err != nil || got != (testUser{"Ada", 36}) {
+            t.Errorf("got %+v, %v, want %+v", got, err, testUser{"Ada", 36})
+        }
+        raw, _ := b.Get("ada")
+        assertString(t, raw, `{"Name":"Ada","Age":36}`)
+
+        users.Delete("ada")
+        _, err = users.Get("ada")
+        assertError(t, err, "ada: key does not exist")
+
+    })
+
+    t.Run("gob and bytes codecs round trip", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        defer b.Close()
+
+        gobUsers := NewTyped[int, testUser](b, IntKey[int]{}, GobCodec[testUser]{})
+        gobUsers.Put(1, testUser{"Grace", 85})
+        gotUser, err := gobUsers.Get(1)
+        if err != nil || gotUser != (testUser{"Grace", 85}) {
+            t.Errorf("got %+v, %v", gotUser, err)
+        }
+
+        blobs := NewTyped[string, []byte](b, StringKey{}, BytesCodec{})
+        blobs.Put("blob", []byte{0, 1, 2, '\n', 255})
+        gotBlob, _ := blobs.Get("blob")
+        if !reflect.DeepEqual(gotBlob, []byte{0, 1, 2, '\n', 255}) {
+            t.Errorf("got %v", gotBlob)
+        }
+
+    })
+
+    t.Run("a value that does not decode is an error", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        defer b.Close()
+        users := NewTyped[string, testUser](b, StringKey{}, JSONCodec[testUser]{})
+
+        b.Put("bad", "not json")
+        if _, err := users.Get("bad"); err == nil {
+            t.Errorf("expected an error decoding %q", "not json")
+        }
+        if err := users.ForEach(func(string, testUser) bool { return true }); err == nil {
+            t.Errorf("expected ForEach to fail decoding %q", "not json")
+        }
+
+    })
+
+    t.Run("iterate, range and fold in key order", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        defer b.Close()
+        scores := NewTyped[int64, int](b, IntKey[int64]{}, JSONCodec[int]{})
+
+        for _, key := range []int64{300, -7, 42, math.MinInt64, 0, math.MaxInt64, -300} {
+            scores.Put(key, int(key % 1000))
+        }
+        b.Put("not an int key", "1")
+
+        want := []int64{math.MinInt64, -300, -7, 0, 42, 300, math.MaxInt64}
+        if got := scores.Keys(); !reflect.DeepEqual(got, want) {
+            t.Errorf("Keys() = %v, want %v", got, want)
+        }
+
+        var visited []int64
+        scores.ForEach(func(key int64, value int) bool {
+            visited = append(visited, key)
+            return len(visited) < 3
+        })
+        if !reflect.DeepEqual(visited, want[:3]) {
+            t.Errorf("ForEach stopped after %v, want %v", visited, want[:3])
+        }
+
+        visited = nil
+        scores.Range(-7, 300, func(key int64, value int) bool {
+            visited = append(visited, key)
+            return true
+        })
+        if !reflect.DeepEqual(visited, []int64{-7, 0, 42}) {
+            t.Errorf("Range(-7, 300) visited %v", visited)
+        }
+
+        sum, err := FoldTyped(scores, func(key int64, value int, acc int) int {
+            return acc + value
+        }, 0)
+        if err != nil || sum != 300 - 7 + 42 - 300 + int(math.MinInt64 % 1000) + int(math.MaxInt64 % 1000) {
+            t.Errorf("FoldTyped() = %d, %v", sum, err)
+        }
+
+    })
+
+}
+
+func TestKeyEncoders(t *testing.T) {
+
+    t.Run("int keys keep their order", func(t *testing.T) {
+
+        random := rand.New(rand.NewSource(1))
+        checkKeyOrder[int32](t, IntKey[int32]{}, func() int32 { return int32(random.Uint32()) },
+            func(a, b int32) bool { return a < b })
+        checkKeyOrder[uint16](t, IntKey[uint16]{}, func() uint16 { return uint16(random.Uint32()) },
+            func(a, b uint16) bool { return a < b })
+        checkKeyOrder[int8](t, IntKey[int8]{}, func() int8 { return int8(random.Uint32()) },
+            func(a, b int8) bool { return a < b })
+
+    })
+
+    t.Run("pair keys keep their order", func(t *testing.T) {
+
+        random := rand.New(rand.NewSource(2))
+        parts := []string{"", "a", "a\x00", "a\x00\x00b", "a\x01", "ab", "b", "\x00", "\xff"}
+        encoder := PairKey[string, int]{StringKey{}, IntKey[int]{}}
+        checkKeyOrder[Pair[string, int]](t, encoder, func() Pair[string, int] {
+            return Pair[string, int]{parts[random.Intn(len(parts))], random.Intn(7) - 3}
+        }, func(a, b Pair[string, int]) bool {
+            return a.First < b.First || a.First == b.First && a.Second < b.Second
+        })
+
+    })
+
+    t.Run("malformed keys do not decode", func(t *testing.T) {
+
+        _, err := IntKey[int64]{}.DecodeKey("short")
+        assertError(t, err, `"short": malformed key`)
+        _, err = IntKey[uint8]{}.DecodeKey("\x00\x00\x00\x00\x00\x00\x01\x00")
+        assertError(t, err, `"\x00\x00\x00\x00\x00\x00\x01\x00": malformed key`)
+        encoder := PairKey[string, string]{StringKey{}, StringKey{}}
+        for _, data := range []string{"a", "a\x00\x01", "a\x00\x01b\x00\x01c", "a\x00\x02b\x00\x01"} {
+            if _, err := encoder.DecodeKey(data); err == nil {
+                t.Errorf("%q decoded as a pair", data)
+            }
+        }
+
+    })
+
+}
+
+// checkKeyOrder encodes random keys and checks that they decode back
+// and that the encoded keys sort as the keys do.
+func checkKeyOrder[K any](t *testing.T, encoder KeyEncoder[K], randomKey func() K, less func(a, b K) bool) {
+
+    t.Helper()
+
+    keys := make([]K, 500)
+    for i := range keys {
+        keys[i] = randomKey()
+    }
+    sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+
+    for i, key := range keys {
+        decoded, err := encoder.DecodeKey(encoder.EncodeKey(key))
+        if err != nil || !reflect.DeepEqual(decoded, key) {
+            t.Fatalf("%v decoded to %v, %v", key, decoded, err)
+        }
+        if i > 0 && less(keys[i - 1], key) && encoder.EncodeKey(keys[i - 1]) >= encoder.EncodeKey(key) {
+            t.Fatalf("%v encodes after %v", fmt.Sprint(keys[i - 1]), fmt.Sprint(key))
+        }
+    }
+
+}
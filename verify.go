@@ -0,0 +1,215 @@
+package bitcask
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+    TornRecord = "torn or corrupted record"
+    HintMismatch = "hint file does not match its data file"
+    OrphanHintFile = "hint file without a data file"
+    BadCheckpoint = "checkpoint does not match the data files"
+    StaleLock = "lock file left by a process"
+    StaleFile = "file left by a crashed process"
+)
+
+// Problem is an inconsistency Verify found in a file of a datastore.
+// Offset is the position of a torn record in a data file, 0 for problems with a whole file.
+type Problem struct {
+    File string
+    Offset int64
+    Description string
+}
+
+func (problem Problem) String() string {
+
+    if problem.Offset > 0 {
+        return fmt.Sprintf("%s at offset %d: %s", problem.File, problem.Offset, problem.Description)
+    }
+
+    return fmt.Sprintf("%s: %s", problem.File, problem.Description)
+
+}
+
+// Verify checks a datastore no process has open and returns the problems found.
+// Every data file record must be intact and match its checksum, every hint file
+// must hold exactly the last record of each key of its data file and the checkpoint
+// must point at intact records. Lock, keydir and temporary files are left by crashed processes.
+// It takes the FileSystem option.
+// returns an error if the directory cannot be read.
+func Verify(dirPath string, opts ...ConfigOpt) ([]Problem, error) {
+
+    return verify(dirPath, false, opts)
+
+}
+
+// Repair verifies a datastore no process has open, as Verify, and repairs the problems found.
+// Torn data files are truncated after their last intact record, hint files that do not
+// match their data file are rebuilt, and orphan hint files, a bad checkpoint and the files
+// left by crashed processes are removed. Data files in an unknown format are left as they are.
+// It takes the FileSystem option.
+// returns the problems found before the repair.
+func Repair(dirPath string, opts ...ConfigOpt) ([]Problem, error) {
+
+    return verify(dirPath, true, opts)
+
+}
+
+func verify(dirPath string, repair bool, opts []ConfigOpt) ([]Problem, error) {
+
+    var problems []Problem
+    var fileNames []string
+    hintFiles := make(map[string]bool)
+    dataFiles := make(map[string]bool)
+    intactEnds := make(map[string]int64)
+    rebuildHints := make(map[string]bool)
+    isTruncated := false
+
+    bitcask := Bitcask{
+        directoryPath: dirPath,
+        config: newOptions(opts),
+    }
+    bitcask.keyDir = bitcask.newBucketKeyDir()
+    fs := bitcask.config.fs
+
+    files, err := fs.ReadDir(dirPath)
+    if err != nil {
+        return nil, BitcaskError(fmt.Sprintf("%s: %s", dirPath, CannotOpenThisDir))
+    }
+    sort.Slice(files, func(i, j int) bool {
+        return files[i].Name() < files[j].Name()
+    })
+
+    for _, file := range files {
+        name := file.Name()
+        if strings.HasPrefix(name, readLock) || strings.HasPrefix(name, writeLock) {
+            problems = append(problems, Problem{name, 0, StaleLock})
+        } else if strings.HasPrefix(name, ".") || strings.HasPrefix(name, keyDirFilePrefix) {
+            problems = append(problems, Problem{name, 0, StaleFile})
+        } else if strings.HasPrefix(name, hintFilePrefix) {
+            hintFiles[strings.TrimPrefix(name, hintFilePrefix)] = true
+        } else if _, err := strconv.ParseInt(name, 10, 64); err == nil {
+            fileNames = append(fileNames, name)
+            dataFiles[name] = true
+        }
+    }
+    if repair {
+        for _, problem := range problems {
+            if err := fs.Remove(path.Join(dirPath, problem.File)); err != nil {
+                return problems, err
+            }
+        }
+    }
+
+    for _, name := range fileNames {
+        hints, intactEnd, err := bitcask.scanDataFile(name, 0)
+        if err != nil {
+            problems = append(problems, Problem{name, 0, strings.TrimPrefix(err.Error(), name + ": ")})
+            continue
+        }
+        intactEnds[name] = intactEnd
+
+        info, err := fs.Stat(path.Join(dirPath, name))
+        if err != nil {
+            return problems, err
+        }
+        if intactEnd > 0 && info.Size() > intactEnd {
+            problems = append(problems, Problem{name, intactEnd, TornRecord})
+            isTruncated = true
+            rebuildHints[name] = true
+            if repair {
+                if err := fs.Truncate(path.Join(dirPath, name), intactEnd); err != nil {
+                    return problems, err
+                }
+            }
+        }
+
+        if hintFiles[name] {
+            fileHints, err := bitcask.extractHintFile(hintFilePrefix + name)
+            if err != nil || !sameHints(fileHints, hints) {
+                problems = append(problems, Problem{hintFilePrefix + name, 0, HintMismatch})
+                rebuildHints[name] = true
+            }
+        }
+    }
+
+    for name := range hintFiles {
+        if !dataFiles[name] {
+            problems = append(problems, Problem{hintFilePrefix + name, 0, OrphanHintFile})
+            if repair {
+                if err := fs.Remove(path.Join(dirPath, hintFilePrefix + name)); err != nil {
+                    return problems, err
+                }
+            }
+        }
+    }
+
+    if _, err := fs.Stat(path.Join(dirPath, checkpointFileName)); err == nil && !bitcask.checkCheckpoint(dataFiles, intactEnds) {
+        problems = append(problems, Problem{checkpointFileName, 0, BadCheckpoint})
+        isTruncated = true
+    }
+    if repair && isTruncated {
+        if err := fs.Remove(path.Join(dirPath, checkpointFileName)); err != nil && !os.IsNotExist(err) {
+            return problems, err
+        }
+    }
+
+    if repair {
+        for name := range rebuildHints {
+            if err := fs.Remove(path.Join(dirPath, hintFilePrefix + name)); err != nil && !os.IsNotExist(err) {
+                return problems, err
+            }
+            if _, err := bitcask.extractDataFile(name, 0); err != nil {
+                return problems, err
+            }
+        }
+    }
+
+    return problems, nil
+
+}
+
+// checkCheckpoint reports whether the checkpoint loads and every record in it,
+// and the position it covers, lies before the end of the intact records of its data file.
+func (bitcask *Bitcask) checkCheckpoint(dataFiles map[string]bool, intactEnds map[string]int64) bool {
+
+    coveredFileId, coveredPos, isCheckpointed := bitcask.loadCheckpoint(dataFiles)
+    if !isCheckpointed {
+        return false
+    }
+
+    coveredName := strconv.FormatInt(coveredFileId, 10)
+    if dataFiles[coveredName] && coveredPos > intactEnds[coveredName] {
+        return false
+    }
+
+    isIntact := true
+    bitcask.keyDir.forEach(func(bucket int64, key string, recValue record) {
+        if recValue.valuePos + recValue.valueSize > intactEnds[recValue.fileId] {
+            isIntact = false
+        }
+    })
+
+    return isIntact
+
+}
+
+func sameHints(first map[bucketKey]record, second map[bucketKey]record) bool {
+
+    if len(first) != len(second) {
+        return false
+    }
+    for key, recValue := range first {
+        if other, isExist := second[key]; !isExist || other != recValue {
+            return false
+        }
+    }
+
+    return true
+
+}
@@ -0,0 +1,335 @@
+package bitcask
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+    PutEvent    EventKind = 0
+    DeleteEvent EventKind = 1
+
+    DropEvents  WatchFlag = 0
+    BlockWrites WatchFlag = 1
+    DeliverOnApply WatchFlag = 2
+    DeliverOnSync  WatchFlag = 3
+
+    defaultWatchBuffer = 64
+)
+
+// EventKind tells a Put event from a Delete event.
+type EventKind int
+
+// Event is a write of a watched key, with the timestamp and sequence number of the write.
+// Missed is the number of events dropped just before this one because the watcher was too slow.
+type Event struct {
+    Kind EventKind
+    Key string
+    Tstamp int64
+    Seq uint64
+    Missed uint64
+    bucket int64
+}
+
+// WatchOpt configures a watch when passed to Watch.
+type WatchOpt interface {
+    applyWatch(config *watchOptions)
+}
+
+// WatchFlag is a WatchOpt that takes no value, like BlockWrites or DeliverOnSync.
+type WatchFlag int
+
+type watchBufferOpt int
+
+type watchOptions struct {
+    buffer int
+    isBlocking bool
+    isSynced bool
+}
+
+// watcher is a watch registered by Watch, it gets the events of the writes of bucket after fromSeq.
+// done is closed by cancel, so a write blocked on a watcher that stopped reading gives up.
+// unsynced, unsyncedMissed and synced hold the events of a DeliverOnSync watcher waiting for an fsync,
+// the count of those dropped past its buffer and those released by the fsync, they are guarded by mu.
+type watcher struct {
+    bucket int64
+    prefix string
+    fromSeq uint64
+    config watchOptions
+    events chan Event
+    done chan struct{}
+    missed uint64
+    unsynced []Event
+    unsyncedMissed uint64
+    synced []Event
+}
+
+func (kind EventKind) String() string {
+
+    if kind == DeleteEvent {
+        return "delete"
+    }
+
+    return "put"
+
+}
+
+func (opt WatchFlag) applyWatch(config *watchOptions) {
+
+    switch opt {
+    case DropEvents:
+        config.isBlocking = false
+    case BlockWrites:
+        config.isBlocking = true
+    case DeliverOnApply:
+        config.isSynced = false
+    case DeliverOnSync:
+        config.isSynced = true
+    }
+
+}
+
+// WatchBuffer sets how many events a watch buffers for a slow reader, 64 by default.
+func WatchBuffer(n int) WatchOpt {
+
+    return watchBufferOpt(n)
+
+}
+
+func (opt watchBufferOpt) applyWatch(config *watchOptions) {
+
+    config.buffer = int(opt)
+    if config.buffer < 0 {
+        config.buffer = 0
+    }
+
+}
+
+// Watch returns a channel of the Put and Delete events of the keys starting with prefix, in sequence order,
+// and a function that cancels the watch. The keys of buckets are watched by the Watch of their bucket.
+// It takes options DropEvents, BlockWrites, WatchBuffer, DeliverOnApply and DeliverOnSync.
+// DeliverOnApply, the default, delivers an event once the write is applied, before Put returns.
+// DeliverOnSync delivers it once the write is fsynced, by Sync or by the sync option the datastore was opened with.
+// When the buffer of the channel is full, DropEvents, the default, drops the event and counts it in the Missed
+// of the next one, BlockWrites makes writers wait for the reader, which then must not write to the datastore,
+// until the watch is cancelled or the datastore closed.
+// With DeliverOnSync the buffer also bounds the events waiting for an fsync.
+// The events past it are dropped and counted in the Missed of the next one, whatever the option.
+// The channel is closed by cancel and by Close, the events not delivered yet are dropped by Close.
+// Only the writes of this process are watched.
+func (bitcask *Bitcask) Watch(prefix string, opts ...WatchOpt) (<-chan Event, func()) {
+
+    return bitcask.watch(defaultBucket, prefix, opts)
+
+}
+
+// Watch returns a channel of the Put and Delete events of the keys of the bucket starting with prefix,
+// and a function that cancels the watch, with the options of the Watch of the datastore.
+// Once the bucket is dropped the watch gets no more events.
+func (bucket *Bucket) Watch(prefix string, opts ...WatchOpt) (<-chan Event, func()) {
+
+    return bucket.bitcask.watch(bucket.id, prefix, opts)
+
+}
+
+func (bitcask *Bitcask) watch(bucket int64, prefix string, opts []WatchOpt) (<-chan Event, func()) {
+
+    watch := &watcher{
+        bucket: bucket,
+        prefix: prefix,
+        config: watchOptions{buffer: defaultWatchBuffer},
+        done: make(chan struct{}),
+    }
+    for _, opt := range opts {
+        opt.applyWatch(&watch.config)
+    }
+    watch.events = make(chan Event, watch.config.buffer)
+
+    bitcask.watchMu.Lock()
+    bitcask.mu.Lock()
+    if bitcask.watchers == nil {
+        bitcask.watchers = make(map[*watcher]bool)
+    }
+    bitcask.watchers[watch] = true
+    watch.fromSeq = bitcask.lastSeq
+    if watch.config.isSynced {
+        bitcask.syncedWatchers++
+    } else {
+        bitcask.appliedWatchers++
+    }
+    bitcask.mu.Unlock()
+    bitcask.watchMu.Unlock()
+
+    var once sync.Once
+    cancel := func() {
+        once.Do(func() {
+            close(watch.done)
+            bitcask.watchMu.Lock()
+            bitcask.removeWatcher(watch)
+            bitcask.watchMu.Unlock()
+        })
+    }
+
+    return watch.events, cancel
+
+}
+
+// queueEvent queues the event of a write of a key for the watchers, the reserved buckets are not watched.
+// It must be called with mu held, right after the write is applied to keyDir,
+// and reports whether there is an event to deliver right away.
+func (bitcask *Bitcask) queueEvent(bucket int64, kind EventKind, key string, tstamp int64, seq uint64) bool {
+
+    if bucket < defaultBucket {
+        return false
+    }
+
+    event := Event{Kind: kind, Key: key, Tstamp: tstamp, Seq: seq, bucket: bucket}
+    if bitcask.syncedWatchers > 0 {
+        for watch := range bitcask.watchers {
+            if watch.config.isSynced && watch.wants(event) {
+                watch.queueUnsynced(event)
+            }
+        }
+    }
+    if bitcask.appliedWatchers > 0 {
+        bitcask.appliedEvents = append(bitcask.appliedEvents, event)
+        return true
+    }
+
+    return false
+
+}
+
+// releaseSyncedEvents makes the events of the writes up to seq, now fsynced, ready for the watchers
+// of DeliverOnSync. It must be called with mu held, and reports whether an event was released.
+func (bitcask *Bitcask) releaseSyncedEvents(seq uint64) bool {
+
+    isReleased := false
+    for watch := range bitcask.watchers {
+        n := 0
+        for n < len(watch.unsynced) && watch.unsynced[n].Seq <= seq {
+            n++
+        }
+        if n == 0 {
+            continue
+        }
+        watch.synced = append(watch.synced, watch.unsynced[:n]...)
+        watch.unsynced = append([]Event(nil), watch.unsynced[n:]...)
+        isReleased = true
+    }
+
+    return isReleased
+
+}
+
+// wants reports whether event is a write the watcher gets.
+func (watch *watcher) wants(event Event) bool {
+
+    return event.bucket == watch.bucket && event.Seq > watch.fromSeq && strings.HasPrefix(event.Key, watch.prefix)
+
+}
+
+// queueUnsynced keeps event until it is fsynced, or drops it and counts it in the Missed of the next one
+// when the buffer of the watcher is full, at least one event is kept. mu must be held.
+func (watch *watcher) queueUnsynced(event Event) {
+
+    if len(watch.unsynced) > 0 && len(watch.unsynced) >= watch.config.buffer {
+        watch.unsyncedMissed++
+        return
+    }
+    event.Missed = watch.unsyncedMissed
+    watch.unsyncedMissed = 0
+    watch.unsynced = append(watch.unsynced, event)
+
+}
+
+// deliverEvents hands the queued events to the watchers.
+// watchMu is held while sending, so events are delivered in sequence order
+// whichever writer delivers them, and writers wait for a blocking watcher until Close.
+func (bitcask *Bitcask) deliverEvents() {
+
+    bitcask.watchMu.Lock()
+    defer bitcask.watchMu.Unlock()
+
+    bitcask.mu.Lock()
+    applied := bitcask.appliedEvents
+    bitcask.appliedEvents = nil
+    synced := make(map[*watcher][]Event)
+    for watch := range bitcask.watchers {
+        if len(watch.synced) > 0 {
+            synced[watch] = watch.synced
+            watch.synced = nil
+        }
+    }
+    bitcask.mu.Unlock()
+
+    for watch := range bitcask.watchers {
+        events := applied
+        if watch.config.isSynced {
+            events = synced[watch]
+        }
+        for _, event := range events {
+            if watch.wants(event) {
+                watch.send(event, bitcask.closed)
+            }
+        }
+    }
+
+}
+
+// send hands an event to the watcher, a blocking send gives up once the watch is cancelled or closed is closed.
+func (watch *watcher) send(event Event, closed chan struct{}) {
+
+    event.Missed += watch.missed
+    if watch.config.isBlocking {
+        select {
+        case watch.events <- event:
+            watch.missed = 0
+        case <-watch.done:
+        case <-closed:
+        }
+        return
+    }
+
+    select {
+    case watch.events <- event:
+        watch.missed = 0
+    default:
+        watch.missed = event.Missed + 1
+    }
+
+}
+
+// removeWatcher unregisters a watcher and closes its channel, watchMu must be held.
+func (bitcask *Bitcask) removeWatcher(watch *watcher) {
+
+    if !bitcask.watchers[watch] {
+        return
+    }
+
+    bitcask.mu.Lock()
+    delete(bitcask.watchers, watch)
+    if watch.config.isSynced {
+        bitcask.syncedWatchers--
+    } else {
+        bitcask.appliedWatchers--
+    }
+    if bitcask.appliedWatchers == 0 {
+        bitcask.appliedEvents = nil
+    }
+    bitcask.mu.Unlock()
+    close(watch.events)
+
+}
+
+// closeWatchers drops the events left and closes the channels of every watcher.
+// closed must be closed first, so a writer blocked on a watcher releases watchMu.
+func (bitcask *Bitcask) closeWatchers() {
+
+    bitcask.watchMu.Lock()
+    defer bitcask.watchMu.Unlock()
+    for watch := range bitcask.watchers {
+        bitcask.removeWatcher(watch)
+    }
+
+}
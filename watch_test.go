@@ -0,0 +1,236 @@
+package bitcask
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+
+    t.Run("events of the watched prefix in order", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        defer b.Close()
+        b.Put("user:old", "before the watch")
+        events, cancel := b.Watch("user:")
+        defer cancel()
+
+        b.Put("user:ada", "36")
+        b.Put("order:1", "ada")
+        b.Delete("user:ada")
+        users, _ := b.Bucket("users")
+        users.Put("user:bob", "in a bucket")
+        b.Put("user:bob", "41")
+
+        assertEvents(t, events, "put user:ada", "delete user:ada", "put user:bob")
+        assertNoEvent(t, events)
+
+    })
+
+    t.Run("a slow watcher misses events", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        defer b.Close()
+        events, cancel := b.Watch("", WatchBuffer(2))
+        defer cancel()
+
+        for _, key := range []string{"a", "b", "c", "d", "e"} {
+            b.Put(key, "value")
+        }
+        assertEvents(t, events, "put a", "put b")
+        b.Put("f", "value")
+        event := <-events
+        if event.Key != "f" || event.Missed != 3 {
+            t.Errorf("got event %+v, want f after 3 missed", event)
+        }
+
+    })
+
+    t.Run("a blocking watcher holds writers back", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        defer b.Close()
+        events, cancel := b.Watch("", BlockWrites, WatchBuffer(1))
+
+        b.Put("a", "value")
+        done := make(chan struct{})
+        go func() {
+            b.Put("b", "value")
+            close(done)
+        }()
+        select {
+        case <-done:
+            t.Fatal("Put returned while the watcher buffer was full")
+        case <-time.After(50 * time.Millisecond):
+        }
+
+        assertEvents(t, events, "put a")
+        <-done
+        assertEvents(t, events, "put b")
+
+        // a cancelled watcher no longer holds writers back.
+        b.Put("c", "value")
+        go cancel()
+        b.Put("d", "value")
+
+    })
+
+    t.Run("a blocking watcher that stopped reading does not hang Close", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        events, _ := b.Watch("", BlockWrites, WatchBuffer(1))
+
+        b.Put("a", "value")
+        written := make(chan struct{})
+        go func() {
+            b.Put("b", "value")
+            close(written)
+        }()
+        select {
+        case <-written:
+            t.Fatal("Put returned while the watcher buffer was full")
+        case <-time.After(50 * time.Millisecond):
+        }
+        closed := make(chan struct{})
+        go func() {
+            b.Close()
+            close(closed)
+        }()
+        select {
+        case <-closed:
+        case <-time.After(5 * time.Second):
+            t.Fatal("Close blocked on a watcher that stopped reading")
+        }
+        <-written
+        assertEvents(t, events, "put a")
+        if _, isOpen := <-events; isOpen {
+            t.Error("the channel is still open after Close")
+        }
+
+    })
+
+    t.Run("the keys of a bucket are watched by the bucket", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, FileSystem(NewMemFS()))
+        defer b.Close()
+        users, _ := b.Bucket("users")
+        events, cancel := users.Watch("a")
+        defer cancel()
+        plain, cancelPlain := b.Watch("")
+        defer cancelPlain()
+
+        users.Put("ada", "36")
+        users.Put("bob", "41")
+        b.Put("alan", "in the default bucket")
+        users.Delete("ada")
+        b.Bucket("orders")
+
+        assertEvents(t, events, "put ada", "delete ada")
+        assertNoEvent(t, events)
+        assertEvents(t, plain, "put alan")
+        assertNoEvent(t, plain)
+
+    })
+
+    t.Run("events delivered once synced", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, SyncOnDemand, FileSystem(NewMemFS()))
+        defer b.Close()
+        events, cancel := b.Watch("", DeliverOnSync)
+        defer cancel()
+
+        b.Put("a", "value")
+        b.Delete("a")
+        assertNoEvent(t, events)
+        b.Sync()
+        assertEvents(t, events, "put a", "delete a")
+
+        b2, _ := Open(testBitcaskPath + "2", ReadWrite, SyncOnPut, FileSystem(NewMemFS()))
+        defer b2.Close()
+        events2, cancel2 := b2.Watch("", DeliverOnSync)
+        defer cancel2()
+        b2.Put("b", "value")
+        assertEvents(t, events2, "put b")
+
+    })
+
+    t.Run("events waiting for a sync are bounded by the buffer", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, SyncOnDemand, FileSystem(NewMemFS()))
+        defer b.Close()
+        events, cancel := b.Watch("", DeliverOnSync, WatchBuffer(10))
+        defer cancel()
+
+        for i := 0; i < 100; i++ {
+            b.Put(fmt.Sprintf("key%d", i), "value")
+        }
+        b.mu.RLock()
+        for watch := range b.watchers {
+            if n := len(watch.unsynced); n != 10 {
+                t.Errorf("got %d events waiting for a sync, want 10", n)
+            }
+        }
+        b.mu.RUnlock()
+
+        b.Sync()
+        for i := 0; i < 10; i++ {
+            assertEvents(t, events, fmt.Sprintf("put key%d", i))
+        }
+        b.Put("last", "value")
+        b.Sync()
+        event := <-events
+        if event.Key != "last" || event.Missed != 90 {
+            t.Errorf("got event of %q with %d missed, want \"last\" with 90", event.Key, event.Missed)
+        }
+
+    })
+
+    t.Run("cancel and close end the watch", func(t *testing.T) {
+
+        b, _ := Open(testBitcaskPath, ReadWrite, SyncOnDemand, FileSystem(NewMemFS()))
+        events, cancel := b.Watch("")
+        synced, _ := b.Watch("", DeliverOnSync)
+        cancel()
+        cancel()
+        if _, isOpen := <-events; isOpen {
+            t.Error("the channel is still open after cancel")
+        }
+
+        b.Put("a", "value")
+        b.Close()
+        assertEvents(t, synced, "put a")
+        if _, isOpen := <-synced; isOpen {
+            t.Error("the channel is still open after Close")
+        }
+
+    })
+
+}
+
+func assertEvents(t testing.TB, events <-chan Event, want ...string) {
+
+    t.Helper()
+    for _, description := range want {
+        select {
+        case event := <-events:
+            if got := event.Kind.String() + " " + event.Key; got != description {
+                t.Errorf("got event %q, want %q", got, description)
+            }
+        case <-time.After(time.Second):
+            t.Fatalf("got no event, want %q", description)
+        }
+    }
+
+}
+
+func assertNoEvent(t testing.TB, events <-chan Event) {
+
+    t.Helper()
+    select {
+    case event := <-events:
+        t.Errorf("got event %+v, want none", event)
+    default:
+    }
+
+}